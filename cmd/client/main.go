@@ -71,8 +71,35 @@ func start(ctx context.Context, lg *zap.Logger, config *client.Config) error {
 		}
 	}
 
+	profile, err := proxy.LookupProfile(config.ShapeProfile)
+	if err != nil {
+		return err
+	}
+	styles, err := proxy.ParseStyleSet(config.Styles)
+	if err != nil {
+		return err
+	}
+	opts := &proxy.Options{
+		Profile: profile,
+		Styles:  styles,
+	}
+	if config.CaptureFile != "" {
+		path := config.CaptureFile
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			startLog.Error("create capture file", zap.String("path", path), zap.Error(err))
+			return fmt.Errorf("create capture file \"%s\": %v", path, err)
+		}
+		defer file.Close()
+
+		opts.Capture, err = proxy.NewCapture(file)
+		if err != nil {
+			return fmt.Errorf("write capture header: %v", err)
+		}
+	}
+
 	url := config.ProxyURL
-	tunnel, err := proxy.Connect(ctx, url, config.AuthToken)
+	tunnel, err := proxy.Connect(ctx, url, config.AuthToken, opts)
 	if err != nil {
 		startLog.Error("connect to proxy server", zap.String("url", url), zap.Error(err))
 		return fmt.Errorf("connect to proxy server: %v", err)
@@ -82,13 +109,16 @@ func start(ctx context.Context, lg *zap.Logger, config *client.Config) error {
 	err = nat.Setup(config.LocalTCPPort, config.LocalUDPPort)
 	if err != nil {
 		startLog.Error("setup local nat", zap.Uint16("tcp.port", config.LocalTCPPort), zap.Uint16("udp.port", config.LocalUDPPort), zap.Error(err))
+		// remove rules which were added before failure
+		cleanupNAT(lg, &nat)
 		return fmt.Errorf("setup local nat: %v", err)
 	}
 	defer cleanupNAT(lg, &nat)
 
-	go tunnel.Serve(ctx)
+	link := client.NewLink(lg, url, config.AuthToken, opts, tunnel)
+	go link.Run(ctx)
 
-	err = client.RunLocalServer(ctx, lg, config, tunnel, &resolver, &router)
+	err = client.RunLocalServer(ctx, lg, config, link, &resolver, &router)
 	if err != nil {
 		lg.Error("run local server", zap.Error(err))
 		return fmt.Errorf("run local server: %v", err)
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/mebyus/higs/proxy"
+	"github.com/mebyus/higs/wsok"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: higs-dump <capture file>\n\n")
+		fmt.Fprintf(os.Stderr, "Decodes tunnel capture into a timeline of packets.\n")
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := proxy.NewCaptureReader(file)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	var d dumper
+	d.w = w
+	for {
+		var rec proxy.CaptureRecord
+		err = r.Next(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			d.summary()
+			return err
+		}
+		d.record(&rec)
+	}
+	d.summary()
+	return nil
+}
+
+// Tracks current tunnel while capture records are printed.
+type dumper struct {
+	w io.Writer
+
+	// start of current tunnel, frame times are relative to it
+	start time.Time
+
+	up   *proxy.Key
+	down *proxy.Key
+
+	// number of tunnels seen so far
+	tunnels int
+
+	frames int
+
+	// frames which failed control sum or authentication
+	tampered int
+
+	// frames which could not be decoded for other reasons
+	broken int
+}
+
+func (d *dumper) record(rec *proxy.CaptureRecord) {
+	if rec.Begin {
+		d.tunnels += 1
+		d.start = rec.Time
+		d.up = rec.Up
+		d.down = rec.Down
+		fmt.Fprintf(d.w, "tunnel %d started at %s (sealed: %t)\n",
+			d.tunnels, rec.Time.UTC().Format(time.RFC3339Nano), rec.Up != nil)
+		return
+	}
+
+	d.frames += 1
+	fmt.Fprintf(d.w, "%12.6f %-4s %6d B  ", rec.Time.Sub(d.start).Seconds(), rec.Dir, len(rec.Data))
+	if rec.Op != wsok.OpBin {
+		fmt.Fprintf(d.w, "frame op=0x%x\n", uint8(rec.Op))
+		return
+	}
+
+	var p proxy.Packet
+	p.InitDecode(rec.Salt)
+	p.UseKey(rec.Key(d.up, d.down))
+	p.UseStyles(proxy.AllStyles)
+	err := proxy.Decode(&p, bytes.Clone(rec.Data))
+	if err != nil {
+		if errors.Is(err, proxy.ErrPacketSum) || errors.Is(err, proxy.ErrPacketAuth) {
+			d.tampered += 1
+			fmt.Fprintf(d.w, "!! %v, frame was corrupted or tampered with\n", err)
+			return
+		}
+		d.broken += 1
+		fmt.Fprintf(d.w, "!! decode: %v\n", err)
+		return
+	}
+
+	fmt.Fprintf(d.w, "%-5s cid=%s seq=%d size=%d", p.Type, p.CID, p.Seq, len(p.Data))
+	switch p.Type {
+	case proxy.PacketClose:
+		var c proxy.Close
+		err = proxy.DecodeClose(&c, p.Data)
+		if err == nil {
+			fmt.Fprintf(d.w, " code=%s", c.Code)
+		}
+	case proxy.PacketPing:
+		var ping proxy.Ping
+		err = proxy.DecodePing(&ping, p.Data)
+		if err == nil {
+			fmt.Fprintf(d.w, " kind=%s value=%d", ping.Kind, ping.Value)
+		}
+	case proxy.PacketHello:
+		if len(p.Data) == 0 {
+			// server accepts connection with empty hello
+			fmt.Fprint(d.w, " accepted")
+			break
+		}
+		var h proxy.Hello
+		err = proxy.DecodeHello(&h, p.Data)
+		if err == nil {
+			if h.Name != "" {
+				fmt.Fprintf(d.w, " name=%s port=%d", h.Name, h.AddrPort.Port())
+			} else {
+				fmt.Fprintf(d.w, " addr=%s", h.AddrPort)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(d.w, " !! payload: %v", err)
+	}
+	fmt.Fprintln(d.w)
+}
+
+func (d *dumper) summary() {
+	fmt.Fprintf(d.w, "\ntunnels: %d, frames: %d, tampered: %d, broken: %d\n",
+		d.tunnels, d.frames, d.tampered, d.broken)
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/mebyus/higs/proxy"
 	"github.com/mebyus/higs/scf"
 )
 
@@ -22,6 +23,21 @@ type Config struct {
 	// Zero value means info level.
 	LogLevel string
 
+	// Name of traffic shaping profile for packets sent to proxy server.
+	// Empty name means no shaping.
+	ShapeProfile string
+
+	// Comma-separated list of packet styles offered to proxy server.
+	// Empty list means default styles.
+	Styles string
+
+	// Path to file for capturing tunnel frames, each reconnect appends
+	// a new tunnel to it. Capture is disabled if this field is empty.
+	// Capture holds tunnel keys and should be enabled only for debugging.
+	CaptureFile string
+
+	// Ports of local proxy server. Local tcp and udp traffic to port 443
+	// (https and quic) is redirected to them, see LocalNAT.
 	LocalTCPPort uint16
 	LocalUDPPort uint16
 }
@@ -53,6 +69,18 @@ func (c *Config) Apply(name, rawValue string) error {
 		var v string
 		v, err = scf.ParseStringValue(rawValue)
 		c.LogLevel = v
+	case "shape_profile":
+		var v string
+		v, err = scf.ParseStringValue(rawValue)
+		c.ShapeProfile = v
+	case "styles":
+		var v string
+		v, err = scf.ParseStringValue(rawValue)
+		c.Styles = v
+	case "capture_file":
+		var v string
+		v, err = scf.ParseStringValue(rawValue)
+		c.CaptureFile = v
 	case "local_tcp_port":
 		var v uint16
 		v, err = scf.ParseUint16Value(rawValue)
@@ -80,5 +108,13 @@ func (c *Config) Valid() error {
 	if c.LocalUDPPort == 0 {
 		return errors.New("empty or zero local udp port")
 	}
+	_, err := proxy.LookupProfile(c.ShapeProfile)
+	if err != nil {
+		return err
+	}
+	_, err = proxy.ParseStyleSet(c.Styles)
+	if err != nil {
+		return err
+	}
 	return nil
 }
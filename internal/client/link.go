@@ -0,0 +1,140 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/mebyus/higs/proxy"
+)
+
+// Link keeps tunnel to proxy server alive. When tunnel dies (for example
+// server stops replying to keepalive pings) link connects a new one.
+type Link struct {
+	lg *zap.Logger
+
+	url   string
+	token string
+
+	// options for all tunnels
+	opts *proxy.Options
+
+	// Protects current tunnel.
+	mu sync.Mutex
+
+	// current tunnel, nil while reconnecting
+	tunnel *proxy.Tunnel
+}
+
+// Delay before first reconnect attempt, doubled after each failed attempt.
+const minReconnectDelay = time.Second
+
+const maxReconnectDelay = 30 * time.Second
+
+// Interval for logging tunnel round trip time.
+const statsLogInterval = time.Minute
+
+var ErrNoTunnel = errors.New("no tunnel to proxy server")
+
+// NewLink creates link which starts with already connected tunnel.
+// Options are used for reconnecting tunnels.
+func NewLink(lg *zap.Logger, url, token string, opts *proxy.Options, tunnel *proxy.Tunnel) *Link {
+	return &Link{
+		lg:     lg.Named("link"),
+		url:    url,
+		token:  token,
+		opts:   opts,
+		tunnel: tunnel,
+	}
+}
+
+// Open creates a new stream inside current tunnel.
+func (l *Link) Open(ctx context.Context, network string, addr string) (*proxy.Stream, error) {
+	l.mu.Lock()
+	t := l.tunnel
+	l.mu.Unlock()
+
+	if t == nil {
+		return nil, ErrNoTunnel
+	}
+	return t.Open(ctx, network, addr)
+}
+
+// RTT returns round trip time statistics of current tunnel.
+func (l *Link) RTT() proxy.RTTStats {
+	l.mu.Lock()
+	t := l.tunnel
+	l.mu.Unlock()
+
+	if t == nil {
+		return proxy.RTTStats{}
+	}
+	return t.RTT()
+}
+
+// Run serves current tunnel and reconnects it until context is canceled.
+// Reconnecting stops if server rejects client as incompatible.
+func (l *Link) Run(ctx context.Context) error {
+	go l.logStats(ctx)
+
+	delay := minReconnectDelay
+	for {
+		l.mu.Lock()
+		t := l.tunnel
+		l.mu.Unlock()
+
+		if t != nil {
+			err := t.Serve(ctx)
+			rtt := t.RTT()
+			l.lg.Warn("tunnel closed", zap.Error(err), zap.Duration("rtt", rtt.SRTT), zap.Duration("jitter", rtt.Jitter))
+
+			l.mu.Lock()
+			l.tunnel = nil
+			l.mu.Unlock()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		t, err := proxy.Connect(ctx, l.url, l.token, l.opts)
+		if errors.Is(err, proxy.ErrIncompatible) {
+			// retrying will not help until client or server is upgraded
+			l.lg.Error("proxy server rejected client", zap.Error(err))
+			return err
+		}
+		if err != nil {
+			l.lg.Error("reconnect to proxy server", zap.Error(err), zap.Duration("delay", delay))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			delay = min(2*delay, maxReconnectDelay)
+			continue
+		}
+		l.lg.Info("reconnected to proxy server")
+		delay = minReconnectDelay
+
+		l.mu.Lock()
+		l.tunnel = t
+		l.mu.Unlock()
+	}
+}
+
+func (l *Link) logStats(ctx context.Context) {
+	ticker := time.NewTicker(statsLogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rtt := l.RTT()
+			l.lg.Info("tunnel stats", zap.Duration("rtt", rtt.SRTT), zap.Duration("jitter", rtt.Jitter), zap.Int("missed", rtt.Missed))
+		}
+	}
+}
@@ -3,21 +3,29 @@ package client
 import (
 	"os"
 	"path/filepath"
+
+	"github.com/mebyus/higs/proxy"
 )
 
+// ProxyConn is a connection to destination which goes through proxy tunnel.
 type ProxyConn struct {
+	stream *proxy.Stream
 }
 
 func (c *ProxyConn) Read(b []byte) (int, error) {
-	return 0, nil
+	return c.stream.Read(b)
 }
 
 func (c *ProxyConn) Write(b []byte) (int, error) {
-	return 0, nil
+	return c.stream.Write(b)
 }
 
 func (c *ProxyConn) Close() error {
-	return nil
+	return c.stream.Close()
+}
+
+func (c *ProxyConn) CloseWrite() error {
+	return c.stream.CloseWrite()
 }
 
 // FileConn mainly used for testing as a simple implementation of Socket.
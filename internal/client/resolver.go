@@ -12,6 +12,9 @@ import (
 
 type Resolver struct {
 	m map[string]*ResolveEntry
+
+	// reverse mapping from address to name
+	r map[netip.Addr]string
 }
 
 func LoadNamesFromFile(r *Resolver, path string) error {
@@ -118,15 +121,25 @@ func parseNamesLine(line string) ([]string, error) {
 
 func (r *Resolver) init(entries []ResolveEntry) {
 	m := make(map[string]*ResolveEntry)
+	rm := make(map[netip.Addr]string)
 	for i := range len(entries) {
 		entry := &entries[i]
 
 		for _, name := range entry.Names {
 			m[name] = entry
 		}
+
+		// first name in entry is used for reverse lookups
+		for _, ip := range entry.List {
+			_, ok := rm[ip]
+			if !ok {
+				rm[ip] = entry.Names[0]
+			}
+		}
 	}
 
 	r.m = m
+	r.r = rm
 }
 
 // Resolve returns nil if there is no entry with specified name.
@@ -137,3 +150,9 @@ func (r *Resolver) Resolve(name string) []netip.Addr {
 	}
 	return entry.List
 }
+
+// LookupName returns name which resolves to specified address.
+// Returns empty string if there is no such name.
+func (r *Resolver) LookupName(ip netip.Addr) string {
+	return r.r[ip]
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"net/netip"
 	"slices"
 	"strings"
 	"testing"
@@ -85,3 +86,48 @@ func Test_parseNames(t *testing.T) {
 		})
 	}
 }
+
+func TestResolver_LookupName(t *testing.T) {
+	var r Resolver
+	err := parseNames(&r, strings.NewReader(testNames))
+	if err != nil {
+		t.Errorf("parseNames() error = %v", err)
+		return
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{
+			ip:   "10.10.10.10",
+			want: "",
+		},
+		{
+			ip:   "188.186.154.88",
+			want: "instagram.com",
+		},
+		{
+			ip:   "64.233.162.136",
+			want: "youtube.com",
+		},
+		{
+			ip:   "209.85.233.198",
+			want: "youtube.ru",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			ip, err := netip.ParseAddr(tt.ip)
+			if err != nil {
+				t.Errorf("ParseAddr() error = %v", err)
+				return
+			}
+
+			got := r.LookupName(ip)
+			if got != tt.want {
+				t.Errorf("Resolver.LookupName() got = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -6,13 +6,13 @@ import (
 	"io"
 	"net"
 	"os"
-	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/mebyus/higs/internal/dns"
-	"github.com/mebyus/higs/proxy"
 )
 
 type Server struct {
@@ -28,20 +28,52 @@ type Server struct {
 	// next accepted connection id
 	next uint64
 
-	tunnel *proxy.Tunnel
+	link *Link
+
+	// active udp associations
+	assocs map[udpKey]*udpAssoc
+
+	// guards assocs
+	amu sync.Mutex
 
 	lg *zap.Logger
 }
 
+// Relays data in both directions until both sides finish sending.
+// End of data in one direction is passed to the other side via half-close.
 func relayData(client, backend Socket) {
+	done := make(chan struct{})
 	go func() {
-		io.Copy(backend, client)
-		backend.Close()
+		defer close(done)
+		relayHalf(backend, client)
 	}()
-	io.Copy(client, backend)
+	relayHalf(client, backend)
+	<-done
+}
+
+func relayHalf(dst, src Socket) {
+	_, err := io.Copy(dst, src)
+	if err != nil {
+		// abort relay in both directions
+		dst.Close()
+		src.Close()
+		return
+	}
+	closeWrite(dst)
+}
+
+// Signals end of data to socket peer. Closes socket completely if it
+// does not support half-close.
+func closeWrite(s Socket) {
+	h, ok := s.(interface{ CloseWrite() error })
+	if ok {
+		h.CloseWrite()
+		return
+	}
+	s.Close()
 }
 
-func RunLocalServer(ctx context.Context, lg *zap.Logger, config *Config, tunnel *proxy.Tunnel, resolver *Resolver, router *Router) error {
+func RunLocalServer(ctx context.Context, lg *zap.Logger, config *Config, link *Link, resolver *Resolver, router *Router) error {
 	lg = lg.Named("local")
 
 	port := config.LocalTCPPort
@@ -49,11 +81,21 @@ func RunLocalServer(ctx context.Context, lg *zap.Logger, config *Config, tunnel
 
 	var server Server
 	server.address = address
-	server.tunnel = tunnel
+	server.link = link
 	server.lg = lg
 	server.resolver = resolver
 	server.router = router
 	server.dns = dns.NewProxy(resolver)
+	server.assocs = make(map[udpKey]*udpAssoc)
+
+	if config.LocalUDPPort != 0 {
+		go func() {
+			err := server.ListenAndRelayUDP(ctx, config.LocalUDPPort)
+			if err != nil {
+				lg.Error("relay udp", zap.Error(err))
+			}
+		}()
+	}
 
 	// go func() {
 	// 	err := server.HandleDNS(ctx, config.LocalUDPPort)
@@ -180,14 +222,22 @@ func (s *Server) handleConnection(c *Connection, done <-chan struct{}) {
 		fmt.Printf("new direct connection (id=%d) from %v to %s established\n", c.id, clientAddress, ap)
 		out = destConn
 	case ActionProxy:
-		var f FileConn
-		err := f.Init(filepath.Join("tcp", strconv.FormatUint(c.id, 10)))
+		// prefer name known from local dns mapping, so that server resolves it
+		target := ap.String()
+		name := s.resolver.LookupName(ap.Addr())
+		if name != "" {
+			target = net.JoinHostPort(name, strconv.FormatUint(uint64(ap.Port()), 10))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), openTimeout)
+		stream, err := s.link.Open(ctx, "tcp", target)
+		cancel()
 		if err != nil {
-			fmt.Printf("create dump file for connection (id=%d): %v\n", c.id, err)
+			fmt.Printf("proxy destination %s open: %v\n", target, err)
 			return
 		}
-		fmt.Printf("new file dump for connection (id=%d) created\n", c.id)
-		out = &f
+		fmt.Printf("new proxy connection (id=%d) from %v to %s established\n", c.id, clientAddress, target)
+		out = &ProxyConn{stream: stream}
 	case ActionBlock:
 		return
 	default:
@@ -202,6 +252,9 @@ func (s *Server) handleConnection(c *Connection, done <-chan struct{}) {
 	fmt.Printf("relay of connection (id=%d) ended\n", c.id)
 }
 
+// Max time for establishing proxied connection.
+const openTimeout = 10 * time.Second
+
 // Socket represents a two-way full duplex connection between client and server.
 type Socket interface {
 	Read([]byte) (int, error)
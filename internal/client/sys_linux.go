@@ -10,6 +10,7 @@ import (
 	"net/netip"
 	"os"
 	"os/exec"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -17,7 +18,25 @@ import (
 	"unsafe"
 )
 
-type LocalNAT struct{}
+// LocalNAT redirects traffic of local processes (except root) to local
+// proxy server with iptables rules.
+//
+// Only destination port 443 is redirected: tcp for https and udp for quic.
+// Traffic to other ports goes directly.
+type LocalNAT struct {
+	// iptables rules added by Setup, Disable removes exactly them
+	rules []iptablesRule
+
+	// set when udp policy routing was added
+	tproxy bool
+}
+
+// Rule in specific iptables table. Spec starts with chain name
+// and is the same for adding and deleting the rule.
+type iptablesRule struct {
+	table string
+	spec  []string
+}
 
 func (n *LocalNAT) Setup(tcpPort, udpPort uint16) error {
 	err := n.addRule("tcp", 443, tcpPort)
@@ -29,11 +48,93 @@ func (n *LocalNAT) Setup(tcpPort, udpPort uint16) error {
 	// 	return fmt.Errorf("add dns redirect rule: %v", err)
 	// }
 
+	if udpPort != 0 {
+		err = n.addTransparentRule(443, udpPort)
+		if err != nil {
+			return fmt.Errorf("add quic tproxy rule: %v", err)
+		}
+	}
+
 	return nil
 }
 
+// Disable removes rules added by Setup. Other rules in the same
+// tables are left intact.
 func (n *LocalNAT) Disable() error {
-	return execProc(time.Second, "iptables", "-t", "nat", "-F")
+	var errs []error
+	for _, r := range slices.Backward(n.rules) {
+		err := n.exec("-D", r)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	n.rules = nil
+
+	if n.tproxy {
+		// policy routing may be partially added, thus errors are ignored
+		execProc(time.Second, "ip", "rule", "del", "fwmark", tproxyMark, "lookup", tproxyTable)
+		execProc(time.Second, "ip", "route", "flush", "table", tproxyTable)
+		n.tproxy = false
+	}
+	return errors.Join(errs...)
+}
+
+// Adds rule to iptables and remembers it for Disable.
+func (n *LocalNAT) add(table string, spec ...string) error {
+	r := iptablesRule{table: table, spec: spec}
+	err := n.exec("-A", r)
+	if err != nil {
+		return err
+	}
+	n.rules = append(n.rules, r)
+	return nil
+}
+
+func (n *LocalNAT) exec(op string, r iptablesRule) error {
+	args := append([]string{"-t", r.table, op}, r.spec...)
+	return execProc(time.Second, "iptables", args...)
+}
+
+// Firewall mark and routing table used for delivering locally
+// originated udp packets to transparent socket.
+const (
+	tproxyMark  = "0x1"
+	tproxyTable = "100"
+)
+
+// Udp cannot be redirected with nat while keeping original destination
+// available to the listener, thus TPROXY is used. Outgoing packets are
+// marked and routed back through loopback, where TPROXY delivers them to
+// the local transparent socket.
+func (n *LocalNAT) addTransparentRule(destPort, tproxyPort uint16) error {
+	dport := strconv.FormatUint(uint64(destPort), 10)
+	tport := strconv.FormatUint(uint64(tproxyPort), 10)
+
+	err := n.add("mangle",
+		"OUTPUT", "-p", "udp",
+		"-m", "owner", "!", "--uid-owner", "root",
+		"--dport", dport,
+		"-j", "MARK", "--set-mark", tproxyMark,
+	)
+	if err != nil {
+		return err
+	}
+	err = n.add("mangle",
+		"PREROUTING", "-p", "udp",
+		"-m", "mark", "--mark", tproxyMark,
+		"-j", "TPROXY", "--on-ip", "127.0.0.1", "--on-port", tport,
+		"--tproxy-mark", tproxyMark,
+	)
+	if err != nil {
+		return err
+	}
+
+	n.tproxy = true
+	err = execProc(time.Second, "ip", "rule", "add", "fwmark", tproxyMark, "lookup", tproxyTable)
+	if err != nil {
+		return err
+	}
+	return execProc(time.Second, "ip", "route", "add", "local", "0.0.0.0/0", "dev", "lo", "table", tproxyTable)
 }
 
 func (n *LocalNAT) addRule(network string, destPort, redirectPort uint16) error {
@@ -44,8 +145,8 @@ func (n *LocalNAT) addRule(network string, destPort, redirectPort uint16) error
 		panic(fmt.Sprintf("unexpected \"%s\" network", network))
 	}
 
-	return execProc(time.Second, "iptables", "-t", "nat",
-		"-A", "OUTPUT", "-p", network,
+	return n.add("nat",
+		"OUTPUT", "-p", network,
 		"-m", "owner", "!", "--uid-owner", "root",
 		"--dport", strconv.FormatUint(uint64(destPort), 10),
 		"-j", "REDIRECT", "--to-port", strconv.FormatUint(uint64(redirectPort), 10),
@@ -124,3 +225,77 @@ func swapEndianUint16(v uint16) uint16 {
 const (
 	SO_ORIGINAL_DST = 80
 )
+
+// Listens for udp packets delivered by TPROXY. Original destination of each
+// packet is passed in control message (see parseOriginalDestination).
+func listenTransparentUDP(port uint16) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setSockopts(c, []int{syscall.IP_TRANSPARENT, syscall.IP_RECVORIGDSTADDR})
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// Creates udp socket bound to non-local address, so that replies to
+// local client appear to come from original destination.
+func dialTransparentUDP(from netip.AddrPort) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setSockopts(c, []int{syscall.IP_TRANSPARENT})
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", from.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// Enables SO_REUSEADDR and the given boolean SOL_IP options on a socket.
+func setSockopts(c syscall.RawConn, opts []int) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if err != nil {
+			return
+		}
+		for _, opt := range opts {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, opt, 1)
+			if err != nil {
+				return
+			}
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Extracts original destination of udp packet from control messages
+// received on transparent socket.
+func parseOriginalDestination(oob []byte) (netip.AddrPort, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_IP || m.Header.Type != syscall.IP_ORIGDSTADDR {
+			continue
+		}
+		if len(m.Data) < syscall.SizeofSockaddrInet4 {
+			break
+		}
+
+		// data holds struct sockaddr_in with port in network byte order
+		port := uint16(m.Data[2])<<8 | uint16(m.Data[3])
+		ip := netip.AddrFrom4([4]byte(m.Data[4:8]))
+		return netip.AddrPortFrom(ip, port), nil
+	}
+	return netip.AddrPort{}, fmt.Errorf("no original destination")
+}
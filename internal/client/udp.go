@@ -0,0 +1,246 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/mebyus/higs/proxy"
+)
+
+// Udp association is closed after no datagrams were relayed in any
+// direction for this long.
+const udpIdleTimeout = 2 * time.Minute
+
+// Max number of datagrams from local client waiting for association
+// to be established or relayed. Excess datagrams are dropped.
+const udpQueueSize = 64
+
+// Fits any udp datagram.
+const udpBufferSize = 1 << 16
+
+// Size of buffer for control messages of transparent socket.
+const udpOOBSize = 64
+
+var errBlocked = errors.New("blocked by route")
+
+// Identifies udp association by local client address and original
+// destination of its datagrams.
+type udpKey struct {
+	src netip.AddrPort
+	dst netip.AddrPort
+}
+
+// udpAssoc relays datagrams between local client and its original
+// destination, either directly or through the proxy.
+type udpAssoc struct {
+	key udpKey
+
+	// datagrams from local client
+	in chan []byte
+
+	// closed when association should end
+	done chan struct{}
+
+	closeOnce sync.Once
+
+	// unix time in nanoseconds of last datagram relayed in any direction
+	active atomic.Int64
+}
+
+func (a *udpAssoc) close() {
+	a.closeOnce.Do(func() {
+		close(a.done)
+	})
+}
+
+func (a *udpAssoc) touch() {
+	a.active.Store(time.Now().UnixNano())
+}
+
+func (a *udpAssoc) idle() bool {
+	return time.Since(time.Unix(0, a.active.Load())) >= udpIdleTimeout
+}
+
+// ListenAndRelayUDP receives udp packets redirected by TPROXY (see LocalNAT)
+// and relays them according to routes until context is canceled.
+func (s *Server) ListenAndRelayUDP(ctx context.Context, port uint16) error {
+	lg := s.lg.Named("udp")
+
+	conn, err := listenTransparentUDP(port)
+	if err != nil {
+		return fmt.Errorf("listen udp %d: %v", port, err)
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, udpBufferSize)
+	oob := make([]byte, udpOOBSize)
+	for {
+		n, oobn, _, src, err := conn.ReadMsgUDPAddrPort(buf, oob)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			lg.Error("read datagram", zap.Error(err))
+			continue
+		}
+
+		dst, err := parseOriginalDestination(oob[:oobn])
+		if err != nil {
+			lg.Error("get original destination", zap.Stringer("src", src), zap.Error(err))
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		s.relayDatagram(udpKey{src: src, dst: dst}, data)
+	}
+}
+
+// Passes datagram to its association, new association is created
+// for first datagram.
+func (s *Server) relayDatagram(key udpKey, data []byte) {
+	s.amu.Lock()
+	a := s.assocs[key]
+	if a == nil {
+		a = &udpAssoc{
+			key:  key,
+			in:   make(chan []byte, udpQueueSize),
+			done: make(chan struct{}),
+		}
+		a.touch()
+		s.assocs[key] = a
+		go s.serveAssoc(a)
+	}
+	s.amu.Unlock()
+
+	select {
+	case a.in <- data:
+	default:
+		// queue is full, datagram is lost as with regular udp
+	}
+}
+
+func (s *Server) dropAssoc(a *udpAssoc) {
+	a.close()
+
+	s.amu.Lock()
+	if s.assocs[a.key] == a {
+		delete(s.assocs, a.key)
+	}
+	s.amu.Unlock()
+}
+
+func (s *Server) serveAssoc(a *udpAssoc) {
+	lg := s.lg.Named("udp").With(zap.Stringer("src", a.key.src), zap.Stringer("dst", a.key.dst))
+	defer s.dropAssoc(a)
+
+	out, err := s.dialDatagram(a.key.dst)
+	if err != nil {
+		if err != errBlocked {
+			lg.Error("open association", zap.Error(err))
+		}
+		return
+	}
+	defer out.Close()
+
+	// replies must come from original destination, otherwise
+	// local client drops them
+	reply, err := dialTransparentUDP(a.key.dst)
+	if err != nil {
+		lg.Error("bind reply socket", zap.Error(err))
+		return
+	}
+	defer reply.Close()
+
+	lg.Debug("new association")
+	go relayReplies(a, out, reply)
+
+	for {
+		select {
+		case <-a.done:
+			lg.Debug("association ended")
+			return
+		case data := <-a.in:
+			_, err := out.Write(data)
+			if errors.Is(err, proxy.ErrDatagramSize) {
+				// too large for proxy, datagram is lost as with regular udp
+				lg.Debug("drop datagram", zap.Int("size", len(data)))
+				continue
+			}
+			if err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+				lg.Debug("write datagram", zap.Error(err))
+				return
+			}
+			a.touch()
+		}
+	}
+}
+
+// Relays datagrams from destination back to local client until association
+// expires or fails.
+func relayReplies(a *udpAssoc, out net.Conn, reply *net.UDPConn) {
+	defer a.close()
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		out.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := out.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && !a.idle() {
+				// datagrams are still relayed in other direction
+				continue
+			}
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			return
+		}
+		a.touch()
+
+		_, err = reply.WriteToUDPAddrPort(buf[:n], a.key.src)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Opens datagram connection to destination according to routes.
+func (s *Server) dialDatagram(dst netip.AddrPort) (net.Conn, error) {
+	act := s.router.Lookup(dst.Addr())
+	switch act {
+	case ActionDirect, ActionAuto:
+		return net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(dst))
+	case ActionProxy:
+		// prefer name known from local dns mapping, so that server resolves it
+		target := dst.String()
+		name := s.resolver.LookupName(dst.Addr())
+		if name != "" {
+			target = net.JoinHostPort(name, strconv.FormatUint(uint64(dst.Port()), 10))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), openTimeout)
+		defer cancel()
+		return s.link.Open(ctx, "udp", target)
+	case ActionBlock:
+		return nil, errBlocked
+	default:
+		panic(fmt.Sprintf("unexpected action (=%d)", act))
+	}
+}
@@ -2,7 +2,6 @@ package dns
 
 import (
 	"errors"
-	"fmt"
 	"strings"
 )
 
@@ -11,8 +10,6 @@ var (
 )
 
 func Decode(m *Message, data []byte) error {
-	const debug = true
-
 	dec := decoder{buf: data}
 
 	var h header
@@ -20,9 +17,6 @@ func Decode(m *Message, data []byte) error {
 	if err != nil {
 		return err
 	}
-	if debug {
-		printHeader(&h)
-	}
 
 	quests, err := dec.quests(h.quests)
 	if err != nil {
@@ -37,11 +31,6 @@ func Decode(m *Message, data []byte) error {
 		return err
 	}
 
-	if debug {
-		fmt.Println()
-		fmt.Printf("decoded %d/%d bytes\n", dec.pos, len(data))
-	}
-
 	_ = records
 	m.Quests = quests
 	m.Answers = answers
@@ -78,6 +67,15 @@ var (
 	ErrNotEnoughData = errors.New("not enough data")
 )
 
+// Minimal encoded sizes of entries in message sections.
+const (
+	// shortest non-empty name is a pointer, followed by type and class
+	minQuestSize = 2 + 2 + 2
+
+	// shortest name is root, followed by type, class, ttl and data length
+	minRecordSize = 1 + 2 + 2 + 4 + 2
+)
+
 func (d *decoder) header(h *header) error {
 	if d.len() < 12 {
 		return ErrNoHeader
@@ -110,6 +108,12 @@ func (d *decoder) quests(num uint16) ([]Quest, error) {
 		return nil, nil
 	}
 
+	// header may declare more entries than data can hold,
+	// thus count is checked before allocation
+	if int(num) > d.len()/minQuestSize {
+		return nil, ErrNotEnoughData
+	}
+
 	quests := make([]Quest, num)
 	for i := range num {
 		q := &quests[i]
@@ -122,8 +126,6 @@ func (d *decoder) quests(num uint16) ([]Quest, error) {
 }
 
 func (d *decoder) quest(q *Quest) error {
-	const debug = true
-
 	name, err := d.name()
 	if err != nil {
 		return err
@@ -142,11 +144,6 @@ func (d *decoder) quest(q *Quest) error {
 	q.Name = name
 	q.Type = Type(typ)
 	q.Class = Class(class)
-
-	if debug {
-		printQuest(q)
-	}
-
 	return nil
 }
 
@@ -155,6 +152,10 @@ func (d *decoder) answers(num uint16) ([]Answer, error) {
 		return nil, nil
 	}
 
+	if int(num) > d.len()/minRecordSize {
+		return nil, ErrNotEnoughData
+	}
+
 	answers := make([]Answer, num)
 	for i := range num {
 		a := &answers[i]
@@ -175,6 +176,10 @@ func (d *decoder) records(num uint16) ([]Record, error) {
 		return nil, nil
 	}
 
+	if int(num) > d.len()/minRecordSize {
+		return nil, ErrNotEnoughData
+	}
+
 	records := make([]Record, num)
 	for i := range num {
 		r := &records[i]
@@ -187,8 +192,6 @@ func (d *decoder) records(num uint16) ([]Record, error) {
 }
 
 func (d *decoder) record(r *Record) error {
-	const debug = true
-
 	name, err := d.name()
 	if err != nil {
 		return err
@@ -213,11 +216,6 @@ func (d *decoder) record(r *Record) error {
 	r.Class = Class(class)
 	r.TTL = ttl
 	r.Data = data
-
-	if debug {
-		printRecord(r)
-	}
-
 	return nil
 }
 
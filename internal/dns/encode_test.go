@@ -1,65 +1,67 @@
 package dns
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 )
 
-func TestEncode(t *testing.T) {
-	tests := []struct {
-		name string
-		msg  Message
-	}{
-		{
-			name: "1 empty message",
-			msg:  Message{},
-		},
-		{
-			name: "2 only id",
-			msg:  Message{ID: 0xE30C},
+var encodeTests = []struct {
+	name string
+	msg  Message
+}{
+	{
+		name: "1 empty message",
+		msg:  Message{},
+	},
+	{
+		name: "2 only id",
+		msg:  Message{ID: 0xE30C},
+	},
+	{
+		name: "3 one quest",
+		msg: Message{
+			ID:     0xE30C,
+			Opcode: OpQuery,
+			Quests: []Quest{{
+				Name:  "ya.ru",
+				Type:  TypeAddr,
+				Class: Internet,
+			}},
 		},
-		{
-			name: "3 one quest",
-			msg: Message{
-				ID:     0xE30C,
-				Opcode: OpQuery,
-				Quests: []Quest{{
-					Name:  "ya.ru",
-					Type:  TypeAddr,
-					Class: Internet,
-				}},
-			},
+	},
+	{
+		name: "4 one answer",
+		msg: Message{
+			ID:     0xE30C,
+			Opcode: OpQuery,
+			Answers: []Answer{{
+				Name:  "ya.ru",
+				Type:  TypeAddr,
+				Class: Internet,
+				TTL:   581,
+				Data:  []byte{77, 88, 44, 242},
+			}},
 		},
-		{
-			name: "4 one answer",
-			msg: Message{
-				ID:     0xE30C,
-				Opcode: OpQuery,
-				Answers: []Answer{{
-					Name:  "ya.ru",
-					Type:  TypeAddr,
-					Class: Internet,
-					TTL:   581,
-					Data:  []byte{77, 88, 44, 242},
-				}},
-			},
-		},
-		{
-			name: "5 two answers",
-			msg: Message{
-				ID:     0xE30C,
-				Opcode: OpQuery,
-				Answers: []Answer{{
-					Name:  "ya.ru",
-					Type:  TypeAddr,
-					Class: Internet,
-					TTL:   581,
-					Data:  []byte{5, 255, 255, 242},
-				}},
-			},
+	},
+	{
+		name: "5 two answers",
+		msg: Message{
+			ID:     0xE30C,
+			Opcode: OpQuery,
+			Answers: []Answer{{
+				Name:  "ya.ru",
+				Type:  TypeAddr,
+				Class: Internet,
+				TTL:   581,
+				Data:  []byte{5, 255, 255, 242},
+			}},
 		},
-	}
-	for _, tt := range tests {
+	},
+}
+
+func TestEncode(t *testing.T) {
+	for _, tt := range encodeTests {
 		t.Run(tt.name, func(t *testing.T) {
 			// use small initial buffer to test that reallocations
 			// are handled correctly inside Encode function
@@ -79,3 +81,47 @@ func TestEncode(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeEntryCount(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{
+			name:   "1 too many questions",
+			header: []byte{0, 1, 0, 0, 0xFF, 0xFF, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:   "2 too many answers",
+			header: []byte{0, 1, 0, 0, 0, 0, 0xFF, 0xFF, 0, 0, 0, 0},
+		},
+		{
+			name:   "3 too many records",
+			header: []byte{0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// data holds a single entry of any kind
+			data := append(tt.header, 0xC0, 0x0C, 0, 1, 0, 1, 0, 0, 0, 0, 0, 0)
+
+			var msg Message
+			err := Decode(&msg, data)
+			if !errors.Is(err, ErrNotEnoughData) {
+				t.Errorf("Decode() error = %v, want %v", err, ErrNotEnoughData)
+			}
+		})
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, tt := range encodeTests {
+		f.Add(Encode(&tt.msg, nil))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg Message
+		Decode(&msg, data)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"log/slog"
 
+	"github.com/mebyus/higs/proxy"
 	"github.com/mebyus/higs/scf"
 )
 
@@ -21,6 +22,19 @@ type Config struct {
 	// Zero value means info level.
 	LogLevel slog.Level
 
+	// Name of traffic shaping profile for packets sent to clients.
+	// Empty name means no shaping.
+	ShapeProfile string
+
+	// Comma-separated list of packet styles accepted from clients.
+	// Empty list means default styles.
+	Styles string
+
+	// Directory for capture files, one file for each tunnel.
+	// Capture is disabled if this field is empty. Captures hold tunnel
+	// keys and should be enabled only for debugging.
+	CaptureDir string
+
 	// Required.
 	//
 	// Listen port.
@@ -46,6 +60,18 @@ func (c *Config) Apply(name, rawValue string) error {
 		var l slog.Level
 		l, err = scf.ParseLogLevel(rawValue)
 		c.LogLevel = l
+	case "shape_profile":
+		var v string
+		v, err = scf.ParseStringValue(rawValue)
+		c.ShapeProfile = v
+	case "styles":
+		var v string
+		v, err = scf.ParseStringValue(rawValue)
+		c.Styles = v
+	case "capture_dir":
+		var v string
+		v, err = scf.ParseStringValue(rawValue)
+		c.CaptureDir = v
 	case "port":
 		var v uint16
 		v, err = scf.ParseUint16Value(rawValue)
@@ -66,5 +92,13 @@ func (c *Config) Valid() error {
 	if c.Port == 0 {
 		return errors.New("empty or zero listen port")
 	}
+	_, err := proxy.LookupProfile(c.ShapeProfile)
+	if err != nil {
+		return err
+	}
+	_, err = proxy.ParseStyleSet(c.Styles)
+	if err != nil {
+		return err
+	}
 	return nil
 }
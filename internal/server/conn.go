@@ -1,9 +1,16 @@
 package server
 
 import (
+	"errors"
 	"io"
 	"log/slog"
+	"math/rand/v2"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/mebyus/higs/proxy"
 )
@@ -18,79 +25,315 @@ type Conn struct {
 
 	cid proxy.ConnID
 
-	// incoming packets from client connection
-	in chan *proxy.Packet
+	// incoming data chunks from client connection
+	in proxy.Queue
+
+	// credit for relaying remote data to client
+	sendw proxy.SendWindow
+
+	// accounts data received from client
+	recvw proxy.RecvWindow
 
 	// packets with data from target remote
 	// we need to relay them to client
-	out chan *proxy.Packet
+	//
+	// all connections of the tunnel share the same channel,
+	// which is drained by tunnel writer
+	out chan<- *proxy.Packet
+
+	// window credits and resets for client, shared with other connections
+	// as well, tunnel writer sends them ahead of data packets
+	ctrl chan<- *proxy.Packet
 
 	// signals when connection serve should end
 	done chan struct{}
 
+	closeOnce sync.Once
+
+	// used for generating junk in close and ping packets,
+	// shared by goroutines which read from and write to remote
+	g *rand.ChaCha8
+
+	// guards g
+	gmu sync.Mutex
+
+	// unix time in nanoseconds of last data relayed in any direction
+	active atomic.Int64
+
+	// set when close packet was received from client or sent to it,
+	// no more close packets should be sent after that
+	closed atomic.Bool
+
 	lg *slog.Logger
 }
 
-func serveConn(c *Conn) {
-	if c.hello.IP == nil {
+// Max time for establishing connection to target.
+const dialTimeout = 10 * time.Second
+
+// Connection is closed after no data was relayed in any direction
+// for this long.
+const idleTimeout = 5 * time.Minute
+
+func (t *Tunnel) serveConn(c *Conn) {
+	if c.hello.Name == "" && !c.hello.AddrPort.IsValid() {
 		panic("empty remote address")
 	}
 	lg := c.lg
+	defer t.dropConn(c.cid)
 
-	conn, err := net.DialTCP("tcp", nil, &net.TCPAddr{
-		IP:   c.hello.IP,
-		Port: int(c.hello.Port),
-	})
+	var conn net.Conn
+	var err error
+	switch {
+	case c.hello.Network == proxy.NetworkTCP:
+		// when hello carries host name it is resolved here by dialer
+		conn, err = net.DialTimeout("tcp", c.hello.Target(), dialTimeout)
+	case c.hello.Network == proxy.NetworkUDP && t.caps.Has(proxy.CapUDP):
+		conn, err = dialUDP(c.hello.Target())
+	default:
+		lg.Warn("unsupported network", slog.Int("network", int(c.hello.Network)))
+		c.sendClose(proxy.ClosePolicy)
+		c.close()
+		return
+	}
 	if err != nil {
 		lg.Error("init conn", slog.String("error", err.Error()))
+		c.sendClose(dialCloseCode(err))
+		c.close()
 		return
 	}
 
 	c.conn = conn
+	defer conn.Close()
+	c.touch()
+
+	// confirm to client that connection is established
+	if !c.send(&proxy.Packet{CID: c.cid, Type: proxy.PacketHello}) {
+		c.close()
+		return
+	}
 
-	go c.serveIncomingPackets(lg)
-	go c.serveRemoteReads(lg)
+	// connection is released after both directions are closed
+	var wg sync.WaitGroup
+	if c.hello.Network == proxy.NetworkUDP {
+		wg.Go(func() { c.serveIncomingDatagrams(lg) })
+		wg.Go(func() { c.serveRemoteDatagrams(lg) })
+	} else {
+		wg.Go(func() { c.serveIncomingPackets(lg) })
+		wg.Go(func() { c.serveRemoteReads(lg) })
+	}
+	go func() {
+		wg.Wait()
+		c.close()
+	}()
 
 	<-c.done
 }
 
+// Picks close code which describes dial error.
+func dialCloseCode(err error) proxy.CloseCode {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return proxy.CloseTimeout
+	}
+	return proxy.CloseDialRefused
+}
+
+// Signals connection serve to end. Safe to call multiple times.
+func (c *Conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.sendw.Close()
+	})
+}
+
+// Handles close packet from client.
+func (c *Conn) closeByPeer(cc proxy.CloseCode) {
+	if cc == proxy.CloseWrite {
+		// remote receives end of data after all queued data is written
+		c.in.Close()
+		return
+	}
+
+	c.lg.Debug("closed by client", slog.String("code", cc.String()))
+	c.closed.Store(true)
+	c.close()
+}
+
+// Marks connection as active at current time.
+func (c *Conn) touch() {
+	c.active.Store(time.Now().UnixNano())
+}
+
+// Reports whether no data was relayed for the given timeout.
+func (c *Conn) idle(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, c.active.Load())) >= timeout
+}
+
+// Queues packet for relaying to client. Returns false if connection
+// was closed before packet could be queued.
+func (c *Conn) send(p *proxy.Packet) bool {
+	select {
+	case <-c.done:
+		return false
+	case c.out <- p:
+		return true
+	}
+}
+
+func (c *Conn) sendClose(cc proxy.CloseCode) bool {
+	if cc != proxy.CloseWrite && c.closed.Swap(true) {
+		return false
+	}
+
+	c.gmu.Lock()
+	p := proxy.NewClosePacket(c.g, c.cid, cc)
+	c.gmu.Unlock()
+
+	return c.send(p)
+}
+
+// Queues reset packet ahead of data packets. Tunnel reader uses it and must
+// not wait for writer, thus reset is dropped if control queue is full.
+// Client ignores data packets of unknown streams, thus data queued for
+// this connection may safely follow the reset.
+func (c *Conn) sendReset() {
+	if c.closed.Swap(true) {
+		return
+	}
+
+	c.gmu.Lock()
+	p := proxy.NewClosePacket(c.g, c.cid, proxy.CloseReset)
+	c.gmu.Unlock()
+
+	select {
+	case c.ctrl <- p:
+	default:
+	}
+}
+
+// Grants more credit to client after n bytes were relayed to remote.
+func (c *Conn) consume(n int) bool {
+	k := c.recvw.Consume(n)
+	if k == 0 {
+		return true
+	}
+
+	c.gmu.Lock()
+	p := proxy.NewPingPacket(c.g, c.cid, proxy.PingWindow, uint64(k))
+	c.gmu.Unlock()
+
+	select {
+	case <-c.done:
+		return false
+	case c.ctrl <- p:
+		return true
+	}
+}
+
+// Relays data from client to remote. Returns after client closes its
+// sending side or on error.
 func (c *Conn) serveIncomingPackets(lg *slog.Logger) {
 	for {
-		select {
-		case <-c.done:
-			return
-		case packet := <-c.in:
-			_, err := c.conn.Write(packet.Data)
-			if err != nil {
-				if err == net.ErrClosed {
-					lg.Debug("exit serve incoming packets")
-					return
-				}
+		// check before pop, see Queue.Closed
+		fin := c.in.Closed()
+		data, ok := c.in.Pop()
+		if !ok {
+			if fin {
+				lg.Debug("client closed write")
+				closeWrite(c.conn)
+				return
+			}
+
+			select {
+			case <-c.done:
+				return
+			case <-c.in.Wait():
+				continue
+			}
+		}
+
+		n := len(data)
+		_, err := c.conn.Write(data)
+		proxy.PutBuffer(data)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
 				lg.Error("relay incoming data from client", slog.String("error", err.Error()))
+				c.sendClose(proxy.CloseReset)
+				c.close()
 			}
+			return
+		}
+		c.touch()
+		if !c.consume(n) {
+			return
 		}
 	}
 }
 
+// Sends end of data to remote. Closes connection completely if it
+// does not support half-close.
+func closeWrite(conn net.Conn) {
+	h, ok := conn.(interface{ CloseWrite() error })
+	if ok {
+		h.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// Relays data from remote to client. Returns after remote closes its
+// sending side or on error.
 func (c *Conn) serveRemoteReads(lg *slog.Logger) {
 	var buf [1 << 16]byte
 	for {
+		c.conn.SetReadDeadline(time.Now().Add(idleTimeout))
 		n, err := c.conn.Read(buf[:])
-		if err != nil {
-			if err == io.EOF || err == net.ErrClosed {
-				lg.Debug("exit serve remote reads")
+		for b := buf[:n]; len(b) != 0; {
+			k, err := c.sendw.Acquire(len(b), c.done, net.ErrClosed)
+			if err != nil {
 				return
 			}
 
-			lg.Error("read data from remote", slog.String("error", err.Error()))
+			// buffer is reused for next read, while packet waits
+			// in queue for writer
+			data := proxy.GetBuffer(k)
+			copy(data, b[:k])
+			b = b[k:]
+
+			if !c.send(&proxy.Packet{Data: data, CID: c.cid, Type: proxy.PacketData, Pooled: true}) {
+				return
+			}
+		}
+		if n != 0 {
+			c.touch()
+		}
+		if err == nil {
 			continue
 		}
 
-		data := buf[:n]
-
-		var packet proxy.Packet
-		packet.PutData(nil, c.cid, data)
-		proxy.Encode(&packet)
-		// TODO: transform to packet and send to out channel
+		switch {
+		case err == io.EOF:
+			lg.Debug("remote closed write")
+			c.sendClose(proxy.CloseWrite)
+		case errors.Is(err, net.ErrClosed):
+			lg.Debug("exit serve remote reads")
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			if !c.idle(idleTimeout) {
+				// data is still relayed in other direction
+				continue
+			}
+			lg.Debug("connection idle")
+			c.sendClose(proxy.CloseIdle)
+			c.close()
+		case errors.Is(err, syscall.ECONNRESET):
+			lg.Debug("remote reset connection")
+			c.sendClose(proxy.CloseReset)
+			c.close()
+		default:
+			lg.Error("read data from remote", slog.String("error", err.Error()))
+			c.sendClose(proxy.CloseReset)
+			c.close()
+		}
+		return
 	}
 }
@@ -6,7 +6,11 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
+	"sync"
 	"time"
+
+	"github.com/mebyus/higs/proxy"
 )
 
 type Server struct {
@@ -17,10 +21,38 @@ type Server struct {
 	mux *http.ServeMux
 
 	lg *slog.Logger
+
+	// traffic shaping profile for tunnels
+	profile *proxy.Profile
+
+	// styles which server accepts from clients
+	styles proxy.StyleSet
+
+	// Protects set of active tunnels.
+	mu sync.Mutex
+
+	// hijacked connections are not tracked by http server,
+	// thus tunnels are shut down separately
+	tunnels map[*Tunnel]struct{}
 }
 
 func (s *Server) Run(ctx context.Context, lg *slog.Logger) error {
 	s.lg = lg
+	profile, err := proxy.LookupProfile(s.Config.ShapeProfile)
+	if err != nil {
+		return err
+	}
+	s.profile = profile
+	s.styles, err = proxy.ParseStyleSet(s.Config.Styles)
+	if err != nil {
+		return err
+	}
+	if s.Config.CaptureDir != "" {
+		err = os.MkdirAll(s.Config.CaptureDir, 0o700)
+		if err != nil {
+			return err
+		}
+	}
 	s.mux = http.NewServeMux()
 	s.setupRoutes()
 
@@ -71,5 +103,39 @@ func (s *Server) shutdown() error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	return s.hs.Shutdown(ctx)
+	err := s.hs.Shutdown(ctx)
+
+	s.mu.Lock()
+	tunnels := make([]*Tunnel, 0, len(s.tunnels))
+	for t := range s.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	s.mu.Unlock()
+
+	for _, t := range tunnels {
+		go t.shutdown()
+	}
+	for _, t := range tunnels {
+		select {
+		case <-t.done:
+		case <-ctx.Done():
+			t.close()
+		}
+	}
+	return err
+}
+
+func (s *Server) addTunnel(t *Tunnel) {
+	s.mu.Lock()
+	if s.tunnels == nil {
+		s.tunnels = make(map[*Tunnel]struct{})
+	}
+	s.tunnels[t] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *Server) dropTunnel(t *Tunnel) {
+	s.mu.Lock()
+	delete(s.tunnels, t)
+	s.mu.Unlock()
 }
@@ -1,13 +1,14 @@
 package server
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math/rand/v2"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mebyus/higs/proxy"
@@ -15,13 +16,19 @@ import (
 )
 
 type Tunnel struct {
-	conn net.Conn
+	// websocket connection to client
+	ws *wsok.Conn
 
 	// signals when tunnel serve should end
 	done chan struct{}
 
-	rb *bufio.Reader
-	wb *bufio.Writer
+	// signals writer to send pending packets and end tunnel
+	quit chan struct{}
+
+	quitOnce sync.Once
+
+	// reused by reader for incoming messages
+	rbuf []byte
 
 	lg *slog.Logger
 
@@ -30,22 +37,85 @@ type Tunnel struct {
 
 	conns map[proxy.ConnID]*Conn
 
+	// outgoing packets from all connections, drained by writer
+	out chan *proxy.Packet
+
+	// outgoing control packets (pings and window credits), writer
+	// sends them ahead of packets from out
+	ctrl chan *proxy.Packet
+
+	closeOnce sync.Once
+
+	// used only by writer for encoding packets
 	g *rand.ChaCha8
+
+	// used only by reader for seeding connection generators
+	cg *rand.ChaCha8
+
+	// used only by keepalive goroutine
+	kg *rand.ChaCha8
+
+	// sequence number of next packet sent to client,
+	// only writer uses it
+	seq uint64
+
+	// key for packets from client
+	up *proxy.Key
+
+	// key for packets to client
+	down *proxy.Key
+
+	// tracks sequence numbers of packets from client
+	window proxy.ReplayWindow
+
+	// number of dropped replayed packets
+	replays atomic.Uint64
+
+	// tracks keepalive pings and measures round trip time
+	ka proxy.Keepalive
+
+	// time between keepalive pings, zero means proxy.PingInterval
+	pingInterval time.Duration
+
+	// traffic shaping profile for packets to client
+	profile *proxy.Profile
+
+	// records tunnel frames, nil if capture is disabled
+	capture *proxy.Capture
+
+	// styles negotiated with client
+	styles proxy.StyleSet
+
+	// capabilities negotiated with client
+	caps proxy.Caps
 }
 
 func serveTunnel(t *Tunnel) {
-	addr := t.conn.RemoteAddr().String()
+	addr := t.ws.RemoteAddr().String()
 	if t.g == nil {
 		var seed [32]byte
 		time.Now().AppendBinary(seed[:16])
 		copy(seed[16:], addr)
 		t.g = rand.NewChaCha8(seed)
 	}
+	if t.cg == nil {
+		var seed [32]byte
+		t.g.Read(seed[:])
+		t.cg = rand.NewChaCha8(seed)
+	}
+	if t.kg == nil {
+		var seed [32]byte
+		t.g.Read(seed[:])
+		t.kg = rand.NewChaCha8(seed)
+	}
 
 	lg := t.lg
 
 	lg.Info("new client", slog.String("addr", addr))
-	defer lg.Info("drop client")
+	defer func() {
+		rtt := t.ka.Stats()
+		lg.Info("drop client", slog.Duration("rtt", rtt.SRTT), slog.Duration("jitter", rtt.Jitter))
+	}()
 
 	defer func() {
 		p := recover()
@@ -57,38 +127,312 @@ func serveTunnel(t *Tunnel) {
 	}()
 
 	go t.serveIncomingFrames(lg)
+	go t.serveOutgoingPackets(lg)
+	go t.serveKeepalive(lg)
 
 	<-t.done
 }
 
+// Closes tunnel connection and all proxied connections.
+// Safe to call multiple times.
+func (t *Tunnel) close() {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		t.ws.Close()
+
+		t.mu.Lock()
+		for _, c := range t.conns {
+			c.close()
+		}
+		t.mu.Unlock()
+	})
+}
+
+// Notifies client that all connections are closed due to shutdown and
+// closes tunnel after pending packets are sent.
+func (t *Tunnel) shutdown() {
+	t.mu.RLock()
+	conns := make([]*Conn, 0, len(t.conns))
+	for _, c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.RUnlock()
+
+	for _, c := range conns {
+		c.sendClose(proxy.CloseShutdown)
+		c.close()
+	}
+	t.quitOnce.Do(func() {
+		close(t.quit)
+	})
+}
+
+// Periodically sends keepalive pings to client. Closes tunnel when
+// client stops replying.
+func (t *Tunnel) serveKeepalive(lg *slog.Logger) {
+	interval := t.pingInterval
+	if interval == 0 {
+		interval = proxy.PingInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	g := t.kg
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			nonce := g.Uint64()
+			if !t.ka.Next(nonce, now) {
+				lg.Warn("client stopped replying to pings")
+				t.close()
+				return
+			}
+
+			rtt := t.ka.Stats()
+			lg.Debug("ping", slog.Duration("rtt", rtt.SRTT), slog.Duration("jitter", rtt.Jitter), slog.Int("missed", rtt.Missed))
+			if !t.sendPing(g, proxy.PingRequest, nonce) {
+				return
+			}
+		}
+	}
+}
+
+// Queues tunnel ping packet for sending to client. Returns false if tunnel
+// was closed before packet could be queued.
+func (t *Tunnel) sendPing(g *rand.ChaCha8, kind proxy.PingKind, value uint64) bool {
+	select {
+	case <-t.done:
+		return false
+	case t.ctrl <- proxy.NewPingPacket(g, proxy.TunnelID, kind, value):
+		return true
+	}
+}
+
+// Handles keepalive ping which refers to the tunnel itself.
+func (t *Tunnel) handlePing(data []byte) error {
+	var p proxy.Ping
+	err := proxy.DecodePing(&p, data)
+	if err != nil {
+		return err
+	}
+
+	switch p.Kind {
+	case proxy.PingRequest:
+		// reader must not wait for writer, otherwise tunnel may deadlock
+		// when both directions are saturated, thus reply is dropped if
+		// control queue is full (client treats it as a missed ping)
+		select {
+		case t.ctrl <- proxy.NewPingPacket(t.cg, proxy.TunnelID, proxy.PingReply, p.Value):
+		default:
+		}
+	case proxy.PingReply:
+		t.ka.Reply(p.Value, time.Now())
+	}
+	return nil
+}
+
 // serve frames that come from the client
 func (t *Tunnel) serveIncomingFrames(lg *slog.Logger) {
+	defer t.close()
+
 	for {
 		err := t.readNextFrame()
 		if err != nil {
-			if err == io.EOF {
-				return
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				lg.Error("read frame", slog.String("error", err.Error()))
+			}
+			return
+		}
+	}
+}
+
+// serve packets that come from connections and send them to the client
+func (t *Tunnel) serveOutgoingPackets(lg *slog.Logger) {
+	defer t.close()
+
+	sh := proxy.NewShaper(t.profile, t.g)
+	defer sh.Stop()
+
+	// delays writes, closed tunnel must not wait for it
+	delay := time.NewTimer(0)
+	delay.Stop()
+
+	var buf []byte
+	emit := func(p *proxy.Packet) error {
+		var err error
+		buf, err = t.writePacket(buf[:0], p)
+		return err
+	}
+
+	for {
+		var err error
+		select {
+		case <-t.done:
+			return
+		case <-t.quit:
+			err := t.flushAndClose(buf)
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				lg.Error("write frame", slog.String("error", err.Error()))
+			}
+			return
+		case <-sh.IdleC():
+			err = emit(sh.Junk())
+			if err == nil {
+				err = t.ws.Flush()
+			}
+		case p := <-t.ctrl:
+			err = emit(p)
+			if err == nil {
+				err = t.flushPending()
+			}
+		case p := <-t.out:
+			if d := sh.Delay(); d > 0 {
+				// jitter timings, more packets may be queued meanwhile
+				delay.Reset(d)
+				select {
+				case <-delay.C:
+				case <-t.done:
+					return
+				}
+			}
+			err = t.writeControl(emit)
+			if err == nil {
+				err = sh.Shape(p, emit)
+			}
+			if err == nil {
+				err = t.flushPending()
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				lg.Error("write frame", slog.String("error", err.Error()))
+			}
+			return
+		}
+		sh.Active()
+	}
+}
+
+// Flushes written packets only when there are no more pending packets,
+// thus several packets may go out in one write.
+func (t *Tunnel) flushPending() error {
+	if len(t.out) != 0 || len(t.ctrl) != 0 {
+		return nil
+	}
+	return t.ws.Flush()
+}
+
+// Writes all pending control packets. Data packets may wait in queue
+// for a long time, thus writer sends control packets ahead of them.
+func (t *Tunnel) writeControl(emit func(p *proxy.Packet) error) error {
+	for {
+		select {
+		case p := <-t.ctrl:
+			err := emit(p)
+			if err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// Sends all pending packets followed by websocket close frame.
+func (t *Tunnel) flushAndClose(buf []byte) error {
+	for {
+		select {
+		case p := <-t.out:
+			data, pooled := p.Data, p.Pooled
+			var err error
+			buf, err = t.writePacket(buf[:0], p)
+			if pooled {
+				proxy.PutBuffer(data)
+			}
+			if err != nil {
+				return err
 			}
-			lg.Error("read frame", slog.String("error", err.Error()))
+		default:
+			err := t.ws.Flush()
+			if err != nil {
+				return err
+			}
+			// server is shutting down
+			return t.ws.WriteClose(wsok.CloseGoingAway, "")
 		}
 	}
 }
 
+func (t *Tunnel) writePacket(buf []byte, p *proxy.Packet) ([]byte, error) {
+	// frames from server are not masked, thus salt is the same for all packets
+	salt := t.down.Salt([4]byte{})
+	p.Compress = t.caps.Has(proxy.CapCompress)
+	p.InitEncode(t.g, salt)
+	p.UseKey(t.down)
+	p.UseStyles(t.styles)
+	p.Seq = t.seq
+	t.seq += 1
+
+	// packet is encoded right after room for frame header
+	buf = proxy.Encode(p, append(buf, make([]byte, wsok.MaxHeaderSize)...))
+	if t.capture != nil {
+		t.capture.Frame(proxy.CaptureDown, wsok.OpBin, salt, buf[wsok.MaxHeaderSize:])
+	}
+	return buf, t.ws.WriteInPlace(&wsok.Frame{
+		Op:  wsok.OpBin,
+		Fin: true,
+	}, buf)
+}
+
+// Reads next frame from the client and handles packet inside it.
+// Returned error means that tunnel can no longer be used.
 func (t *Tunnel) readNextFrame() error {
-	var frame wsok.Frame
-	err := wsok.Decode(t.rb, &frame)
+	var m wsok.Message
+	err := t.ws.ReadMessage(&m, t.rbuf)
+	var ce *wsok.CloseError
+	if errors.As(err, &ce) {
+		return io.EOF
+	}
 	if err != nil {
 		return err
 	}
+	if t.capture != nil {
+		t.capture.Frame(proxy.CaptureUp, m.Op, t.up.Salt(m.Mask), m.Data)
+	}
+	if m.Op != wsok.OpBin {
+		return nil
+	}
 
+	err = t.handleFrame(&m)
+	if err != nil {
+		t.lg.Error("handle frame", slog.String("error", err.Error()))
+	}
+	return nil
+}
+
+func (t *Tunnel) handleFrame(m *wsok.Message) error {
 	var packet proxy.Packet
-	err = proxy.Decode(frame.Data, &packet)
+	packet.InitDecode(t.up.Salt(m.Mask))
+	packet.UseKey(t.up)
+	packet.UseStyles(t.styles)
+	packet.UseWindow(&t.window)
+	err := proxy.Decode(&packet, m.Data)
 	if err != nil {
+		if errors.Is(err, proxy.ErrPacketReplay) {
+			n := t.replays.Add(1)
+			t.lg.Warn("drop replayed packet", slog.Uint64("replays", n))
+			return nil
+		}
 		return err
 	}
 
 	cid := packet.CID
 	typ := packet.Type
+	if typ == proxy.PacketPing && cid == proxy.TunnelID {
+		return t.handlePing(packet.Data)
+	}
 	c := t.getConn(cid)
 
 	switch typ {
@@ -98,31 +442,72 @@ func (t *Tunnel) readNextFrame() error {
 		}
 
 		var hello proxy.Hello
-		err = proxy.DecodeHello(packet.Data, &hello)
+		err = proxy.DecodeHello(&hello, packet.Data)
 		if err != nil {
 			return err
 		}
 
+		var seed [32]byte
+		t.cg.Read(seed[:])
 		c = &Conn{
 			cid:   cid,
-			in:    make(chan *proxy.Packet, 64),
-			lg:    t.lg,
+			out:   t.out,
+			ctrl:  t.ctrl,
+			lg:    t.lg.With(slog.String("cid", cid.String()), slog.String("target", hello.Target())),
 			done:  make(chan struct{}),
 			hello: hello,
+			g:     rand.NewChaCha8(seed),
 		}
+		c.in.Init()
+		c.sendw.Init()
 		t.addConn(c)
-		go serveConn(c)
+		go t.serveConn(c)
 		return nil
 	case proxy.PacketData:
 		if c == nil {
 			return fmt.Errorf("packet from unknown connection (cid=%s)", cid)
 		}
-		c.in <- &packet
+		err = c.recvw.Receive(len(packet.Data))
+		if err != nil {
+			// client does not respect flow control
+			c.sendReset()
+			c.close()
+			return fmt.Errorf("connection (cid=%s): %w", cid, err)
+		}
+		// packet data points into frame buffer, which is reused for next frame
+		data := proxy.GetBuffer(len(packet.Data))
+		copy(data, packet.Data)
+		c.in.Push(data)
+		return nil
+	case proxy.PacketPing:
+		if c == nil {
+			// connection may be already closed on our side
+			return nil
+		}
+
+		var ping proxy.Ping
+		err = proxy.DecodePing(&ping, packet.Data)
+		if err != nil {
+			return err
+		}
+		if ping.Kind == proxy.PingWindow && ping.Value <= proxy.InitialWindow {
+			c.sendw.Grant(int(ping.Value))
+		}
 		return nil
 	case proxy.PacketClose:
 		if c == nil {
-			return fmt.Errorf("packet from unknown connection (cid=%s)", cid)
+			// connection may be already closed on our side
+			return nil
+		}
+
+		var cp proxy.Close
+		err = proxy.DecodeClose(&cp, packet.Data)
+		if err != nil {
+			return err
 		}
+		c.closeByPeer(cp.Code)
+		return nil
+	case proxy.PacketJunk:
 		return nil
 	default:
 		return fmt.Errorf("unexpected packet type (=%d)", typ)
@@ -132,6 +517,12 @@ func (t *Tunnel) readNextFrame() error {
 func (t *Tunnel) addConn(c *Conn) {
 	t.mu.Lock()
 	t.conns[c.cid] = c
+	select {
+	case <-t.done:
+		// tunnel was closed before connection was added
+		c.close()
+	default:
+	}
 	t.mu.Unlock()
 }
 
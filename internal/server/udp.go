@@ -0,0 +1,122 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/mebyus/higs/proxy"
+)
+
+// Udp association is closed after no datagrams were relayed in any direction
+// for this long. It is shorter than for tcp connections, since udp has no
+// explicit end of association.
+const udpIdleTimeout = 2 * time.Minute
+
+// Fits any udp datagram.
+const udpBufferSize = 1 << 16
+
+// Resolves target address and dials udp socket connected to it.
+func dialUDP(target string) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialUDP("udp", nil, addr)
+}
+
+// Relays datagrams from client to remote. Each queued chunk is a single
+// datagram. Returns after client closes its sending side or on error.
+func (c *Conn) serveIncomingDatagrams(lg *slog.Logger) {
+	for {
+		// check before pop, see Queue.Closed
+		fin := c.in.Closed()
+		data, ok := c.in.Pop()
+		if !ok {
+			if fin {
+				// udp has no end of data, remote keeps sending
+				// datagrams until association expires
+				lg.Debug("client closed write")
+				return
+			}
+
+			select {
+			case <-c.done:
+				return
+			case <-c.in.Wait():
+				continue
+			}
+		}
+
+		n := len(data)
+		_, err := c.conn.Write(data)
+		proxy.PutBuffer(data)
+		switch {
+		case err == nil:
+			c.touch()
+		case errors.Is(err, net.ErrClosed):
+			return
+		case errors.Is(err, syscall.ECONNREFUSED):
+			// remote port is unreachable right now, datagram is lost
+			// as it would be without proxy
+			lg.Debug("remote refused datagram")
+		default:
+			lg.Error("relay incoming datagram from client", slog.String("error", err.Error()))
+			c.sendClose(proxy.CloseReset)
+			c.close()
+			return
+		}
+		if !c.consume(n) {
+			return
+		}
+	}
+}
+
+// Relays datagrams from remote to client. Datagrams which do not fit into
+// flow control window or are larger than proxy.MaxDatagramSize are dropped.
+// Returns after association expires or on error.
+func (c *Conn) serveRemoteDatagrams(lg *slog.Logger) {
+	buf := make([]byte, udpBufferSize)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := c.conn.Read(buf)
+		if err == nil {
+			c.touch()
+			if n > proxy.MaxDatagramSize || !c.sendw.TryAcquire(n) {
+				continue
+			}
+
+			data := proxy.GetBuffer(n)
+			copy(data, buf[:n])
+			if !c.send(&proxy.Packet{Data: data, CID: c.cid, Type: proxy.PacketData, Datagram: true, Pooled: true}) {
+				return
+			}
+			continue
+		}
+
+		switch {
+		case errors.Is(err, net.ErrClosed):
+			lg.Debug("exit serve remote datagrams")
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			if !c.idle(udpIdleTimeout) {
+				// datagrams are still relayed in other direction
+				continue
+			}
+			lg.Debug("association idle")
+			c.sendClose(proxy.CloseIdle)
+			c.close()
+		case errors.Is(err, syscall.ECONNREFUSED):
+			// icmp port unreachable from remote, association may
+			// still recover
+			continue
+		default:
+			lg.Error("read datagram from remote", slog.String("error", err.Error()))
+			c.sendClose(proxy.CloseReset)
+			c.close()
+		}
+		return
+	}
+}
@@ -1,7 +1,10 @@
 package server
 
 import (
+	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -21,50 +24,117 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	authToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-	if authToken == "" || s.Config.AuthToken != authToken {
+	cookie, err := r.Cookie(proxy.HandshakeCookieName)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var hm proxy.HandshakeMessage
+	err = proxy.DecodeHandshake(&hm, cookie.Value)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// websocket key is random for each tunnel, thus it is used as
+	// handshake nonce for signing messages and deriving tunnel keys
+	token := s.Config.AuthToken
+	if token == "" || hm.VerifyOffer(token, []byte(key)) != nil {
 		// Check token for empty string in case we somehow allowed
 		// empty auth token in config.
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	hash := wsok.HashHandshakeKey(key)
-
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	conn, bufrw, err := hj.Hijack()
+	hs, err := proxy.NewHandshake()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	err = conn.SetWriteDeadline(time.Time{})
+	up, down, err := hs.Keys(&hm, token, []byte(key))
 	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	err = conn.SetReadDeadline(time.Time{})
+
+	ws, err := wsok.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
+	ws.SetMaxMessageSize(proxy.ReadBufferSize)
 
-	bufrw.WriteString("HTTP/1.1 101 Switching Protocols\n")
-	bufrw.WriteString("Connection: Upgrade\n")
-	bufrw.WriteString("Upgrade: websocket\n")
-	bufrw.WriteString("Sec-Websocket-Accept: " + hash + "\n\n")
-	err = bufrw.Flush()
+	// first message carries server part of key exchange
+	reply := hs.Message()
+	reply.Accept(&hm, proxy.SupportedCaps, s.styles)
+	reply.SignReply(&hm, token, []byte(key))
+	err = ws.WriteMessage(wsok.OpText, proxy.EncodeHandshakeReply(&reply))
+	if err == nil {
+		err = ws.Flush()
+	}
 	if err != nil {
+		ws.Close()
+		return
+	}
+	if reply.Code != proxy.CloseOK {
+		// client learns rejection reason from handshake reply
+		s.lg.Warn("reject client",
+			slog.String("remote", ws.RemoteAddr().String()),
+			slog.Int("version", int(hm.Version)),
+			slog.String("caps", hm.Caps.String()),
+			slog.String("code", reply.Code.String()))
+		ws.Close()
 		return
 	}
 
-	go serveTunnel(&Tunnel{
-		conn:  conn,
-		rb:    bufrw.Reader,
-		wb:    bufrw.Writer,
-		lg:    s.lg.WithGroup("tun"),
-		done:  make(chan struct{}),
-		conns: make(map[proxy.ConnID]*Conn),
-	})
+	t := &Tunnel{
+		ws:      ws,
+		rbuf:    make([]byte, 0, proxy.ReadBufferSize),
+		lg:      s.lg.WithGroup("tun"),
+		done:    make(chan struct{}),
+		quit:    make(chan struct{}),
+		conns:   make(map[proxy.ConnID]*Conn),
+		out:     make(chan *proxy.Packet, 64),
+		ctrl:    make(chan *proxy.Packet, 16),
+		up:      up,
+		down:    down,
+		profile: s.profile,
+		styles:  reply.Styles,
+		caps:    reply.Caps,
+	}
+
+	var file *os.File
+	if s.Config.CaptureDir != "" {
+		file, t.capture, err = createCapture(s.Config.CaptureDir, ws.RemoteAddr().String())
+		if err != nil {
+			s.lg.Error("create capture", slog.String("error", err.Error()))
+		} else {
+			t.capture.Begin(up, down)
+		}
+	}
+
+	s.addTunnel(t)
+	go func() {
+		defer s.dropTunnel(t)
+		if file != nil {
+			defer file.Close()
+		}
+		serveTunnel(t)
+	}()
+}
+
+// Creates file in the given directory for capturing frames of tunnel
+// with remote client.
+func createCapture(dir string, remote string) (*os.File, *proxy.Capture, error) {
+	name := time.Now().UTC().Format("20060102-150405.000") + "-" +
+		strings.NewReplacer(":", "-", "[", "", "]", "").Replace(remote) + ".cap"
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := proxy.NewCapture(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, c, nil
 }
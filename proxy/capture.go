@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mebyus/higs/wsok"
+)
+
+// Capture records websocket frames of tunnels together with salts used
+// for their packets, so that they can be decoded offline (see cmd/higs-dump).
+//
+// Tunnel keys are recorded as well, otherwise sealed packets cannot be
+// decoded. Thus capture must be protected the same way as the keys.
+//
+// Capture is safe for concurrent use. Records of a tunnel follow the record
+// which starts it (see Begin), thus only one tunnel at a time may use
+// the capture.
+type Capture struct {
+	mu sync.Mutex
+
+	w io.Writer
+
+	// reused for encoding records
+	buf []byte
+
+	// first write error, capture is stopped after it
+	err error
+}
+
+// CaptureDir is direction of captured frame.
+type CaptureDir uint8
+
+const (
+	// Frame sent from client to server.
+	CaptureUp CaptureDir = iota
+
+	// Frame sent from server to client.
+	CaptureDown
+)
+
+func (d CaptureDir) String() string {
+	switch d {
+	case CaptureUp:
+		return "up"
+	case CaptureDown:
+		return "down"
+	default:
+		return fmt.Sprintf("dir=%d", uint8(d))
+	}
+}
+
+// Capture file starts with magic followed by format version.
+const (
+	captureMagic   = "HIGSCAP"
+	captureVersion = 1
+)
+
+// Kinds of capture records.
+const (
+	recordBegin = 1
+	recordFrame = 2
+)
+
+// Max size of frame data in capture record.
+const maxCaptureFrameSize = 1 << 24
+
+var ErrCaptureFormat = errors.New("bad capture format")
+
+// NewCapture creates capture which writes records to w.
+// Capture header is written immediately.
+func NewCapture(w io.Writer) (*Capture, error) {
+	_, err := w.Write(append([]byte(captureMagic), captureVersion))
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{w: w}, nil
+}
+
+// Begin records start of a tunnel with the given keys. Nil keys
+// mean that tunnel packets are not sealed.
+func (c *Capture) Begin(up, down *Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.buf = c.head(recordBegin)
+	for _, k := range []*Key{up, down} {
+		if k == nil {
+			c.buf = append(c.buf, 0)
+			continue
+		}
+		c.buf = append(c.buf, 1)
+		c.buf = append(c.buf, k.material[:]...)
+	}
+	c.write()
+}
+
+// Frame records websocket frame. Salt is the one used for packet carried
+// by frame. Data must be captured before it is masked or decoded in place.
+func (c *Capture) Frame(dir CaptureDir, op wsok.OpCode, salt uint32, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.buf = c.head(recordFrame)
+	c.buf = append(c.buf, uint8(dir), uint8(op))
+	c.buf = binary.LittleEndian.AppendUint32(c.buf, salt)
+	c.buf = binary.LittleEndian.AppendUint32(c.buf, uint32(len(data)))
+	c.buf = append(c.buf, data...)
+	c.write()
+}
+
+// Err returns first error which occurred while writing records.
+func (c *Capture) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Starts new record of the given kind in buffer.
+func (c *Capture) head(kind uint8) []byte {
+	buf := append(c.buf[:0], kind)
+	return binary.LittleEndian.AppendUint64(buf, uint64(time.Now().UnixNano()))
+}
+
+func (c *Capture) write() {
+	if c.err != nil {
+		return
+	}
+	_, c.err = c.w.Write(c.buf)
+}
+
+// CaptureRecord is a single record read from capture.
+type CaptureRecord struct {
+	Time time.Time
+
+	// Keys of new tunnel. Set only in record which starts tunnel,
+	// but may be nil if tunnel packets are not sealed.
+	Up   *Key
+	Down *Key
+
+	// Frame data, nil in record which starts tunnel.
+	Data []byte
+
+	// Salt of packet carried by frame.
+	Salt uint32
+
+	Dir CaptureDir
+	Op  wsok.OpCode
+
+	// Record starts new tunnel.
+	Begin bool
+}
+
+// Key picks key for packet of record frame from keys of its tunnel.
+func (r *CaptureRecord) Key(up, down *Key) *Key {
+	if r.Dir == CaptureDown {
+		return down
+	}
+	return up
+}
+
+// CaptureReader reads records written by Capture.
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+// NewCaptureReader checks capture header and returns reader
+// positioned at first record.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+
+	var header [len(captureMagic) + 1]byte
+	_, err := io.ReadFull(br, header[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCaptureFormat, err)
+	}
+	if !bytes.HasPrefix(header[:], []byte(captureMagic)) {
+		return nil, fmt.Errorf("%w: no magic", ErrCaptureFormat)
+	}
+	if header[len(captureMagic)] != captureVersion {
+		return nil, fmt.Errorf("%w: unknown version %d", ErrCaptureFormat, header[len(captureMagic)])
+	}
+	return &CaptureReader{r: br}, nil
+}
+
+// Next reads next record from capture. Returns io.EOF when there
+// are no more records.
+func (r *CaptureReader) Next(rec *CaptureRecord) error {
+	var head [9]byte
+	_, err := io.ReadFull(r.r, head[:])
+	if err == io.EOF {
+		return io.EOF
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrCaptureFormat, err)
+	}
+
+	*rec = CaptureRecord{
+		Time: time.Unix(0, int64(binary.LittleEndian.Uint64(head[1:]))),
+	}
+	switch head[0] {
+	case recordBegin:
+		rec.Begin = true
+		rec.Up, err = r.key()
+		if err != nil {
+			return err
+		}
+		rec.Down, err = r.key()
+		return err
+	case recordFrame:
+		var fh [10]byte
+		_, err = io.ReadFull(r.r, fh[:])
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrCaptureFormat, err)
+		}
+		rec.Dir = CaptureDir(fh[0])
+		rec.Op = wsok.OpCode(fh[1])
+		rec.Salt = binary.LittleEndian.Uint32(fh[2:])
+		size := binary.LittleEndian.Uint32(fh[6:])
+		if size > maxCaptureFrameSize {
+			return fmt.Errorf("%w: frame size %d", ErrCaptureFormat, size)
+		}
+		rec.Data = make([]byte, size)
+		_, err = io.ReadFull(r.r, rec.Data)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrCaptureFormat, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown record kind %d", ErrCaptureFormat, head[0])
+	}
+}
+
+func (r *CaptureReader) key() (*Key, error) {
+	flag, err := r.r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCaptureFormat, err)
+	}
+	if flag == 0 {
+		return nil, nil
+	}
+
+	var m [keyMaterialSize]byte
+	_, err = io.ReadFull(r.r, m[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCaptureFormat, err)
+	}
+	return keyFromMaterial(m)
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mebyus/higs/wsok"
+)
+
+// Buffer which is safe to use from tunnel goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes())
+}
+
+func TestCapture(t *testing.T) {
+	var buf syncBuffer
+	c, err := NewCapture(&buf)
+	if err != nil {
+		t.Fatalf("NewCapture() error = %v", err)
+	}
+
+	// raw style, so that flipped byte below always lands in sealed part
+	tun, s := testConnectOptions(t, &Options{Capture: c, Styles: 1 << Style0})
+	go s.serveEcho()
+	go tun.Serve(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	st, err := tun.Open(ctx, "tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	want := []byte("hello, capture")
+	_, err = st.Write(want)
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	_, err = io.ReadFull(st, make([]byte, len(want)))
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+
+	r, err := NewCaptureReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("NewCaptureReader() error = %v", err)
+	}
+
+	var begin CaptureRecord
+	err = r.Next(&begin)
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if !begin.Begin || begin.Up == nil || begin.Down == nil {
+		t.Fatalf("Next() first record does not start tunnel")
+	}
+
+	// count of decoded data packets with expected payload in each direction
+	var echoed [2]int
+	var frames []CaptureRecord
+	for {
+		var rec CaptureRecord
+		err = r.Next(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if rec.Op != wsok.OpBin {
+			continue
+		}
+
+		var p Packet
+		p.InitDecode(rec.Salt)
+		p.UseKey(rec.Key(begin.Up, begin.Down))
+		p.UseStyles(AllStyles)
+		err = Decode(&p, bytes.Clone(rec.Data))
+		if err != nil {
+			t.Fatalf("Decode() %s frame error = %v", rec.Dir, err)
+		}
+		if p.Type == PacketData && bytes.Equal(p.Data, want) {
+			echoed[rec.Dir] += 1
+			frames = append(frames, rec)
+		}
+	}
+	if echoed[CaptureUp] != 1 || echoed[CaptureDown] != 1 {
+		t.Fatalf("captured data packets: up = %d, down = %d", echoed[CaptureUp], echoed[CaptureDown])
+	}
+
+	// tampered frame must fail authentication
+	rec := frames[0]
+	rec.Data[len(rec.Data)/2] ^= 1
+	var p Packet
+	p.InitDecode(rec.Salt)
+	p.UseKey(rec.Key(begin.Up, begin.Down))
+	p.UseStyles(AllStyles)
+	err = Decode(&p, rec.Data)
+	if !errors.Is(err, ErrPacketAuth) {
+		t.Errorf("Decode() tampered frame error = %v, want %v", err, ErrPacketAuth)
+	}
+}
+
+func TestCaptureReaderBadFormat(t *testing.T) {
+	_, err := NewCaptureReader(bytes.NewReader([]byte("not a capture")))
+	if !errors.Is(err, ErrCaptureFormat) {
+		t.Errorf("NewCaptureReader() error = %v, want %v", err, ErrCaptureFormat)
+	}
+
+	var buf bytes.Buffer
+	c, err := NewCapture(&buf)
+	if err != nil {
+		t.Fatalf("NewCapture() error = %v", err)
+	}
+	c.Frame(CaptureUp, wsok.OpBin, 0x1234, []byte("frame"))
+
+	// record is cut short
+	r, err := NewCaptureReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	if err != nil {
+		t.Fatalf("NewCaptureReader() error = %v", err)
+	}
+	var rec CaptureRecord
+	err = r.Next(&rec)
+	if !errors.Is(err, ErrCaptureFormat) {
+		t.Errorf("Next() error = %v, want %v", err, ErrCaptureFormat)
+	}
+}
@@ -3,16 +3,80 @@ package proxy
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"math/rand/v2"
 	"slices"
 )
 
+// CloseCode describes why connection is closed. All codes except CloseWrite
+// close connection in both directions and release it on both sides.
 type CloseCode uint32
 
 const (
+	// Connection was closed normally.
 	CloseOK CloseCode = iota
+
+	// Sender will not send more data over connection, but still accepts
+	// data from the peer (TCP half-close). Connection is released after
+	// both sides send this code.
+	CloseWrite
+
+	// Server failed to establish connection to target.
+	CloseDialRefused
+
+	// Server did not manage to establish connection to target in time.
+	CloseTimeout
+
+	// Connection to target was reset or broken otherwise.
+	CloseReset
+
+	// Connection is not allowed by server policy.
+	ClosePolicy
+
+	// Connection was idle for too long.
+	CloseIdle
+
+	// Tunnel is shutting down.
+	CloseShutdown
+
+	// Peers do not share compatible protocol version or
+	// required capabilities (see HandshakeMessage).
+	CloseIncompatible
 )
 
+var closeCodeText = [...]string{
+	CloseOK:           "ok",
+	CloseWrite:        "write",
+	CloseDialRefused:  "dial refused",
+	CloseTimeout:      "timeout",
+	CloseReset:        "reset",
+	ClosePolicy:       "policy",
+	CloseIdle:         "idle",
+	CloseShutdown:     "shutdown",
+	CloseIncompatible: "incompatible",
+}
+
+func (c CloseCode) String() string {
+	if int(c) < len(closeCodeText) {
+		return closeCodeText[c]
+	}
+	return fmt.Sprintf("code=%d", uint32(c))
+}
+
+// CloseError describes stream which was closed by the peer.
+type CloseError struct {
+	Code CloseCode
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("closed by peer (%s)", e.Code)
+}
+
+// Graceful reports whether close code means normal end of data.
+func (e *CloseError) Graceful() bool {
+	return e.Code == CloseOK || e.Code == CloseWrite
+}
+
 type Close struct {
 	Code CloseCode
 
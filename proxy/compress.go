@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"math"
+	"sync"
+)
+
+// Marks packet with compressed data in type byte.
+const compressFlag = 0x40
+
+// Data shorter than this is never compressed, deflate overhead eats
+// most of the gain.
+const minCompressSize = 128
+
+// Max size of decompressed packet data. Sender compresses data
+// of already split packets.
+const maxDecompressedSize = MaxPayloadSize
+
+var ErrCompression = errors.New("bad compressed data")
+
+// Preset dictionary shared by both sides. Proxied plaintext is mostly http
+// and json, thus dictionary holds their common tokens. Changing dictionary
+// breaks compatibility and requires new protocol version.
+var compressDict = []byte(`HTTP/1.1 200 OK` + "\r\n" +
+	`Content-Type: application/json; charset=utf-8` + "\r\n" +
+	`Content-Type: text/html; charset=utf-8` + "\r\n" +
+	`Content-Length: Transfer-Encoding: chunked` + "\r\n" +
+	`Cache-Control: no-cache, max-age=0` + "\r\n" +
+	`Connection: keep-alive` + "\r\n" +
+	`Accept-Encoding: gzip, deflate` + "\r\n" +
+	`Accept: */*` + "\r\n" +
+	`User-Agent: Mozilla/5.0 (X11; Linux x86_64)` + "\r\n" +
+	`Host: GET /api/v1/ HTTP/1.1` + "\r\n\r\n" +
+	`{"id":"type":"name":"data":"value":"status":"error":"message":` +
+	`"items":[{"created_at":"updated_at":"url":"https://","true,"false,"null,}]}`)
+
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, err := flate.NewWriterDict(nil, flate.BestSpeed, compressDict)
+		if err != nil {
+			panic(err)
+		}
+		return w
+	},
+}
+
+var flateReaders = sync.Pool{
+	New: func() any {
+		return flate.NewReaderDict(nil, compressDict)
+	},
+}
+
+// Compresses data if it is worth it. Returns nil if data should
+// be sent as is.
+func compress(data []byte) []byte {
+	if !compressible(data) {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil
+	}
+	err = w.Close()
+	if err != nil {
+		return nil
+	}
+
+	// require noticeable gain, otherwise receiver wastes time on inflating
+	if buf.Len() > len(data)-len(data)/16 {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func decompress(data []byte) ([]byte, error) {
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+
+	err := r.(flate.Resetter).Reset(bytes.NewReader(data), compressDict)
+	if err != nil {
+		return nil, ErrCompression
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(min(4*len(data), maxDecompressedSize))
+	n, err := buf.ReadFrom(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil || n > maxDecompressedSize {
+		return nil, ErrCompression
+	}
+	return buf.Bytes(), nil
+}
+
+// Magic prefixes of compressed or encrypted formats which do not
+// compress further.
+var compressedMagic = [][]byte{
+	{0x1F, 0x8B},             // gzip
+	{0x28, 0xB5, 0x2F, 0xFD}, // zstd
+	{0x50, 0x4B, 0x03, 0x04}, // zip
+	{0x89, 0x50, 0x4E, 0x47}, // png
+	{0xFF, 0xD8, 0xFF},       // jpeg
+	{0x47, 0x49, 0x46, 0x38}, // gif
+	{0x52, 0x49, 0x46, 0x46}, // riff (webp, avi)
+	{0x37, 0x7A, 0xBC, 0xAF}, // 7z
+	{0xFD, 0x37, 0x7A, 0x58}, // xz
+}
+
+// Number of leading bytes examined for estimating entropy.
+const entropySampleSize = 512
+
+// Reports whether data looks compressible. Already compressed
+// or encrypted payloads are detected by magic prefixes, tls record
+// header and byte entropy of data start.
+func compressible(data []byte) bool {
+	if len(data) < minCompressSize {
+		return false
+	}
+	for _, magic := range compressedMagic {
+		if bytes.HasPrefix(data, magic) {
+			return false
+		}
+	}
+	if isTLSRecord(data) {
+		return false
+	}
+	if string(data[4:8]) == "ftyp" {
+		// mp4 and other iso media
+		return false
+	}
+
+	sample := data[:min(len(data), entropySampleSize)]
+	var counts [256]int
+	for _, b := range sample {
+		counts[b] += 1
+	}
+	var e float64
+	n := float64(len(sample))
+	for _, c := range counts {
+		if c != 0 {
+			p := float64(c) / n
+			e -= p * math.Log2(p)
+		}
+	}
+
+	// random data of sample size comes close to maximum entropy
+	limit := min(8, math.Log2(n))
+	return e < 0.9*limit
+}
+
+// Reports whether data starts with tls record header. Proxied tls traffic
+// is the most common incompressible payload.
+func isTLSRecord(data []byte) bool {
+	if len(data) < 5 {
+		return false
+	}
+	typ := data[0]
+	return typ >= 20 && typ <= 23 && data[1] == 3 && data[2] <= 4
+}
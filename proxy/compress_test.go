@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+func TestCompressible(t *testing.T) {
+	g := rand.NewChaCha8([32]byte{5})
+	random := make([]byte, 4096)
+	putJunk(g, random)
+
+	json := []byte(strings.Repeat(`{"id":12,"name":"item","status":"ok"},`, 20))
+
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{name: "1 json", data: json, want: true},
+		{name: "2 short", data: json[:minCompressSize-1], want: false},
+		{name: "3 random", data: random, want: false},
+		{name: "4 gzip", data: append([]byte{0x1F, 0x8B}, json...), want: false},
+		{name: "5 tls record", data: append([]byte{23, 3, 3, 0x10, 0x00}, json...), want: false},
+		{name: "6 mp4", data: append([]byte("\x00\x00\x00\x20ftypisom"), json...), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := compressible(tt.data)
+			if got != tt.want {
+				t.Errorf("compressible() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCompressedPacket(t *testing.T) {
+	up, _, err := DeriveKeys([]byte("secret"), []byte("nonce"))
+	if err != nil {
+		t.Fatalf("DeriveKeys() error = %v", err)
+	}
+
+	g := rand.NewChaCha8([32]byte{0, 1, 2, 3})
+	random := make([]byte, 2000)
+	putJunk(g, random)
+
+	tests := []struct {
+		name string
+
+		data       []byte
+		compressed bool
+	}{
+		{
+			name:       "1 http",
+			data:       []byte("HTTP/1.1 200 OK\r\nContent-Type: application/json; charset=utf-8\r\n\r\n" + strings.Repeat(`{"id":"1"}`, 100)),
+			compressed: true,
+		},
+		{
+			name:       "2 random",
+			data:       random,
+			compressed: false,
+		},
+	}
+
+	for _, key := range []*Key{nil, up} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s sealed=%t", tt.name, key != nil), func(t *testing.T) {
+				packet := Packet{
+					Data:     append([]byte(nil), tt.data...),
+					Type:     PacketData,
+					CID:      NewConnID(g),
+					Size:     100,
+					Compress: true,
+				}
+				packet.InitEncode(g, 0x1234)
+				packet.UseKey(key)
+				if packet.compressed != tt.compressed {
+					t.Fatalf("InitEncode() compressed = %t, want %t", packet.compressed, tt.compressed)
+				}
+				encoded := Encode(&packet, nil)
+				if tt.compressed && len(encoded) >= len(tt.data) {
+					t.Errorf("Encode() length = %d, data length = %d", len(encoded), len(tt.data))
+				}
+
+				var got Packet
+				got.InitDecode(0x1234)
+				got.UseKey(key)
+				err := Decode(&got, encoded)
+				if err != nil {
+					t.Fatalf("Decode() error = %v", err)
+				}
+				if !bytes.Equal(got.Data, tt.data) {
+					t.Errorf("Decode() data mismatch")
+				}
+			})
+		}
+	}
+}
+
+func TestCompressedPacketSize(t *testing.T) {
+	up, _, err := DeriveKeys([]byte("secret"), []byte("nonce"))
+	if err != nil {
+		t.Fatalf("DeriveKeys() error = %v", err)
+	}
+
+	g := rand.NewChaCha8([32]byte{6})
+	json := []byte(strings.Repeat(`{"id":12,"name":"item","status":"ok"},`, 20))
+
+	// padding is derived after compression, thus sealed packet
+	// reaches target size regardless of compression
+	for _, size := range []int{100, len(json), 3000} {
+		t.Run(fmt.Sprintf("size=%d", size), func(t *testing.T) {
+			packet := Packet{
+				Data:     json,
+				Type:     PacketData,
+				CID:      NewConnID(g),
+				Size:     size,
+				Compress: true,
+			}
+			packet.UseStyles(1 << Style0)
+			packet.InitEncode(g, 0x1234)
+			packet.UseKey(up)
+			if !packet.compressed {
+				t.Fatalf("InitEncode() did not compress data")
+			}
+			encoded := Encode(&packet, nil)
+
+			// varlen tjunk on both sides takes up to 7 extra bytes
+			base := 2 + minSealedInnerLength + 2 + size
+			if len(encoded) < base || len(encoded) > base+14 {
+				t.Errorf("Encode() length = %d, want in range [%d, %d]", len(encoded), base, base+14)
+			}
+
+			var got Packet
+			got.InitDecode(0x1234)
+			got.UseKey(up)
+			err := Decode(&got, encoded)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if !bytes.Equal(got.Data, json) {
+				t.Errorf("Decode() data mismatch")
+			}
+		})
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriterDict(&buf, flate.BestCompression, compressDict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(make([]byte, maxDecompressedSize+1))
+	w.Close()
+
+	_, err = decompress(buf.Bytes())
+	if !errors.Is(err, ErrCompression) {
+		t.Errorf("decompress() error = %v, want %v", err, ErrCompression)
+	}
+
+	_, err = decompress([]byte("not deflate"))
+	if !errors.Is(err, ErrCompression) {
+		t.Errorf("decompress() garbage error = %v, want %v", err, ErrCompression)
+	}
+}
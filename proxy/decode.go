@@ -5,14 +5,25 @@ import (
 	"fmt"
 )
 
-// Decode packet from wire format. Correct packet salt must be
-// set before decoding.
+// Decode packet from wire format. Correct packet salt (and key if
+// packet was encoded with one) must be set before decoding.
 func Decode(p *Packet, data []byte) error {
 	if !p.ok {
 		panic("no init")
 	}
 
-	d := decoder{buf: data}
+	inner, style, err := unwrap(data)
+	if err != nil {
+		return err
+	}
+	if !p.styles.orDefault().Has(style) {
+		return ErrPacketStyle
+	}
+
+	d := decoder{buf: inner}
+	if p.key != nil {
+		return d.sealedPacket(p)
+	}
 	return d.packet(p)
 }
 
@@ -21,14 +32,16 @@ type decoder struct {
 	pos int
 }
 
-const minPacketLength = 2 + // style prefix
-	8 + 1 + // prefix junk
-	3 + 1 + // reserved junk + type
+// Minimal length of packet inner part.
+const minInnerLength = 8 + 1 + // prefix junk
+	3 + 1 + // sequence number + type
 	16 + // cid
 	0 + // packet data
 	4 + // control sum
-	8 + 1 + // suffix junk
-	2 // style suffix
+	8 + 1 // suffix junk
+
+// Minimal length of packet encoded without a key in raw style.
+const minPacketLength = 2 + minInnerLength + 2
 
 var (
 	ErrPacketSize  = errors.New("bad size")
@@ -39,23 +52,10 @@ var (
 func (d *decoder) packet(p *Packet) error {
 	const debug = false
 
-	if d.len() < minPacketLength {
+	if d.len() < minInnerLength {
 		return ErrPacketSize
 	}
 
-	var s1 Style
-	switch d.u8() {
-	case '{':
-		s1 = Style0
-	case '[':
-		s1 = Style1
-	default:
-		return ErrPacketStyle
-	}
-	if d.u8() != '"' {
-		return ErrPacketStyle
-	}
-
 	prefix := d.bytes(8)
 
 	var hasher Hasher
@@ -66,9 +66,11 @@ func (d *decoder) packet(p *Packet) error {
 	len1 := 1 + (h & 0b111)
 	len2 := 1 + ((h >> 3) & 0b111)
 
-	d.skip(int(len1) + 3) // skip prefix varlen tjunk + 3 bytes of reserved junk
+	d.skip(int(len1)) // skip prefix varlen tjunk
+	seq := d.bytes(3)
 
-	typ := PacketType(d.u8() & 0b1111)
+	tb := d.u8()
+	typ := PacketType(tb & 0b1111)
 	if typ.IsJunk() {
 		typ = PacketJunk
 	}
@@ -78,13 +80,14 @@ func (d *decoder) packet(p *Packet) error {
 	dlen := d.len() -
 		4 - // control sum
 		int(len2) - // varlen tjunk suffix
-		8 - // fixed tjunk suffix
-		2 // style suffix
+		8 // fixed tjunk suffix
 	if dlen < 0 {
 		return ErrPacketSize
 	}
 	data := d.bytes(dlen)
 
+	// position of control sum
+	cpos := d.pos
 	csum := d.u32()
 	d.skip(int(len2))
 	suffix := d.bytes(8)
@@ -95,33 +98,31 @@ func (d *decoder) packet(p *Packet) error {
 		fmt.Printf("suffix:  %v\n", suffix)
 	}
 
-	i1 := prefix[0] & 0b111
-	i2 := suffix[0] & 0b111
-	hasher.reset(p.salt)
-	hasher.putb(prefix[i1])
-	hasher.put(cid[:])
-	hasher.put(data[:min(4, len(data))])
-	hasher.putb(suffix[i2])
-	if hasher.get32() != csum {
+	// control sum covers whole inner part except itself
+	var sh SipHash
+	sh.reset(p.salt)
+	sh.put(d.buf[:cpos])
+	sh.put(d.buf[cpos+4:])
+	if sh.get32() != csum {
 		return ErrPacketSum
 	}
 
-	if d.u8() != '"' {
-		return ErrPacketStyle
+	data, err := unpack(tb, data)
+	if err != nil {
+		return err
 	}
-	var s2 Style
-	switch d.u8() {
-	case '}':
-		s2 = Style0
-	case ']':
-		s2 = Style1
-	default:
-		return ErrPacketStyle
-	}
-	if s1 != s2 {
-		return ErrPacketStyle
+
+	short := uint32(seq[0]) | (uint32(seq[1]) << 8) | (uint32(seq[2]) << 16)
+	n := uint64(short)
+	if p.window != nil {
+		n = p.window.expand(short)
+		err = p.window.Check(n)
+		if err != nil {
+			return err
+		}
 	}
 
+	p.Seq = n
 	p.Data = data
 	p.CID = cid
 	p.Type = typ
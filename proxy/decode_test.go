@@ -8,52 +8,52 @@ import (
 	"testing"
 )
 
-func TestDecodePacket(t *testing.T) {
-	tests := []struct {
-		name string
-
-		data string
-		typ  PacketType
-	}{
-		{
-			name: "1 hello",
-			data: "",
-			typ:  PacketHello,
-		},
-		{
-			name: "2 close",
-			data: "",
-			typ:  PacketClose,
-		},
-		{
-			name: "3 ping",
-			data: "",
-			typ:  PacketPing,
-		},
-		{
-			name: "4 junk",
-			data: "",
-			typ:  PacketJunk,
-		},
-		{
-			name: "5 empty",
-			data: "",
-			typ:  PacketData,
-		},
-		{
-			name: "6 data",
-			data: "hello",
-			typ:  PacketData,
-		},
-		{
-			name: "7 large data",
-			data: strings.Repeat("++ hello !", 237),
-			typ:  PacketData,
-		},
-	}
+var decodePacketTests = []struct {
+	name string
 
+	data string
+	typ  PacketType
+}{
+	{
+		name: "1 hello",
+		data: "",
+		typ:  PacketHello,
+	},
+	{
+		name: "2 close",
+		data: "",
+		typ:  PacketClose,
+	},
+	{
+		name: "3 ping",
+		data: "",
+		typ:  PacketPing,
+	},
+	{
+		name: "4 junk",
+		data: "",
+		typ:  PacketJunk,
+	},
+	{
+		name: "5 empty",
+		data: "",
+		typ:  PacketData,
+	},
+	{
+		name: "6 data",
+		data: "hello",
+		typ:  PacketData,
+	},
+	{
+		name: "7 large data",
+		data: strings.Repeat("++ hello !", 237),
+		typ:  PacketData,
+	},
+}
+
+func TestDecodePacket(t *testing.T) {
 	g := rand.NewChaCha8([32]byte{0, 1, 2, 3})
-	for _, tt := range tests {
+	for _, tt := range decodePacketTests {
 		t.Run(tt.name, func(t *testing.T) {
 			cid := NewConnID(g)
 			packet := Packet{
@@ -86,6 +86,73 @@ func TestDecodePacket(t *testing.T) {
 	}
 }
 
+func TestDecodeLargePacket(t *testing.T) {
+	g := rand.NewChaCha8([32]byte{11})
+	for _, size := range []int{MaxPayloadSize, MaxPayloadSize + 1} {
+		packet := Packet{
+			Data: make([]byte, size),
+			Type: PacketData,
+			CID:  NewConnID(g),
+		}
+		packet.InitEncode(g, 0x1234)
+		encoded := Encode(&packet, nil)
+
+		var got Packet
+		got.InitDecode(0x1234)
+		err := Decode(&got, encoded)
+		if size <= MaxPayloadSize && err != nil {
+			t.Errorf("Decode() %d bytes error = %v", size, err)
+		}
+		if size > MaxPayloadSize && !errors.Is(err, ErrPacketSize) {
+			t.Errorf("Decode() %d bytes error = %v, want %v", size, err, ErrPacketSize)
+		}
+	}
+}
+
+func FuzzDecodePacket(f *testing.F) {
+	up, _, err := DeriveKeys([]byte("secret"), []byte("nonce"))
+	if err != nil {
+		f.Fatalf("DeriveKeys() error = %v", err)
+	}
+
+	const salt = 0x4A7BAAE0
+
+	g := rand.NewChaCha8([32]byte{0, 1, 2, 3})
+	for _, key := range []*Key{nil, up} {
+		for style := range numStyles {
+			for _, tt := range decodePacketTests {
+				packet := Packet{
+					Data:     []byte(tt.data),
+					Type:     tt.typ,
+					CID:      NewConnID(g),
+					Size:     len(tt.data) + int(style),
+					Compress: true,
+				}
+				packet.UseStyles(1 << style)
+				packet.InitEncode(g, salt)
+				packet.UseKey(key)
+				f.Add(Encode(&packet, nil), key != nil)
+			}
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, sealed bool) {
+		var p Packet
+		p.InitDecode(salt)
+		p.UseStyles(AllStyles)
+		if sealed {
+			p.UseKey(up)
+		}
+		err := Decode(&p, data)
+		if err != nil {
+			return
+		}
+		if len(p.Data) > MaxPayloadSize {
+			t.Errorf("Decode() data length = %d, exceeds %d", len(p.Data), MaxPayloadSize)
+		}
+	})
+}
+
 func logPacket(t *testing.T, title string, p *Packet) {
 	t.Logf("%s packet:", title)
 	t.Logf("  cid:  %s", p.CID)
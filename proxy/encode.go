@@ -11,6 +11,9 @@ func Encode(p *Packet, buf []byte) []byte {
 	}
 
 	c := encoder{buf: buf}
+	if p.key != nil {
+		return c.sealedPacket(p)
+	}
 	return c.packet(p)
 }
 
@@ -25,10 +28,11 @@ func (c *encoder) packet(p *Packet) []byte {
 		2+ // style prefix
 			8+ // fixed start tjunk
 			8+ // at most 8 bytes of varlen tjunk
-			3+ // reserved tjunk
+			3+ // sequence number
 			1+ // packet type
 			16+ // connection id
 			len(p.Data)+
+			len(p.pad)+
 			4+ // control sum
 			8+ // at most 8 bytes of varlen tjunk
 			8+ // fixed end tjunk
@@ -43,59 +47,42 @@ func (c *encoder) packet(p *Packet) []byte {
 	len1 := 1 + (h & 0b111)
 	len2 := 1 + ((h >> 3) & 0b111)
 
-	typ := uint8(p.Type) | (p.junk1[20] & 0xF0)
+	typ := p.typeByte()
 
-	i1 := p.junk1[0] & 0b111
-	i2 := uint8(len2) + p.junk2[len2]&0b111
-	hasher.reset(p.salt)
-	hasher.putb(p.junk1[i1])
-	hasher.put(p.CID[:])
-	hasher.put(p.Data[:min(4, len(p.Data))])
-	hasher.putb(p.junk2[i2])
+	// only low bits of sequence number are stored
+	seq := [3]byte{byte(p.Seq), byte(p.Seq >> 8), byte(p.Seq >> 16)}
+
+	style := p.styles.pick(p.pick)
+	mark := c.start(style)
+	c.put(p.junk1[:8+len1])
+	c.put(seq[:])
+	c.putb(typ)
+	c.put(p.CID[:])
+	c.put(p.Data)
+	c.put(p.pad)
 
-	csum := hasher.get32()
+	suffix := p.junk2[:8+len2]
+
+	// control sum covers whole inner part except itself
+	var sh SipHash
+	sh.reset(p.salt)
+	sh.put(c.buf[mark:])
+	sh.put(suffix)
+	csum := sh.get32()
 
 	if debug {
-		suffix := p.junk2[len2 : 8+len2]
 		fmt.Printf("data(4): %v\n", p.Data[:min(4, len(p.Data))])
 		fmt.Printf("csum:    %08X\n", csum)
 		fmt.Printf("suffix:  %v\n", suffix)
 	}
 
-	c.start(p.style)
-	c.put(p.junk1[:8+len1+3])
-	c.putb(typ)
-	c.put(p.CID[:])
-	c.put(p.Data)
 	c.u32(csum)
-	c.put(p.junk2[:8+len2])
-	c.end(p.style)
+	c.put(suffix)
+	c.end(style, mark)
 
 	return c.buf
 }
 
-func (c *encoder) start(s Style) {
-	switch s {
-	case Style0:
-		c.puts(`{"`)
-	case Style1:
-		c.puts(`["`)
-	default:
-		panic(fmt.Sprintf("unexpected style (=%d)", s))
-	}
-}
-
-func (c *encoder) end(s Style) {
-	switch s {
-	case Style0:
-		c.puts(`"}`)
-	case Style1:
-		c.puts(`"]`)
-	default:
-		panic(fmt.Sprintf("unexpected style (=%d)", s))
-	}
-}
-
 func (c *encoder) put(data []byte) {
 	c.buf = append(c.buf, data...)
 }
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+)
+
+// InitialWindow is number of bytes each side of a connection may send
+// before receiving any window update from the peer.
+//
+// Each side grants more credit to the peer with PingWindow pings as
+// received data is consumed. Thus a slow consumer of one connection
+// throttles only the peer of this connection, other connections inside
+// the same tunnel are not affected.
+const InitialWindow = 1 << 18
+
+var ErrWindowExceeded = errors.New("flow control window exceeded")
+
+// SendWindow limits amount of data sent over a connection by credit
+// granted by the peer.
+type SendWindow struct {
+	mu sync.Mutex
+
+	// number of bytes which can be sent right now
+	credit int
+
+	// signals waiting sender that credit was granted
+	wake chan struct{}
+
+	// closed when no more data can be sent
+	done chan struct{}
+
+	closeOnce sync.Once
+}
+
+func (w *SendWindow) Init() {
+	w.credit = InitialWindow
+	w.wake = make(chan struct{}, 1)
+	w.done = make(chan struct{})
+}
+
+var ErrWindowClosed = errors.New("send window closed")
+
+// Acquire waits until some credit is available and takes at most n bytes
+// of it. Returns number of acquired bytes.
+//
+// Returns ErrWindowClosed if window is closed and cancel error if cancel
+// channel is closed before credit becomes available.
+func (w *SendWindow) Acquire(n int, cancel <-chan struct{}, cancelErr error) (int, error) {
+	for {
+		select {
+		case <-w.done:
+			return 0, ErrWindowClosed
+		default:
+		}
+
+		w.mu.Lock()
+		if w.credit > 0 {
+			k := min(n, w.credit)
+			w.credit -= k
+			w.mu.Unlock()
+			return k, nil
+		}
+		w.mu.Unlock()
+
+		select {
+		case <-w.done:
+			return 0, ErrWindowClosed
+		case <-cancel:
+			return 0, cancelErr
+		case <-w.wake:
+		}
+	}
+}
+
+// TryAcquire takes exactly n bytes of credit without waiting. Returns false
+// if not enough credit is available or window is closed.
+func (w *SendWindow) TryAcquire(n int) bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.credit < n {
+		return false
+	}
+	w.credit -= n
+	return true
+}
+
+// Close wakes up waiting sender, all subsequent Acquire calls will fail.
+// Safe to call multiple times.
+func (w *SendWindow) Close() {
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+}
+
+// Grant adds credit received from the peer.
+func (w *SendWindow) Grant(n int) {
+	w.mu.Lock()
+	w.credit += n
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// RecvWindow keeps track of data received over a connection and decides
+// when more credit should be granted to the peer.
+type RecvWindow struct {
+	mu sync.Mutex
+
+	// number of bytes received, but not consumed yet
+	buffered int
+
+	// number of bytes consumed since last grant
+	consumed int
+}
+
+// Receive accounts n bytes received from the peer. Returns ErrWindowExceeded
+// if peer sent more data than it was allowed to.
+func (w *RecvWindow) Receive(n int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buffered+w.consumed+n > InitialWindow {
+		return ErrWindowExceeded
+	}
+	w.buffered += n
+	return nil
+}
+
+// Consume accounts n bytes consumed by local reader. Returns number of bytes
+// which should be granted to the peer. Zero means that no window update
+// should be sent yet.
+func (w *RecvWindow) Consume(n int) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buffered -= n
+	w.consumed += n
+
+	// grant in large portions to avoid flood of window updates
+	if w.consumed < InitialWindow/4 {
+		return 0
+	}
+	k := w.consumed
+	w.consumed = 0
+	return k
+}
+
+// Queue holds data chunks received over a connection until they are
+// consumed. Push never blocks, thus the tunnel reader is never stalled
+// by a slow consumer. Queue size is bounded by RecvWindow instead.
+type Queue struct {
+	mu sync.Mutex
+
+	chunks [][]byte
+
+	// signals waiting consumer that new chunk was pushed
+	wake chan struct{}
+
+	// true when no more chunks will be pushed
+	closed bool
+}
+
+func (q *Queue) Init() {
+	q.wake = make(chan struct{}, 1)
+}
+
+func (q *Queue) Push(data []byte) {
+	q.mu.Lock()
+	q.chunks = append(q.chunks, data)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close marks that no more chunks will be pushed to the queue.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Closed reports whether queue was closed. Consumer should check it before
+// Pop, then empty queue means that all chunks were consumed.
+func (q *Queue) Closed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// Pop returns next chunk from the queue. Returns false if queue is empty.
+func (q *Queue) Pop() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.chunks) == 0 {
+		return nil, false
+	}
+	data := q.chunks[0]
+	q.chunks[0] = nil
+	q.chunks = q.chunks[1:]
+	return data, true
+}
+
+// Wait returns channel which receives a value after new chunk is pushed.
+// Consumer should try Pop again after receiving from it.
+func (q *Queue) Wait() <-chan struct{} {
+	return q.wake
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Sends size bytes to client over each opened stream. Respects flow control
+// windows granted by client.
+func (s *testServer) serveFlood(size int) error {
+	var mu sync.Mutex
+	windows := make(map[ConnID]*SendWindow)
+	defer func() {
+		mu.Lock()
+		for _, w := range windows {
+			w.Close()
+		}
+		mu.Unlock()
+	}()
+
+	for {
+		p, err := s.read()
+		if err != nil {
+			return err
+		}
+
+		switch p.Type {
+		case PacketHello:
+			w := &SendWindow{}
+			w.Init()
+			mu.Lock()
+			windows[p.CID] = w
+			mu.Unlock()
+
+			err = s.write(&Packet{Type: PacketHello, CID: p.CID})
+			if err != nil {
+				return err
+			}
+			go s.flood(p.CID, w, size)
+		case PacketPing:
+			var ping Ping
+			err = DecodePing(&ping, p.Data)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			w := windows[p.CID]
+			mu.Unlock()
+			if w != nil {
+				w.Grant(int(ping.Value))
+			}
+		}
+	}
+}
+
+func (s *testServer) flood(cid ConnID, w *SendWindow, size int) {
+	for i := 0; size > 0; i++ {
+		n, err := w.Acquire(min(size, 1<<14), nil, nil)
+		if err != nil {
+			return
+		}
+		size -= n
+
+		err = s.write(&Packet{Type: PacketData, CID: cid, Data: bytes.Repeat([]byte{byte(i)}, n)})
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	const size = 3 * InitialWindow
+
+	tun, s := testConnect(t)
+	go s.serveFlood(size)
+	go tun.Serve(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a, err := tun.Open(ctx, "tcp", "a.example:80")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	b, err := tun.Open(ctx, "tcp", "b.example:80")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	// stream b is not read, but must not block progress of stream a
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := io.ReadFull(a, make([]byte, size))
+	if err != nil {
+		t.Fatalf("read stream a: got %d bytes, error = %v", n, err)
+	}
+
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err = io.ReadFull(b, make([]byte, size))
+	if err != nil {
+		t.Fatalf("read stream b: got %d bytes, error = %v", n, err)
+	}
+}
+
+func TestRecvWindow(t *testing.T) {
+	var w RecvWindow
+
+	err := w.Receive(InitialWindow)
+	if err != nil {
+		t.Fatalf("Receive(InitialWindow) error = %v", err)
+	}
+	err = w.Receive(1)
+	if err != ErrWindowExceeded {
+		t.Fatalf("Receive() over window error = %v, want %v", err, ErrWindowExceeded)
+	}
+
+	k := w.Consume(InitialWindow/4 - 1)
+	if k != 0 {
+		t.Errorf("Consume() = %d, want 0", k)
+	}
+	k = w.Consume(1)
+	if k != InitialWindow/4 {
+		t.Errorf("Consume() = %d, want %d", k, InitialWindow/4)
+	}
+	err = w.Receive(InitialWindow / 4)
+	if err != nil {
+		t.Errorf("Receive() after grant error = %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Handshake holds ephemeral X25519 key pair of one side of a tunnel.
+//
+// Client sends its public key inside websocket upgrade request (see
+// HandshakeCookie) and server replies with its own public key in the
+// first websocket frame after upgrade (see EncodeHandshakeReply). Shared
+// secret obtained from the exchange is mixed with auth token to derive
+// per-tunnel keys and salts. Since key pairs are never reused, recorded
+// traffic of one tunnel does not help to decode another.
+//
+// Auth token is never sent. Instead both messages carry MAC keyed with
+// the token (see SignOffer and SignReply), thus middlebox which sees the
+// handshake can neither learn the token nor replace public keys.
+type Handshake struct {
+	priv *ecdh.PrivateKey
+}
+
+// NewHandshake generates fresh ephemeral key pair.
+func NewHandshake() (*Handshake, error) {
+	priv, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Handshake{priv: priv}, nil
+}
+
+// Message returns handshake message which must be sent to the peer.
+func (h *Handshake) Message() HandshakeMessage {
+	var m HandshakeMessage
+	copy(m.PublicKey[:], h.priv.PublicKey().Bytes())
+	m.Version = ProtocolVersion
+	m.Caps = SupportedCaps
+	return m
+}
+
+// Keys derives tunnel keys from peer handshake message, auth token and
+// handshake nonce. Both sides obtain identical keys.
+func (h *Handshake) Keys(m *HandshakeMessage, token string, nonce []byte) (up *Key, down *Key, err error) {
+	peer, err := ecdh.X25519().NewPublicKey(m.PublicKey[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := h.priv.ECDH(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret := make([]byte, 0, len(shared)+len(token))
+	secret = append(secret, shared...)
+	secret = append(secret, token...)
+	return DeriveKeys(secret, nonce)
+}
+
+// HandshakeMessage is exchanged between client and server
+// while tunnel is being established.
+type HandshakeMessage struct {
+	PublicKey [32]byte
+
+	// Client offers styles it supports, server replies with
+	// negotiated style set (see NegotiateStyles).
+	Styles StyleSet
+
+	// Client offers highest protocol version it speaks,
+	// server replies with version used by tunnel.
+	Version uint8
+
+	// Client offers capabilities it supports, server replies
+	// with common set.
+	Caps Caps
+
+	// Non-zero code in server reply means that tunnel is rejected.
+	// Only CloseIncompatible is used for now.
+	Code CloseCode
+
+	// HMAC-SHA256 keyed with auth token, proves that peer knows the token.
+	MAC [32]byte
+}
+
+// Layout of encoded handshake message:
+//
+//	public key   - 32 bytes
+//	styles       - 2 bytes
+//	version      - 1 byte
+//	caps         - 2 bytes
+//	code         - 1 byte
+//	mac          - 32 bytes
+//
+// Messages from peers which predate versioning end after styles, they
+// are decoded with zero version and without MAC. Bytes after MAC are
+// reserved for future versions and ignored.
+const handshakeMessageSize = handshakeFieldsSize + 32
+
+// Size of message fields covered by MAC.
+const handshakeFieldsSize = 32 + 2 + 1 + 2 + 1
+
+// Size of handshake message sent by peers without protocol version.
+const legacyHandshakeMessageSize = 32 + 2
+
+var (
+	ErrHandshake     = errors.New("bad handshake")
+	ErrHandshakeAuth = errors.New("handshake authentication failed")
+)
+
+// EncodeHandshake encodes message into a string which looks like
+// regular session identifier.
+func EncodeHandshake(m *HandshakeMessage) string {
+	var buf [handshakeMessageSize]byte
+	putHandshakeFields(buf[:handshakeFieldsSize], m)
+	copy(buf[handshakeFieldsSize:], m.MAC[:])
+	return base64.RawURLEncoding.EncodeToString(buf[:])
+}
+
+func putHandshakeFields(buf []byte, m *HandshakeMessage) {
+	copy(buf, m.PublicKey[:])
+	binary.LittleEndian.PutUint16(buf[32:], uint16(m.Styles))
+	buf[34] = m.Version
+	binary.LittleEndian.PutUint16(buf[35:], uint16(m.Caps))
+	buf[37] = uint8(m.Code)
+}
+
+func DecodeHandshake(m *HandshakeMessage, s string) error {
+	if base64.RawURLEncoding.DecodedLen(len(s)) > 2*handshakeMessageSize {
+		return ErrHandshake
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ErrHandshake
+	}
+	if len(buf) != legacyHandshakeMessageSize && len(buf) < handshakeMessageSize {
+		return ErrHandshake
+	}
+
+	copy(m.PublicKey[:], buf[:32])
+	m.Styles = StyleSet(binary.LittleEndian.Uint16(buf[32:]))
+	if len(buf) == legacyHandshakeMessageSize {
+		m.Version = 0
+		m.Caps = 0
+		m.Code = CloseOK
+		m.MAC = [32]byte{}
+		return nil
+	}
+
+	m.Version = buf[34]
+	m.Caps = Caps(binary.LittleEndian.Uint16(buf[35:]))
+	m.Code = CloseCode(buf[37])
+	copy(m.MAC[:], buf[handshakeFieldsSize:])
+	return nil
+}
+
+// SignOffer puts MAC of client handshake message into it. MAC is keyed with
+// auth token and binds client public key and offer to handshake nonce.
+func (m *HandshakeMessage) SignOffer(token string, nonce []byte) {
+	m.MAC = handshakeMAC(token, nonce, m, nil)
+}
+
+// VerifyOffer checks MAC of client handshake message. Returns ErrHandshakeAuth
+// if client does not know auth token or message was altered.
+func (m *HandshakeMessage) VerifyOffer(token string, nonce []byte) error {
+	return checkHandshakeMAC(m.MAC, handshakeMAC(token, nonce, m, nil))
+}
+
+// SignReply puts MAC of server handshake message into it. MAC is keyed with
+// auth token and covers the whole exchange: nonce, client offer and the reply.
+// Must be called after reply is filled (see Accept).
+func (m *HandshakeMessage) SignReply(offer *HandshakeMessage, token string, nonce []byte) {
+	m.MAC = handshakeMAC(token, nonce, offer, m)
+}
+
+// VerifyReply checks MAC of server reply to the given client offer. Client must
+// verify reply before deriving keys from it. Returns ErrHandshakeAuth if server
+// does not know auth token or any of the messages was altered.
+func (m *HandshakeMessage) VerifyReply(offer *HandshakeMessage, token string, nonce []byte) error {
+	return checkHandshakeMAC(m.MAC, handshakeMAC(token, nonce, offer, m))
+}
+
+func checkHandshakeMAC(got, want [32]byte) error {
+	if !hmac.Equal(got[:], want[:]) {
+		return ErrHandshakeAuth
+	}
+	return nil
+}
+
+// Computes MAC of client offer or, if reply is not nil, of the whole
+// exchange. Labels separate offer and reply MACs, thus one cannot be
+// passed for another.
+func handshakeMAC(token string, nonce []byte, offer *HandshakeMessage, reply *HandshakeMessage) [32]byte {
+	h := hmac.New(sha256.New, []byte(token))
+	label := "higs offer"
+	if reply != nil {
+		label = "higs reply"
+	}
+	h.Write([]byte(label))
+	h.Write(nonce)
+
+	var buf [handshakeFieldsSize]byte
+	putHandshakeFields(buf[:], offer)
+	h.Write(buf[:])
+	if reply != nil {
+		putHandshakeFields(buf[:], reply)
+		h.Write(buf[:])
+	}
+	return [32]byte(h.Sum(nil))
+}
+
+// Name of cookie which carries client handshake message.
+const HandshakeCookieName = "sid"
+
+// HandshakeCookie returns value of Cookie header which carries client
+// handshake message inside websocket upgrade request.
+func HandshakeCookie(m *HandshakeMessage) string {
+	return HandshakeCookieName + "=" + EncodeHandshake(m)
+}
+
+// EncodeHandshakeReply encodes server handshake message as a payload
+// for the first websocket frame after upgrade.
+func EncodeHandshakeReply(m *HandshakeMessage) []byte {
+	return fmt.Appendf(nil, `{"%s":"%s"}`, HandshakeCookieName, EncodeHandshake(m))
+}
+
+func DecodeHandshakeReply(m *HandshakeMessage, data []byte) error {
+	s, ok := strings.CutPrefix(string(data), `{"`+HandshakeCookieName+`":"`)
+	if !ok {
+		return ErrHandshake
+	}
+	s, ok = strings.CutSuffix(s, `"}`)
+	if !ok {
+		return ErrHandshake
+	}
+	return DecodeHandshake(m, s)
+}
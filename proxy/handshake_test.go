@@ -0,0 +1,335 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+// Performs handshake between client and server, returns keys
+// for client to server direction obtained by each side.
+func testHandshake(t *testing.T, token string, nonce string) (client *Key, server *Key) {
+	ch, err := NewHandshake()
+	if err != nil {
+		t.Fatalf("NewHandshake() error = %v", err)
+	}
+	sh, err := NewHandshake()
+	if err != nil {
+		t.Fatalf("NewHandshake() error = %v", err)
+	}
+
+	cm := ch.Message()
+	cm.Styles = AllStyles
+	cm.SignOffer(token, []byte(nonce))
+	cookie := HandshakeCookie(&cm)
+	var gotClient HandshakeMessage
+	err = DecodeHandshake(&gotClient, strings.TrimPrefix(cookie, HandshakeCookieName+"="))
+	if err != nil {
+		t.Fatalf("DecodeHandshake() error = %v", err)
+	}
+	if gotClient != cm {
+		t.Fatalf("DecodeHandshake() = %+v, want %+v", gotClient, cm)
+	}
+	err = gotClient.VerifyOffer(token, []byte(nonce))
+	if err != nil {
+		t.Fatalf("VerifyOffer() error = %v", err)
+	}
+
+	sm := sh.Message()
+	sm.Accept(&gotClient, SupportedCaps, DefaultStyles)
+	if sm.Code != CloseOK {
+		t.Fatalf("Accept() code = %s", sm.Code)
+	}
+	sm.SignReply(&gotClient, token, []byte(nonce))
+	reply := EncodeHandshakeReply(&sm)
+	var gotServer HandshakeMessage
+	err = DecodeHandshakeReply(&gotServer, reply)
+	if err != nil {
+		t.Fatalf("DecodeHandshakeReply() error = %v", err)
+	}
+	if gotServer != sm {
+		t.Fatalf("DecodeHandshakeReply() = %+v, want %+v", gotServer, sm)
+	}
+	err = gotServer.VerifyReply(&cm, token, []byte(nonce))
+	if err != nil {
+		t.Fatalf("VerifyReply() error = %v", err)
+	}
+	err = gotServer.Check()
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+
+	client, _, err = ch.Keys(&gotServer, token, []byte(nonce))
+	if err != nil {
+		t.Fatalf("client Keys() error = %v", err)
+	}
+	server, _, err = sh.Keys(&gotClient, token, []byte(nonce))
+	if err != nil {
+		t.Fatalf("server Keys() error = %v", err)
+	}
+	return client, server
+}
+
+func TestHandshake(t *testing.T) {
+	const token = "token"
+	const nonce = "rdwCAuY2qmzrQbTkg2fZhA=="
+
+	client, server := testHandshake(t, token, nonce)
+	other, _ := testHandshake(t, token, nonce)
+
+	g := rand.NewChaCha8([32]byte{0, 1, 2, 3})
+	packet := Packet{
+		Data: []byte("hello"),
+		Type: PacketData,
+		CID:  NewConnID(g),
+	}
+	packet.InitEncode(g, client.Salt([4]byte{}))
+	packet.UseKey(client)
+	data := Encode(&packet, nil)
+
+	var got Packet
+	got.InitDecode(server.Salt([4]byte{}))
+	got.UseKey(server)
+	err := Decode(&got, append([]byte(nil), data...))
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	err = comparePackets(&got, &packet)
+	if err != nil {
+		t.Errorf("compare packets: %v", err)
+	}
+
+	// keys from another session must not open the packet, salt from
+	// another session may also change packet layout
+	got = Packet{}
+	got.InitDecode(other.Salt([4]byte{}))
+	got.UseKey(other)
+	err = Decode(&got, data)
+	if !errors.Is(err, ErrPacketAuth) && !errors.Is(err, ErrPacketSize) {
+		t.Errorf("Decode() with keys from another session error = %v, want %v", err, ErrPacketAuth)
+	}
+}
+
+func TestDecodeHandshakeReply(t *testing.T) {
+	tests := []string{
+		``,
+		`{"sid":""}`,
+		`{"sid":"abc"}`,
+		`["sid":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"]`,
+		`{"sid":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}`,
+	}
+
+	for _, tt := range tests {
+		t.Run(tt, func(t *testing.T) {
+			var m HandshakeMessage
+			err := DecodeHandshakeReply(&m, []byte(tt))
+			if !errors.Is(err, ErrHandshake) {
+				t.Errorf("DecodeHandshakeReply() error = %v, want %v", err, ErrHandshake)
+			}
+		})
+	}
+}
+
+func TestHandshakeAccept(t *testing.T) {
+	tests := []struct {
+		name string
+
+		offer HandshakeMessage
+		caps  Caps
+
+		// negotiated capabilities, ignored if incompatible
+		want         Caps
+		incompatible bool
+	}{
+		{
+			name:  "1 all supported",
+			offer: HandshakeMessage{Version: ProtocolVersion, Caps: SupportedCaps},
+			caps:  SupportedCaps,
+			want:  SupportedCaps,
+		},
+		{
+			name:  "2 common set",
+			offer: HandshakeMessage{Version: ProtocolVersion, Caps: CapSealed | CapUDP | CapCompress},
+			caps:  CapSealed | CapIPv6 | CapUDP,
+			want:  CapSealed | CapUDP,
+		},
+		{
+			name:  "3 newer client",
+			offer: HandshakeMessage{Version: ProtocolVersion + 1, Caps: SupportedCaps},
+			caps:  SupportedCaps,
+			want:  SupportedCaps,
+		},
+		{
+			name:         "4 legacy client",
+			offer:        HandshakeMessage{Version: 0},
+			caps:         SupportedCaps,
+			incompatible: true,
+		},
+		{
+			name:         "5 no sealing",
+			offer:        HandshakeMessage{Version: ProtocolVersion, Caps: CapIPv6},
+			caps:         SupportedCaps,
+			incompatible: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reply HandshakeMessage
+			reply.Accept(&tt.offer, tt.caps, DefaultStyles)
+
+			// reply goes through the wire as client would see it
+			var got HandshakeMessage
+			err := DecodeHandshakeReply(&got, EncodeHandshakeReply(&reply))
+			if err != nil {
+				t.Fatalf("DecodeHandshakeReply() error = %v", err)
+			}
+			err = got.Check()
+
+			if tt.incompatible {
+				if got.Code != CloseIncompatible {
+					t.Errorf("Accept() code = %s, want %s", got.Code, CloseIncompatible)
+				}
+				if !errors.Is(err, ErrIncompatible) {
+					t.Errorf("Check() error = %v, want %v", err, ErrIncompatible)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if got.Version != ProtocolVersion {
+				t.Errorf("Accept() version = %d, want %d", got.Version, ProtocolVersion)
+			}
+			if got.Caps != tt.want {
+				t.Errorf("Accept() caps = %s, want %s", got.Caps, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeLegacyHandshake(t *testing.T) {
+	// message from a peer which predates protocol versioning
+	var buf [legacyHandshakeMessageSize]byte
+	buf[0] = 0xAB
+	buf[32] = byte(DefaultStyles)
+
+	var m HandshakeMessage
+	err := DecodeHandshake(&m, base64.RawURLEncoding.EncodeToString(buf[:]))
+	if err != nil {
+		t.Fatalf("DecodeHandshake() error = %v", err)
+	}
+	if m.PublicKey[0] != 0xAB || m.Styles != DefaultStyles || m.Version != 0 {
+		t.Errorf("DecodeHandshake() = %+v", m)
+	}
+
+	var reply HandshakeMessage
+	reply.Accept(&m, SupportedCaps, AllStyles)
+	if reply.Code != CloseIncompatible {
+		t.Errorf("Accept() code = %s, want %s", reply.Code, CloseIncompatible)
+	}
+}
+
+func TestHandshakeMAC(t *testing.T) {
+	const token = "token"
+	const nonce = "rdwCAuY2qmzrQbTkg2fZhA=="
+
+	ch, err := NewHandshake()
+	if err != nil {
+		t.Fatalf("NewHandshake() error = %v", err)
+	}
+	sh, err := NewHandshake()
+	if err != nil {
+		t.Fatalf("NewHandshake() error = %v", err)
+	}
+	mitm, err := NewHandshake()
+	if err != nil {
+		t.Fatalf("NewHandshake() error = %v", err)
+	}
+
+	offer := ch.Message()
+	offer.SignOffer(token, []byte(nonce))
+	reply := sh.Message()
+	reply.Accept(&offer, SupportedCaps, DefaultStyles)
+	reply.SignReply(&offer, token, []byte(nonce))
+
+	tests := []struct {
+		name string
+
+		// alters messages after they were signed
+		tamper func(offer, reply *HandshakeMessage)
+
+		token string
+		nonce string
+	}{
+		{
+			name:   "1 wrong token",
+			tamper: func(offer, reply *HandshakeMessage) {},
+			token:  "other",
+			nonce:  nonce,
+		},
+		{
+			name:   "2 wrong nonce",
+			tamper: func(offer, reply *HandshakeMessage) {},
+			token:  token,
+			nonce:  "dGhlIHNhbXBsZSBub25jZQ==",
+		},
+		{
+			name: "3 swapped client key",
+			tamper: func(offer, reply *HandshakeMessage) {
+				offer.PublicKey = mitm.Message().PublicKey
+			},
+			token: token,
+			nonce: nonce,
+		},
+		{
+			name: "4 swapped server key",
+			tamper: func(offer, reply *HandshakeMessage) {
+				reply.PublicKey = mitm.Message().PublicKey
+			},
+			token: token,
+			nonce: nonce,
+		},
+		{
+			name: "5 downgraded caps",
+			tamper: func(offer, reply *HandshakeMessage) {
+				offer.Caps &^= CapCompress
+			},
+			token: token,
+			nonce: nonce,
+		},
+		{
+			name: "6 offer mac as reply mac",
+			tamper: func(offer, reply *HandshakeMessage) {
+				*reply = *offer
+			},
+			token: token,
+			nonce: nonce,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, r := offer, reply
+			tt.tamper(&o, &r)
+
+			errOffer := o.VerifyOffer(tt.token, []byte(tt.nonce))
+			errReply := r.VerifyReply(&o, tt.token, []byte(tt.nonce))
+			if !errors.Is(errOffer, ErrHandshakeAuth) && !errors.Is(errReply, ErrHandshakeAuth) {
+				t.Errorf("VerifyOffer() error = %v, VerifyReply() error = %v, want %v", errOffer, errReply, ErrHandshakeAuth)
+			}
+		})
+	}
+
+	err = offer.VerifyOffer(token, []byte(nonce))
+	if err != nil {
+		t.Errorf("VerifyOffer() error = %v", err)
+	}
+	err = reply.VerifyReply(&offer, token, []byte(nonce))
+	if err != nil {
+		t.Errorf("VerifyReply() error = %v", err)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"math/rand/v2"
+	"net"
 	"net/netip"
+	"strconv"
 )
 
 const (
@@ -12,10 +14,30 @@ const (
 	NetworkUDP = 1
 )
 
+// MaxDatagramSize is maximum size of a single datagram carried by udp stream.
+// Datagram is never split, thus it must fit into a single packet.
+const MaxDatagramSize = MaxPayloadSize
+
+var ErrDatagramSize = errors.New("datagram too large")
+
+func isDatagramNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return true
+	default:
+		return false
+	}
+}
+
 type Hello struct {
 	AddrPort netip.AddrPort
 
-	junk [8]byte
+	// Destination host name. If not empty, then only port
+	// part of AddrPort field is used and server must resolve
+	// this name by itself.
+	Name string
+
+	junk [16]byte
 
 	Network uint8
 
@@ -25,10 +47,34 @@ type Hello struct {
 func (h *Hello) InitEncode(g *rand.ChaCha8, network uint8, ap netip.AddrPort) {
 	putJunk(g, h.junk[:])
 	h.AddrPort = ap
+	h.Name = ""
 	h.Network = network
 	h.ok = true
 }
 
+// InitEncodeName same as InitEncode, but prepares hello with host name
+// as destination.
+func (h *Hello) InitEncodeName(g *rand.ChaCha8, network uint8, name string, port uint16) {
+	putJunk(g, h.junk[:])
+	h.AddrPort = netip.AddrPortFrom(netip.Addr{}, port)
+	h.Name = name
+	h.Network = network
+	h.ok = true
+}
+
+// Port returns destination port.
+func (h *Hello) Port() uint16 {
+	return h.AddrPort.Port()
+}
+
+// Target returns destination in "host:port" form suitable for dialing.
+func (h *Hello) Target() string {
+	if h.Name == "" {
+		return h.AddrPort.String()
+	}
+	return net.JoinHostPort(h.Name, strconv.FormatUint(uint64(h.Port()), 10))
+}
+
 func EncodeHello(h *Hello, buf []byte) []byte {
 	if !h.ok {
 		panic("no init")
@@ -39,22 +85,30 @@ func EncodeHello(h *Hello, buf []byte) []byte {
 }
 
 const (
-	IPv4 = 0
-	IPv6 = 1
+	IPv4     = 0
+	IPv6     = 1
+	HostName = 2
 )
 
+// Max length of host name carried inside hello.
+const maxHostNameLength = 253
+
 func (c *encoder) hello(h *Hello) []byte {
 	addr := h.AddrPort.Addr()
 	port := h.AddrPort.Port()
-	bl := addr.BitLen()
 	var typ uint8
-	switch bl {
-	case 32:
-		typ = IPv4
-	case 128:
-		typ = IPv6
-	default:
-		panic(fmt.Sprintf("unexpected address bit length (=%d)", bl))
+	if h.Name != "" {
+		typ = HostName
+	} else {
+		bl := addr.BitLen()
+		switch bl {
+		case 32:
+			typ = IPv4
+		case 128:
+			typ = IPv6
+		default:
+			panic(fmt.Sprintf("unexpected address bit length (=%d)", bl))
+		}
 	}
 
 	c.putb((h.junk[0] & 0b11111100) | h.Network)
@@ -77,7 +131,31 @@ func (c *encoder) hello(h *Hello) []byte {
 		c.putb(a[3])
 		c.putb(h.junk[5])
 	case IPv6:
-		panic("stub")
+		a := addr.As16()
+
+		// address bytes go in pairs, each pair is followed by junk byte
+		for i := range 8 {
+			c.putb(a[2*i])
+			c.putb(a[2*i+1])
+			c.putb(h.junk[2+i])
+		}
+	case HostName:
+		name := h.Name
+		if len(name) > maxHostNameLength {
+			panic(fmt.Sprintf("host name is too long (%d bytes)", len(name)))
+		}
+
+		c.putb(uint8(len(name)))
+		c.putb(h.junk[2])
+
+		// same as with IPv6, but junk bytes are taken from junk array cyclically
+		for i := 0; i < len(name); i += 2 {
+			c.putb(name[i])
+			if i+1 < len(name) {
+				c.putb(name[i+1])
+			}
+			c.putb(h.junk[3+(i>>1)%13])
+		}
 	default:
 		panic(fmt.Sprintf("unexpected address type (=%d)", typ))
 	}
@@ -89,12 +167,26 @@ var (
 	ErrAddrType  = errors.New("bad type")
 	ErrHelloSize = errors.New("bad size")
 	ErrNetwork   = errors.New("bad network")
+	ErrHostName  = errors.New("bad host name")
 )
 
 const minHelloLength = 1 + // network
 	1 + // address type
 	2 + // port
-	8 // address + junk (mixed)
+	2 // at least host name length + junk
+
+const (
+	// Length of encoded IPv4 address mixed with junk.
+	ipv4Length = 4 + 4
+
+	// Length of encoded IPv6 address mixed with junk.
+	ipv6Length = 16 + 8
+)
+
+// Returns length of encoded host name (with length prefix) mixed with junk.
+func hostNameLength(n int) int {
+	return 2 + n + (n+1)/2
+}
 
 func DecodeHello(h *Hello, data []byte) error {
 	d := decoder{buf: data}
@@ -118,7 +210,7 @@ func (d *decoder) hello(h *Hello) error {
 
 	typ := d.u8() & 0b11
 	switch typ {
-	case IPv4, IPv6:
+	case IPv4, IPv6, HostName:
 		// continue execution
 	default:
 		return ErrAddrType
@@ -127,8 +219,13 @@ func (d *decoder) hello(h *Hello) error {
 	port := d.u16()
 
 	var ip netip.Addr
+	var name string
 	switch typ {
 	case IPv4:
+		if d.len() != ipv4Length {
+			return ErrHelloSize
+		}
+
 		var a [4]byte
 		b := d.bytes(8)
 		a[0] = b[0]
@@ -137,13 +234,64 @@ func (d *decoder) hello(h *Hello) error {
 		a[3] = b[6]
 		ip = netip.AddrFrom4(a)
 	case IPv6:
-		panic("stub")
+		if d.len() != ipv6Length {
+			return ErrHelloSize
+		}
+
+		var a [16]byte
+		b := d.bytes(ipv6Length)
+		for i := range 8 {
+			a[2*i] = b[3*i]
+			a[2*i+1] = b[3*i+1]
+		}
+		ip = netip.AddrFrom16(a)
+	case HostName:
+		n := int(d.u8())
+		if n == 0 || n > maxHostNameLength {
+			return ErrHostName
+		}
+		d.skip(1) // junk after length
+		if d.len() != hostNameLength(n)-2 {
+			return ErrHelloSize
+		}
+
+		b := d.bytes(d.len())
+		s := make([]byte, 0, n)
+		for i := 0; i < len(b); i += 3 {
+			s = append(s, b[i])
+			if len(s) < n {
+				s = append(s, b[i+1])
+			}
+		}
+		if !isHostName(s) {
+			return ErrHostName
+		}
+		name = string(s)
 	default:
 		panic(fmt.Sprintf("unexpected address type (=%d)", typ))
 	}
 	ap := netip.AddrPortFrom(ip, port)
 
 	h.AddrPort = ap
+	h.Name = name
 	h.Network = network
 	return nil
 }
+
+// Reports whether given string consists only of characters
+// allowed in host names.
+func isHostName(s []byte) bool {
+	if len(s) == 0 || s[0] == '.' || s[0] == '-' {
+		return false
+	}
+
+	for _, c := range s {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '.' || c == '-' || c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
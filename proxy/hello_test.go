@@ -4,31 +4,45 @@ import (
 	"errors"
 	"math/rand/v2"
 	"net/netip"
+	"strings"
 	"testing"
 )
 
-func TestDecodeHello(t *testing.T) {
-	tests := []struct {
-		addr string
-		net  uint8
-	}{
-		{
-			addr: "8.8.8.8:53",
-			net:  NetworkUDP,
-		},
-		{
-			addr: "127.0.0.1:8081",
-		},
-		{
-			addr: "209.85.233.91:80",
-		},
-		{
-			addr: "188.186.154.88:443",
-		},
-	}
+var helloTests = []struct {
+	addr string
+	net  uint8
+}{
+	{
+		addr: "8.8.8.8:53",
+		net:  NetworkUDP,
+	},
+	{
+		addr: "127.0.0.1:8081",
+	},
+	{
+		addr: "209.85.233.91:80",
+	},
+	{
+		addr: "188.186.154.88:443",
+	},
+	{
+		addr: "[2001:4860:4860::8888]:53",
+		net:  NetworkUDP,
+	},
+	{
+		addr: "[::1]:8081",
+	},
+	{
+		addr: "[2a00:1450:4010:c0e::71]:443",
+	},
+	{
+		addr: "[::ffff:188.186.154.88]:443",
+	},
+}
 
+func TestDecodeHello(t *testing.T) {
 	g := rand.NewChaCha8([32]byte{0, 1, 2, 3})
-	for _, tt := range tests {
+	for _, tt := range helloTests {
 		t.Run(tt.addr, func(t *testing.T) {
 			ap, err := netip.ParseAddrPort(tt.addr)
 			if err != nil {
@@ -59,6 +73,90 @@ func TestDecodeHello(t *testing.T) {
 	}
 }
 
+var helloNameTests = []struct {
+	name string
+	port uint16
+	net  uint8
+}{
+	{
+		name: "t.co",
+		port: 443,
+	},
+	{
+		name: "ya.ru",
+		port: 80,
+	},
+	{
+		name: "www.youtube.com",
+		port: 443,
+	},
+	{
+		name: "dns.google",
+		port: 53,
+		net:  NetworkUDP,
+	},
+	{
+		name: "localhost",
+		port: 8081,
+	},
+	{
+		name: strings.Repeat("abcdefghi.", 25) + "com",
+		port: 443,
+	},
+}
+
+func TestDecodeHelloName(t *testing.T) {
+	g := rand.NewChaCha8([32]byte{0, 1, 2, 3})
+	for _, tt := range helloNameTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h Hello
+			h.InitEncodeName(g, tt.net, tt.name, tt.port)
+
+			var buf [16]byte
+			data := EncodeHello(&h, buf[:0])
+
+			var got Hello
+			err := DecodeHello(&got, data)
+			if err != nil {
+				t.Errorf("DecodeHello() error = %v", err)
+				return
+			}
+
+			err = compareHellos(&got, &h)
+			if err != nil {
+				t.Errorf("compare hellos: %v", err)
+				logHello(t, "got", &got)
+				logHello(t, "want", &h)
+			}
+		})
+	}
+}
+
+func FuzzDecodeHello(f *testing.F) {
+	g := rand.NewChaCha8([32]byte{0, 1, 2, 3})
+	for _, tt := range helloTests {
+		var h Hello
+		h.InitEncode(g, tt.net, netip.MustParseAddrPort(tt.addr))
+		f.Add(EncodeHello(&h, nil))
+	}
+	for _, tt := range helloNameTests {
+		var h Hello
+		h.InitEncodeName(g, tt.net, tt.name, tt.port)
+		f.Add(EncodeHello(&h, nil))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var h Hello
+		err := DecodeHello(&h, data)
+		if err != nil {
+			return
+		}
+		if h.Name != "" && !isHostName([]byte(h.Name)) {
+			t.Errorf("DecodeHello() name = %q", h.Name)
+		}
+	})
+}
+
 func logHello(t *testing.T, title string, h *Hello) {
 	t.Logf("%s hello:", title)
 
@@ -69,7 +167,7 @@ func logHello(t *testing.T, title string, h *Hello) {
 	case NetworkUDP:
 		p = "udp"
 	}
-	t.Logf("  addr: %s://%s", p, h.AddrPort)
+	t.Logf("  addr: %s://%s", p, h.Target())
 }
 
 func compareHellos(a, b *Hello) error {
@@ -79,5 +177,8 @@ func compareHellos(a, b *Hello) error {
 	if a.AddrPort != b.AddrPort {
 		return errors.New("address not equal")
 	}
+	if a.Name != b.Name {
+		return errors.New("name not equal")
+	}
 	return nil
 }
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// PingInterval is time between keepalive pings sent over a tunnel.
+const PingInterval = 15 * time.Second
+
+// MaxMissedPings is number of consecutive keepalive pings without reply
+// after which tunnel is considered dead.
+const MaxMissedPings = 3
+
+var ErrTunnelDead = errors.New("tunnel dead: ping replies missed")
+
+// TunnelID is used as packet cid for pings which refer to the tunnel
+// itself rather than to one of its connections.
+var TunnelID ConnID
+
+// RTTStats describes round trip time measured by keepalive pings.
+type RTTStats struct {
+	// Smoothed round trip time.
+	SRTT time.Duration
+
+	// Smoothed mean deviation of round trip time.
+	Jitter time.Duration
+
+	// Last measured round trip time.
+	Last time.Duration
+
+	// Number of measured round trips.
+	Samples uint64
+
+	// Number of consecutive pings without reply.
+	Missed int
+}
+
+// Keepalive tracks pings sent over a tunnel and replies to them.
+// Only one ping is outstanding at a time.
+type Keepalive struct {
+	mu sync.Mutex
+
+	// time when outstanding ping was sent
+	sent time.Time
+
+	stats RTTStats
+
+	// nonce of outstanding ping
+	nonce uint64
+
+	// true when ping was sent and reply did not come yet
+	pending bool
+}
+
+// Next accounts new ping with the given nonce sent at specified time.
+// Previous ping which did not get reply is counted as missed.
+//
+// Returns false if too many pings were missed, new ping should not be sent
+// in that case.
+func (k *Keepalive) Next(nonce uint64, now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.pending {
+		k.stats.Missed += 1
+	}
+	if k.stats.Missed >= MaxMissedPings {
+		return false
+	}
+
+	k.nonce = nonce
+	k.sent = now
+	k.pending = true
+	return true
+}
+
+// Reply accounts ping reply with the given nonce received at specified time.
+// Returns false if nonce does not match outstanding ping.
+func (k *Keepalive) Reply(nonce uint64, now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if !k.pending || nonce != k.nonce {
+		return false
+	}
+	k.pending = false
+
+	s := &k.stats
+	s.Missed = 0
+
+	// smoothing is the same as in TCP retransmission timer (RFC 6298)
+	r := now.Sub(k.sent)
+	if s.Samples == 0 {
+		s.SRTT = r
+		s.Jitter = r / 2
+	} else {
+		d := s.SRTT - r
+		if d < 0 {
+			d = -d
+		}
+		s.Jitter = (3*s.Jitter + d) / 4
+		s.SRTT = (7*s.SRTT + r) / 8
+	}
+	s.Last = r
+	s.Samples += 1
+	return true
+}
+
+// Stats returns current round trip time statistics.
+func (k *Keepalive) Stats() RTTStats {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.stats
+}
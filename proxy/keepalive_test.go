@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestKeepalive(t *testing.T) {
+	var k Keepalive
+	start := time.Unix(1000, 0)
+
+	if !k.Next(1, start) {
+		t.Fatal("Next() = false on first ping")
+	}
+	if k.Reply(2, start.Add(time.Millisecond)) {
+		t.Error("Reply() = true for wrong nonce")
+	}
+	if !k.Reply(1, start.Add(100*time.Millisecond)) {
+		t.Fatal("Reply() = false for outstanding ping")
+	}
+	got := k.Stats()
+	if got.SRTT != 100*time.Millisecond || got.Jitter != 50*time.Millisecond || got.Samples != 1 {
+		t.Errorf("Stats() after first reply = %+v", got)
+	}
+
+	start = start.Add(time.Second)
+	k.Next(2, start)
+	k.Reply(2, start.Add(20*time.Millisecond))
+	got = k.Stats()
+	if got.SRTT != 90*time.Millisecond || got.Jitter != 57500*time.Microsecond || got.Last != 20*time.Millisecond {
+		t.Errorf("Stats() after second reply = %+v", got)
+	}
+
+	for i := range MaxMissedPings {
+		if !k.Next(uint64(10+i), start.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("Next() = false after %d missed pings", i)
+		}
+	}
+	if k.Next(20, start.Add(time.Minute)) {
+		t.Errorf("Next() = true after %d missed pings", MaxMissedPings)
+	}
+}
+
+func TestTunnelKeepalive(t *testing.T) {
+	tun, s := testConnect(t)
+	tun.pingInterval = 10 * time.Millisecond
+	go s.serveEcho()
+	go tun.Serve(context.Background())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for tun.RTT().Samples < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("no ping replies measured, stats = %+v", tun.RTT())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTunnelDead(t *testing.T) {
+	tun, s := testConnect(t)
+	tun.pingInterval = 10 * time.Millisecond
+
+	// server reads packets, but never replies to pings
+	go func() {
+		for {
+			_, err := s.read()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- tun.Serve(context.Background())
+	}()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrTunnelDead) {
+			t.Errorf("Serve() error = %v, want %v", err, ErrTunnelDead)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel was not declared dead")
+	}
+}
@@ -44,6 +44,9 @@ func (t PacketType) IsJunk() bool {
 const (
 	// Such packets are send between client and server to check tunnel or specific
 	// connection state and keep tunnel alive.
+	//
+	// Keepalive pings carry TunnelID cid, both sides send them periodically
+	// and measure round trip time by replies.
 	PacketPing PacketType = iota
 
 	// Create new connection over the tunnel.
@@ -63,6 +66,10 @@ const (
 	// When client receives such packet from server it indicates that connection
 	// was closed on behalf of the target and client should stop sending and receiving
 	// data for this connection.
+	//
+	// Packet data carries CloseCode. With CloseWrite code only sending side of
+	// the connection is closed (half-close), connection ends after both sides
+	// send such packet.
 	PacketClose
 
 	// Packet with regular connection data transmission between client and server.
@@ -75,17 +82,6 @@ const (
 	PacketJunk
 )
 
-// Style determines packet encoding masquerade style.
-type Style uint8
-
-const (
-	// {"..."}
-	Style0 Style = iota
-
-	// ["..."]
-	Style1
-)
-
 var ErrBadPacketType = errors.New("bad packet type")
 
 func (t PacketType) Valid() error {
@@ -108,17 +104,23 @@ func (t PacketType) Valid() error {
 //
 //	{"..."}
 //	["..."]
+//	{"type":"...","data":"..."}
+//	"..."
+//	[...]
 //
 // Where instead of ... comes encoded data with variable content. This content is called
 // "inner part" of encoded packet. Inner part starts and ends with text junk (tjunk) data.
+// Some styles transform inner part to base64 or list of numbers (see Style). Style is
+// picked at random from style set negotiated for the tunnel.
 //
 //	<start>
 //	tjunk        - 8 bytes
 //	tjunk        - varlen    (1 - 8 bytes)
-//	junk         - 3 bytes   (reserved for future use)
-//	type         - 1 byte    (low 4 bits is type, high 4 bits are junk)
+//	seq          - 3 bytes   (low bits of sequence number)
+//	type         - 1 byte    (low 4 bits is type, 2 bits are junk, compress and padding flags)
 //	cid          - 16 bytes
 //	packet data  - varlen    (arbitrary)
+//	padding      - varlen    (only if padding flag is set)
 //	csum         - 4 bytes   (control sum)
 //	tjunk        - varlen    (1 - 8 bytes)
 //	tjunk        - 8 bytes
@@ -129,21 +131,75 @@ func (t PacketType) Valid() error {
 // (with salt). First tjunk varlen comes from lower 3 bits of hash value
 // and second comes from next 3 bits.
 //
-// Control sum is calculated from:
-//   - packet salt
-//   - 1 chosen byte of first fixed tjunk
-//   - 16 bytes of cid
-//   - at most 4 bytes of packet data (if present)
-//   - 1 chosen byte of last fixed tjunk
+// Control sum is SipHash-2-4 of the whole inner part (except control sum
+// itself) folded into 32 bits. Hash key is derived from packet salt, thus
+// control sum detects corruption, but does not authenticate the packet.
+//
+// When packet is encoded with a key (see Key), inner part has different layout:
+//
+//	<start>
+//	tjunk        - 8 bytes
+//	tjunk        - varlen    (1 - 8 bytes)
+//	nonce        - 12 bytes  (random)
+//	sealed       - varlen    (3 bytes of junk, type, cid, 8 bytes of sequence number and packet data sealed with AEAD)
+//	tag          - 16 bytes  (AEAD authentication tag)
+//	tjunk        - varlen    (1 - 8 bytes)
+//	tjunk        - 8 bytes
+//	<end>
+//
+// Packet salt and tjunk before nonce are used as additional authenticated data.
+//
+// Padding flag is the highest bit of type byte. Padded packet has junk bytes
+// appended to its data followed by 2 bytes with number of these junk bytes.
+// Padding is removed during decoding.
 //
-// What byte to chose in tjunks is determined by lower 3 bits of first byte
-// for each corresponding tjunk.
+// Compress flag is the next bit of type byte. Data of such packet (without
+// padding) is compressed with deflate using preset dictionary. Compression
+// is used only if both sides support CapCompress.
+//
+// Each direction of a tunnel has its own sequence of packet numbers, starting
+// from zero. Receiver uses ReplayWindow to reject packets which were already
+// seen or are too old.
 type Packet struct {
 	Data []byte
 
+	// Sequence number of the packet in its tunnel direction.
+	//
+	// Must be assigned by sender right before encoding, packets
+	// must be sent in order of their sequence numbers.
+	Seq uint64
+
 	// Connection id.
 	CID ConnID
 
+	// Target size of packet data together with its padding. InitEncode
+	// appends junk bytes to data (after compression) so that it reaches
+	// this size. Zero means no padding. Must be set before InitEncode.
+	Size int
+
+	// Packet data is a single datagram of udp stream, thus it must not
+	// be split by shaper. Not encoded, only sender uses it.
+	Datagram bool
+
+	// Data packet may be compressed during InitEncode. Sender sets it
+	// only if compression was negotiated (see CapCompress). Data is
+	// compressed only if it benefits from that.
+	Compress bool
+
+	// packet data was compressed by InitEncode
+	compressed bool
+
+	// Data was obtained with GetBuffer. Writer returns it to pool
+	// after packet is written (see Shaper.Shape).
+	Pooled bool
+
+	// room for encoding small control payloads (close, ping)
+	// without separate allocation
+	scratch [32]byte
+
+	// padding with its length, generated by InitEncode
+	pad []byte
+
 	// junk padding at packet start
 	//
 	// we use at most 8 + 8 + 3 bytes of this array
@@ -159,17 +215,36 @@ type Packet struct {
 	// Should be randomized for each packet and be calculatable
 	// from packet wrapper in wire.
 	//
-	// Usually we use auth token issued by server when tunnel
-	// is established + websocket mask.
+	// Usually we use per-tunnel salt derived during handshake
+	// mixed with websocket mask (see Key.Salt).
 	salt uint32
 
 	// Control sum stored in packet.
 	csum uint32
 
+	// Optional key for sealing inner part of the packet.
+	key *Key
+
+	// Random nonce for sealing inner part of the packet. Sequence
+	// number is sealed together with packet data instead of being
+	// placed into nonce, since plain counter on wire is easy to spot.
+	nonce [nonceSize]byte
+
+	// Associated data for sealing. Kept in packet, because
+	// passing local array to AEAD makes it escape, while
+	// outgoing packets are allocated anyway.
+	ad [20]byte
+
+	// Optional window for rejecting replayed packets during decoding.
+	window *ReplayWindow
+
 	Type PacketType
 
-	// Should be chosen at random.
-	style Style
+	// Random value for picking style from style set.
+	pick uint8
+
+	// Styles allowed for encoding and decoding, zero means DefaultStyles.
+	styles StyleSet
 
 	// Equals true after generating junk for various fields.
 	//
@@ -183,9 +258,10 @@ type Packet struct {
 func (p *Packet) InitEncode(g *rand.ChaCha8, salt uint32) {
 	putTextJunk(g, p.junk1[:])
 	putTextJunk(g, p.junk2[:])
+	putJunk(g, p.nonce[:])
 
 	v := g.Uint64() // random integer for style and type
-	p.style = Style(v & 1)
+	p.pick = uint8(v)
 
 	if p.Type.IsJunk() {
 		// We want to randomize encoded junk type in range [4 - 15],
@@ -208,36 +284,184 @@ func (p *Packet) InitEncode(g *rand.ChaCha8, salt uint32) {
 		}
 	}
 
+	p.compressed = false
+	if p.Compress && p.Type == PacketData {
+		data := compress(p.Data)
+		if data != nil {
+			p.Data = data
+			p.compressed = true
+		}
+	}
+
+	p.pad = nil
+	// padding is derived from final data length and accounts 2 bytes
+	// of its own length, padded data must still fit into MaxPayloadSize
+	if n := min(p.Size, MaxPayloadSize) - len(p.Data) - 2; n > 0 {
+		p.pad = make([]byte, n+2)
+		putJunk(g, p.pad[:n])
+		p.pad[n] = byte(n)
+		p.pad[n+1] = byte(n >> 8)
+	}
+
 	p.salt = salt
 	p.ok = true
 }
 
+// MaxPayloadSize is maximum size of packet data together with its padding.
+// Larger writes are split into several packets (see Shaper.Shape) and
+// decoding rejects packets which exceed it.
+const MaxPayloadSize = 1 << 14
+
+// MaxPadding is maximum number of junk bytes in packet padding.
+const MaxPadding = MaxPayloadSize - 2
+
+// Upper bound of inner part size for packet with MaxPayloadSize data.
+// Generously covers junk, header, nonce, tag and control sum.
+const maxInnerSize = MaxPayloadSize + 128
+
+// MaxFrameSize is maximum size of encoded packet. Style with list
+// of numbers is the largest, it takes up to 4 bytes per byte
+// of inner part.
+const MaxFrameSize = 4*maxInnerSize + 2
+
+// Marks packet with padding in type byte.
+const padFlag = 0x80
+
+// Returns type byte of encoded packet.
+func (p *Packet) typeByte() uint8 {
+	typ := uint8(p.Type) | (p.junk1[20] & 0x30)
+	if len(p.pad) != 0 {
+		typ |= padFlag
+	}
+	if p.compressed {
+		typ |= compressFlag
+	}
+	return typ
+}
+
+// Restores packet data from its encoded form according to type byte flags.
+func unpack(tb uint8, data []byte) ([]byte, error) {
+	if len(data) > MaxPayloadSize {
+		return nil, ErrPacketSize
+	}
+
+	var err error
+	if tb&padFlag != 0 {
+		data, err = unpad(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if tb&compressFlag != 0 {
+		data, err = decompress(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+var ErrPadding = errors.New("bad padding")
+
+// Removes padding from decoded packet data.
+func unpad(data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, ErrPadding
+	}
+	n := int(data[len(data)-2]) | int(data[len(data)-1])<<8
+	if n+2 > len(data) {
+		return nil, ErrPadding
+	}
+	return data[:len(data)-2-n], nil
+}
+
 // InitDecode initializes packet fields before it can be used for decoding.
 func (p *Packet) InitDecode(salt uint32) {
 	p.salt = salt
 	p.ok = true
 }
 
+// UseWindow sets replay window which will be checked (and updated)
+// when packet is decoded. Nil window disables the check.
+func (p *Packet) UseWindow(w *ReplayWindow) {
+	p.window = w
+}
+
+// UseStyles sets styles which can be picked for encoding the packet
+// or accepted during decoding. Zero set means DefaultStyles.
+func (p *Packet) UseStyles(s StyleSet) {
+	p.styles = s
+}
+
+// UseKey sets key for sealing or opening packet. Nil key means
+// packet will be encoded or decoded without encryption.
+func (p *Packet) UseKey(k *Key) {
+	p.key = k
+}
+
 func (p *Packet) PutHelloTCP(g *rand.ChaCha8, salt uint32, cid ConnID, ap netip.AddrPort) {
 	var h Hello
 	h.InitEncode(g, NetworkTCP, ap)
 
 	p.CID = cid
-	p.Data = EncodeHello(&h, nil)
+	p.Data = EncodeHello(&h, p.scratch[:0])
+	p.Type = PacketHello
+
+	p.InitEncode(g, salt)
+}
+
+func (p *Packet) PutHelloName(g *rand.ChaCha8, salt uint32, cid ConnID, network uint8, name string, port uint16) {
+	var h Hello
+	h.InitEncodeName(g, network, name, port)
+
+	p.CID = cid
+	p.Data = EncodeHello(&h, p.scratch[:0])
 	p.Type = PacketHello
 
 	p.InitEncode(g, salt)
 }
 
 func (p *Packet) PutClose(g *rand.ChaCha8, salt uint32, cid ConnID, cc CloseCode) {
+	p.setClose(g, cid, cc)
+	p.InitEncode(g, salt)
+}
+
+func (p *Packet) PutPing(g *rand.ChaCha8, salt uint32, cid ConnID, kind PingKind, value uint64) {
+	p.setPing(g, cid, kind, value)
+	p.InitEncode(g, salt)
+}
+
+// NewClosePacket creates close packet for specified connection. Packet
+// is ready to be queued for writer, which calls InitEncode on its own.
+func NewClosePacket(g *rand.ChaCha8, cid ConnID, cc CloseCode) *Packet {
+	var p Packet
+	p.setClose(g, cid, cc)
+	return &p
+}
+
+// NewPingPacket same as NewClosePacket, but creates ping packet.
+func NewPingPacket(g *rand.ChaCha8, cid ConnID, kind PingKind, value uint64) *Packet {
+	var p Packet
+	p.setPing(g, cid, kind, value)
+	return &p
+}
+
+func (p *Packet) setClose(g *rand.ChaCha8, cid ConnID, cc CloseCode) {
 	var s Close
 	s.InitEncode(g, cc)
 
 	p.CID = cid
-	p.Data = EncodeClose(&s, nil)
+	p.Data = EncodeClose(&s, p.scratch[:0])
 	p.Type = PacketClose
+}
 
-	p.InitEncode(g, salt)
+func (p *Packet) setPing(g *rand.ChaCha8, cid ConnID, kind PingKind, value uint64) {
+	var s Ping
+	s.InitEncode(g, kind, value)
+
+	p.CID = cid
+	p.Data = EncodePing(&s, p.scratch[:0])
+	p.Type = PacketPing
 }
 
 func (p *Packet) PutData(g *rand.ChaCha8, salt uint32, cid ConnID, data []byte) {
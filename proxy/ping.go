@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+)
+
+type PingKind uint8
+
+const (
+	// Grants more credit to the peer for sending data over connection
+	// specified by packet cid. Value is number of bytes which peer is
+	// allowed to send in addition to previously granted ones.
+	PingWindow PingKind = iota
+
+	// Keepalive ping sent with TunnelID cid. Value is a random nonce,
+	// which the peer must echo back in PingReply.
+	PingRequest
+
+	// Reply to PingRequest, carries the same nonce.
+	PingReply
+)
+
+var pingKindText = [...]string{
+	PingWindow:  "window",
+	PingRequest: "request",
+	PingReply:   "reply",
+}
+
+func (k PingKind) String() string {
+	if int(k) >= len(pingKindText) {
+		return fmt.Sprintf("kind=%d", uint8(k))
+	}
+	return pingKindText[k]
+}
+
+// Ping is carried inside ping packets.
+type Ping struct {
+	Value uint64
+
+	junk [9]byte
+
+	Kind PingKind
+
+	ok bool
+}
+
+func (p *Ping) InitEncode(g *rand.ChaCha8, kind PingKind, value uint64) {
+	putJunk(g, p.junk[:])
+	p.Kind = kind
+	p.Value = value
+	p.ok = true
+}
+
+func EncodePing(p *Ping, buf []byte) []byte {
+	if !p.ok {
+		panic("no init")
+	}
+
+	c := encoder{buf: buf}
+	return c.ping(p)
+}
+
+func (c *encoder) ping(p *Ping) []byte {
+	c.buf = slices.Grow(c.buf, 1+16)
+
+	var v [8]byte
+	binary.LittleEndian.PutUint64(v[:], p.Value)
+
+	c.putb((p.junk[8] & 0xF0) | uint8(p.Kind))
+	for i := range 8 {
+		c.putb(v[i])
+		c.putb(p.junk[i])
+	}
+	return c.buf
+}
+
+func DecodePing(p *Ping, data []byte) error {
+	d := decoder{buf: data}
+	return d.ping(p)
+}
+
+var (
+	ErrBadPingSize = errors.New("bad ping size")
+	ErrPingKind    = errors.New("bad ping kind")
+)
+
+func (d *decoder) ping(p *Ping) error {
+	if d.len() != 1+16 {
+		return ErrBadPingSize
+	}
+
+	kind := PingKind(d.u8() & 0x0F)
+	switch kind {
+	case PingWindow, PingRequest, PingReply:
+		// continue execution
+	default:
+		return ErrPingKind
+	}
+
+	b := d.bytes(16)
+	var v [8]byte
+	for i := range 8 {
+		v[i] = b[2*i]
+	}
+
+	p.Kind = kind
+	p.Value = binary.LittleEndian.Uint64(v[:])
+	return nil
+}
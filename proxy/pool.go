@@ -0,0 +1,69 @@
+package proxy
+
+import "sync"
+
+// BufferSize is capacity of the largest pooled buffers for packet data.
+// Data chunks are never larger than that on hot paths, thus each chunk
+// fits into a single pooled buffer.
+const BufferSize = 1 << 16
+
+// Buffers are pooled in size classes, each next class is 4 times larger.
+// Chunk waits in receive queue for reader, which may be slow, and flow
+// control accounts only chunk length. Thus buffer must not be much larger
+// than chunk, otherwise many small chunks would pin a lot of memory.
+const (
+	smallBufferSize  = 1 << 11
+	mediumBufferSize = 1 << 14
+)
+
+// Chunks up to this size are allocated exactly instead of pooling.
+const minPooledSize = 1 << 9
+
+var (
+	smallBuffers = sync.Pool{
+		New: func() any {
+			return new([smallBufferSize]byte)
+		},
+	}
+	mediumBuffers = sync.Pool{
+		New: func() any {
+			return new([mediumBufferSize]byte)
+		},
+	}
+	largeBuffers = sync.Pool{
+		New: func() any {
+			return new([BufferSize]byte)
+		},
+	}
+)
+
+// GetBuffer returns buffer of length n for packet data. Buffer is taken
+// from pool of the smallest size class which fits n. Tiny and oversized
+// buffers are allocated without pool.
+func GetBuffer(n int) []byte {
+	switch {
+	case n <= minPooledSize:
+		return make([]byte, n)
+	case n <= smallBufferSize:
+		return smallBuffers.Get().(*[smallBufferSize]byte)[:n]
+	case n <= mediumBufferSize:
+		return mediumBuffers.Get().(*[mediumBufferSize]byte)[:n]
+	case n <= BufferSize:
+		return largeBuffers.Get().(*[BufferSize]byte)[:n]
+	default:
+		return make([]byte, n)
+	}
+}
+
+// PutBuffer returns buffer obtained from GetBuffer to pool. Buffer must
+// not be used after that. Buffers which did not come from pool are ignored.
+func PutBuffer(b []byte) {
+	switch cap(b) {
+	case smallBufferSize:
+		smallBuffers.Put((*[smallBufferSize]byte)(b[:smallBufferSize]))
+	case mediumBufferSize:
+		mediumBuffers.Put((*[mediumBufferSize]byte)(b[:mediumBufferSize]))
+	case BufferSize:
+		largeBuffers.Put((*[BufferSize]byte)(b[:BufferSize]))
+	}
+}
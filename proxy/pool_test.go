@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	tests := []struct {
+		size int
+		cap  int
+	}{
+		{size: 1, cap: 1},
+		{size: minPooledSize, cap: minPooledSize},
+		{size: minPooledSize + 1, cap: smallBufferSize},
+		{size: smallBufferSize, cap: smallBufferSize},
+		{size: MaxPayloadSize, cap: mediumBufferSize},
+		{size: mediumBufferSize + 1, cap: BufferSize},
+		{size: BufferSize, cap: BufferSize},
+	}
+	for _, tt := range tests {
+		b := GetBuffer(tt.size)
+		if len(b) != tt.size || cap(b) != tt.cap {
+			t.Errorf("GetBuffer(%d) len = %d, cap = %d, want cap %d", tt.size, len(b), cap(b), tt.cap)
+		}
+		// buffer which fits chunk never pins more than 4 times its size
+		if tt.size > minPooledSize && cap(b) > 4*tt.size {
+			t.Errorf("GetBuffer(%d) cap = %d is too large", tt.size, cap(b))
+		}
+		PutBuffer(b)
+	}
+
+	b := GetBuffer(BufferSize + 1)
+	if len(b) != BufferSize+1 {
+		t.Fatalf("GetBuffer() large len = %d", len(b))
+	}
+	// must not panic on buffers which did not come from pool
+	PutBuffer(b)
+	PutBuffer(make([]byte, 10))
+}
+
+// Encodes and decodes 16 KiB data packets with all styles, reusing buffers
+// the same way tunnel does.
+func benchmarkPacket(b *testing.B, decode bool) {
+	up, _, err := DeriveKeys([]byte("secret"), []byte("nonce"))
+	if err != nil {
+		b.Fatalf("DeriveKeys() error = %v", err)
+	}
+
+	g := rand.NewChaCha8([32]byte{7})
+	data := make([]byte, 1<<14)
+	putJunk(g, data)
+	cid := NewConnID(g)
+
+	for style := range numStyles {
+		b.Run(fmt.Sprintf("style=%s", style), func(b *testing.B) {
+			var seq uint64
+			buf := make([]byte, 0, ReadBufferSize)
+
+			// outgoing packets are allocated by streams
+			p := new(Packet)
+			encode := func() []byte {
+				*p = Packet{
+					Data: data,
+					Type: PacketData,
+					CID:  cid,
+					Seq:  seq,
+				}
+				seq += 1
+				p.UseStyles(1 << style)
+				p.InitEncode(g, 0x1234)
+				p.UseKey(up)
+				buf = Encode(p, buf[:0])
+				return buf
+			}
+
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			if !decode {
+				for b.Loop() {
+					encode()
+				}
+				return
+			}
+
+			var w ReplayWindow
+			frame := make([]byte, 0, ReadBufferSize)
+			for b.Loop() {
+				b.StopTimer()
+				frame = append(frame[:0], encode()...)
+				b.StartTimer()
+
+				var p Packet
+				p.InitDecode(0x1234)
+				p.UseKey(up)
+				p.UseStyles(AllStyles)
+				p.UseWindow(&w)
+				err := Decode(&p, frame)
+				if err != nil {
+					b.Fatalf("Decode() error = %v", err)
+				}
+				if !bytes.Equal(p.Data, data) {
+					b.Fatal("Decode() data mismatch")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncodePacket(b *testing.B) {
+	benchmarkPacket(b, false)
+}
+
+func BenchmarkDecodePacket(b *testing.B) {
+	benchmarkPacket(b, true)
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import "errors"
+
+var ErrPacketReplay = errors.New("replayed packet")
+
+// ReplayWindow keeps track of sequence numbers of packets received
+// in one direction of a tunnel. Packets with sequence numbers which
+// were already seen or fall behind the window are rejected.
+//
+// Zero value is ready to use. Not safe for concurrent use.
+type ReplayWindow struct {
+	// Highest sequence number accepted so far.
+	top uint64
+
+	// Bit i is set if packet with sequence number (top - i)
+	// was accepted.
+	bits uint64
+
+	// Equals true after first accepted packet.
+	init bool
+}
+
+// Number of sequence numbers tracked by window.
+const replayWindowSize = 64
+
+// Check reports ErrPacketReplay if packet with given sequence number
+// must be rejected. Otherwise sequence number is marked as seen.
+func (w *ReplayWindow) Check(seq uint64) error {
+	if !w.init {
+		w.top = seq
+		w.bits = 1
+		w.init = true
+		return nil
+	}
+
+	if seq > w.top {
+		shift := seq - w.top
+		if shift >= replayWindowSize {
+			w.bits = 1
+		} else {
+			w.bits = (w.bits << shift) | 1
+		}
+		w.top = seq
+		return nil
+	}
+
+	back := w.top - seq
+	if back >= replayWindowSize {
+		return ErrPacketReplay
+	}
+	bit := uint64(1) << back
+	if w.bits&bit != 0 {
+		return ErrPacketReplay
+	}
+	w.bits |= bit
+	return nil
+}
+
+// Number of sequence number bits carried by packets encoded without a key.
+const shortSeqBits = 24
+
+// Restores full sequence number from its low bits, assuming that it is
+// the closest one to the highest sequence number seen by window.
+func (w *ReplayWindow) expand(short uint32) uint64 {
+	const size = 1 << shortSeqBits
+	const half = size >> 1
+	const mask = size - 1
+
+	if !w.init {
+		return uint64(short)
+	}
+
+	top := w.top
+	seq := (top &^ mask) | uint64(short&mask)
+	if seq > top+half && seq >= size {
+		seq -= size
+	} else if seq+half < top {
+		seq += size
+	}
+	return seq
+}
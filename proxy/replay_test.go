@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"errors"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// sequence numbers of received packets
+		seqs []uint64
+
+		// which packets must be rejected
+		bad []bool
+	}{
+		{
+			name: "1 in order",
+			seqs: []uint64{0, 1, 2, 3, 4},
+			bad:  []bool{false, false, false, false, false},
+		},
+		{
+			name: "2 duplicate",
+			seqs: []uint64{0, 1, 1, 2, 0},
+			bad:  []bool{false, false, true, false, true},
+		},
+		{
+			name: "3 reordered",
+			seqs: []uint64{0, 3, 1, 2, 3},
+			bad:  []bool{false, false, false, false, true},
+		},
+		{
+			name: "4 too old",
+			seqs: []uint64{0, 100, 37, 38, 36},
+			bad:  []bool{false, false, false, false, true},
+		},
+		{
+			name: "5 jump ahead",
+			seqs: []uint64{5, 1000, 999, 1000, 5},
+			bad:  []bool{false, false, false, true, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w ReplayWindow
+			for i, seq := range tt.seqs {
+				err := w.Check(seq)
+				if (err != nil) != tt.bad[i] {
+					t.Errorf("Check(%d) error = %v, want bad = %v", seq, err, tt.bad[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReplayWindowExpand(t *testing.T) {
+	tests := []struct {
+		top   uint64
+		short uint32
+		want  uint64
+	}{
+		{top: 0, short: 1, want: 1},
+		{top: 0xFFFFFF, short: 0, want: 0x1000000},
+		{top: 0x1000002, short: 0xFFFFFE, want: 0xFFFFFE},
+		{top: 0x3ABCDEF, short: 0xABCDF0, want: 0x3ABCDF0},
+		{top: 10, short: 0xFFFFFF, want: 0xFFFFFF},
+	}
+
+	for _, tt := range tests {
+		w := ReplayWindow{top: tt.top, bits: 1, init: true}
+		got := w.expand(tt.short)
+		if got != tt.want {
+			t.Errorf("expand(%X) with top %X = %X, want %X", tt.short, tt.top, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeReplayedPacket(t *testing.T) {
+	up, _, err := DeriveKeys([]byte("secret"), []byte("nonce"))
+	if err != nil {
+		t.Fatalf("DeriveKeys() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		key  *Key
+	}{
+		{
+			name: "1 plain",
+			key:  nil,
+		},
+		{
+			name: "2 sealed",
+			key:  up,
+		},
+	}
+
+	g := rand.NewChaCha8([32]byte{0, 1, 2, 3})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const salt = 0x4A7BAAE0
+
+			var encoded [][]byte
+			for seq := range uint64(3) {
+				packet := Packet{
+					Data: []byte("hello"),
+					Type: PacketData,
+					CID:  NewConnID(g),
+				}
+				packet.InitEncode(g, salt)
+				packet.UseKey(tt.key)
+				packet.Seq = seq
+				encoded = append(encoded, Encode(&packet, nil))
+			}
+
+			var w ReplayWindow
+			decode := func(data []byte) (uint64, error) {
+				var p Packet
+				p.InitDecode(salt)
+				p.UseKey(tt.key)
+				p.UseWindow(&w)
+				err := Decode(&p, append([]byte(nil), data...))
+				return p.Seq, err
+			}
+
+			for i, data := range encoded {
+				seq, err := decode(data)
+				if err != nil {
+					t.Fatalf("Decode() error = %v", err)
+				}
+				if seq != uint64(i) {
+					t.Errorf("Decode() seq = %d, want %d", seq, i)
+				}
+			}
+
+			_, err := decode(encoded[1])
+			if !errors.Is(err, ErrPacketReplay) {
+				t.Errorf("Decode() replayed packet error = %v, want %v", err, ErrPacketReplay)
+			}
+		})
+	}
+}
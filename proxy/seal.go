@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+// Key holds AEAD cipher for packets sent in one direction of a tunnel.
+//
+// Packets which are encoded or decoded with a key have their inner
+// part (except text junk at start and end) sealed with AES-256-GCM.
+// Such packets do not carry control sum, since authentication tag
+// of AEAD makes it redundant.
+type Key struct {
+	aead cipher.AEAD
+
+	// Base salt for packets encoded with this key.
+	salt uint32
+
+	// key is created from this, kept for capture (see Capture)
+	material [keyMaterialSize]byte
+}
+
+const (
+	keySize   = 32
+	nonceSize = 12
+	tagSize   = 16
+
+	// AES key followed by base salt
+	keyMaterialSize = keySize + 4
+)
+
+// DeriveKeys derives a pair of packet keys from shared secret and per-tunnel
+// handshake nonce. Key up is used for packets sent from client to server
+// and key down for packets sent from server to client.
+func DeriveKeys(secret []byte, nonce []byte) (up *Key, down *Key, err error) {
+	if len(secret) == 0 {
+		return nil, nil, errors.New("empty secret")
+	}
+	if len(nonce) == 0 {
+		return nil, nil, errors.New("empty nonce")
+	}
+
+	prk, err := hkdf.Extract(sha256.New, secret, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	up, err = newKey(prk, "higs up")
+	if err != nil {
+		return nil, nil, err
+	}
+	down, err = newKey(prk, "higs down")
+	if err != nil {
+		return nil, nil, err
+	}
+	return up, down, nil
+}
+
+func newKey(prk []byte, info string) (*Key, error) {
+	b, err := hkdf.Expand(sha256.New, prk, info, keyMaterialSize)
+	if err != nil {
+		return nil, err
+	}
+	return keyFromMaterial([keyMaterialSize]byte(b))
+}
+
+func keyFromMaterial(m [keyMaterialSize]byte) (*Key, error) {
+	block, err := aes.NewCipher(m[:keySize])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{
+		aead:     aead,
+		salt:     binary.LittleEndian.Uint32(m[keySize:]),
+		material: m,
+	}, nil
+}
+
+// Salt returns packet salt for frame with the given websocket mask.
+// Frames without mask should use zero mask.
+func (k *Key) Salt(mask [4]byte) uint32 {
+	return k.salt ^ binary.LittleEndian.Uint32(mask[:])
+}
+
+var ErrPacketAuth = errors.New("authentication failed")
+
+// Minimal length of inner part of packet encoded with a key.
+const minSealedInnerLength = 8 + 1 + // prefix junk
+	nonceSize +
+	3 + 1 + // reserved junk + type
+	16 + // cid
+	8 + // sequence number
+	0 + // packet data
+	tagSize +
+	8 + 1 // suffix junk
+
+// Fills additional authenticated data for sealing packet inner part
+// and returns used portion of the buffer.
+//
+// Salt and prefix tjunk are authenticated, since the latter determines
+// layout of the whole packet.
+func putSealAD(buf *[20]byte, salt uint32, prefix []byte) []byte {
+	binary.LittleEndian.PutUint32(buf[:4], salt)
+	n := copy(buf[4:], prefix)
+	return buf[:4+n]
+}
+
+func (c *encoder) sealedPacket(p *Packet) []byte {
+	c.buf = slices.Grow(c.buf,
+		2+ // style prefix
+			8+ // fixed start tjunk
+			8+ // at most 8 bytes of varlen tjunk
+			nonceSize+
+			3+ // reserved junk
+			1+ // packet type
+			16+ // connection id
+			8+ // sequence number
+			len(p.Data)+
+			len(p.pad)+
+			tagSize+
+			8+ // at most 8 bytes of varlen tjunk
+			8+ // fixed end tjunk
+			2+ // style suffix
+			0)
+
+	var hasher Hasher
+	hasher.reset(p.salt)
+	hasher.put(p.junk1[:8])
+	h := hasher.val
+
+	len1 := 1 + (h & 0b111)
+	len2 := 1 + ((h >> 3) & 0b111)
+
+	typ := p.typeByte()
+
+	nonce := p.nonce[:]
+
+	style := p.styles.pick(p.pick)
+	mark := c.start(style)
+	c.put(p.junk1[:8+len1])
+	c.put(nonce)
+
+	start := len(c.buf)
+	c.put(p.junk1[8+len1 : 8+len1+3])
+	c.putb(typ)
+	c.put(p.CID[:])
+	c.buf = binary.LittleEndian.AppendUint64(c.buf, p.Seq)
+	c.put(p.Data)
+	c.put(p.pad)
+	c.buf = p.key.aead.Seal(c.buf[:start], nonce, c.buf[start:],
+		putSealAD(&p.ad, p.salt, p.junk1[:8+len1]))
+
+	c.put(p.junk2[:8+len2])
+	c.end(style, mark)
+
+	return c.buf
+}
+
+// Decodes packet encoded with a key. Decoding is done in place, thus
+// supplied data is modified and resulting packet data points into it.
+func (d *decoder) sealedPacket(p *Packet) error {
+	if d.len() < minSealedInnerLength {
+		return ErrPacketSize
+	}
+
+	prefix := d.bytes(8)
+
+	var hasher Hasher
+	hasher.reset(p.salt)
+	hasher.put(prefix)
+	h := hasher.val
+
+	len1 := 1 + (h & 0b111)
+	len2 := 1 + ((h >> 3) & 0b111)
+
+	d.skip(int(len1))
+	prefix = d.buf[d.pos-8-int(len1) : d.pos]
+	nonce := d.bytes(nonceSize)
+
+	// length of sealed part
+	slen := d.len() -
+		int(len2) - // varlen tjunk suffix
+		8 // fixed tjunk suffix
+	if slen < 3+1+16+8+tagSize {
+		return ErrPacketSize
+	}
+	sealed := d.bytes(slen)
+
+	var ad [20]byte
+	b, err := p.key.aead.Open(sealed[:0], nonce, sealed, putSealAD(&ad, p.salt, prefix))
+	if err != nil {
+		return ErrPacketAuth
+	}
+
+	// sequence number is sealed, thus AEAD authenticates it
+	seq := binary.LittleEndian.Uint64(b[20:28])
+	if p.window != nil {
+		err = p.window.Check(seq)
+		if err != nil {
+			return err
+		}
+	}
+
+	typ := PacketType(b[3] & 0b1111)
+	if typ.IsJunk() {
+		typ = PacketJunk
+	}
+	data, err := unpack(b[3], b[28:])
+	if err != nil {
+		return err
+	}
+
+	var cid ConnID
+	copy(cid[:], b[4:20])
+
+	p.Seq = seq
+	p.Data = data
+	p.CID = cid
+	p.Type = typ
+	return nil
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+func TestDecodeSealedPacket(t *testing.T) {
+	tests := []struct {
+		name string
+
+		data string
+		typ  PacketType
+	}{
+		{
+			name: "1 hello",
+			data: "",
+			typ:  PacketHello,
+		},
+		{
+			name: "2 junk",
+			data: "",
+			typ:  PacketJunk,
+		},
+		{
+			name: "3 empty",
+			data: "",
+			typ:  PacketData,
+		},
+		{
+			name: "4 data",
+			data: "hello",
+			typ:  PacketData,
+		},
+		{
+			name: "5 large data",
+			data: strings.Repeat("++ hello !", 237),
+			typ:  PacketData,
+		},
+	}
+
+	up, _, err := DeriveKeys([]byte("secret"), []byte("nonce"))
+	if err != nil {
+		t.Fatalf("DeriveKeys() error = %v", err)
+	}
+
+	g := rand.NewChaCha8([32]byte{0, 1, 2, 3})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := Packet{
+				Data: []byte(tt.data),
+				Type: tt.typ,
+				CID:  NewConnID(g),
+			}
+
+			salt := up.Salt([4]byte{0xAC, 0x13, 0xE9, 0x06})
+			packet.InitEncode(g, salt)
+			packet.UseKey(up)
+
+			var buf [32]byte
+			data := Encode(&packet, buf[:0])
+
+			var got Packet
+			got.InitDecode(salt)
+			got.UseKey(up)
+			err := Decode(&got, data)
+			if err != nil {
+				t.Errorf("Decode() error = %v", err)
+				return
+			}
+
+			err = comparePackets(&got, &packet)
+			if err != nil {
+				t.Errorf("compare packets: %v", err)
+				logPacket(t, "got", &got)
+				logPacket(t, "want", &packet)
+			}
+		})
+	}
+}
+
+func TestDecodeSealedPacketTampered(t *testing.T) {
+	up, down, err := DeriveKeys([]byte("secret"), []byte("nonce"))
+	if err != nil {
+		t.Fatalf("DeriveKeys() error = %v", err)
+	}
+
+	g := rand.NewChaCha8([32]byte{0, 1, 2, 3})
+	encode := func() []byte {
+		packet := Packet{
+			Data: []byte(strings.Repeat("hello", 20)),
+			Type: PacketData,
+			CID:  NewConnID(g),
+		}
+		packet.InitEncode(g, up.Salt([4]byte{}))
+		packet.UseKey(up)
+		return Encode(&packet, nil)
+	}
+
+	tests := []struct {
+		name string
+
+		key    *Key
+		salt   uint32
+		tamper func(data []byte)
+	}{
+		{
+			name:   "1 flip data byte",
+			key:    up,
+			salt:   up.Salt([4]byte{}),
+			tamper: func(data []byte) { data[len(data)/2] ^= 0x01 },
+		},
+		{
+			name:   "2 flip tag byte",
+			key:    up,
+			salt:   up.Salt([4]byte{}),
+			tamper: func(data []byte) { data[len(data)-20] ^= 0x80 },
+		},
+		{
+			name:   "3 wrong key",
+			key:    down,
+			salt:   up.Salt([4]byte{}),
+			tamper: func(data []byte) {},
+		},
+		{
+			name:   "4 wrong salt",
+			key:    up,
+			salt:   up.Salt([4]byte{1}),
+			tamper: func(data []byte) {},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encode()
+			tt.tamper(data)
+
+			var got Packet
+			got.InitDecode(tt.salt)
+			got.UseKey(tt.key)
+			err := Decode(&got, data)
+			if !errors.Is(err, ErrPacketAuth) {
+				t.Errorf("Decode() error = %v, want %v", err, ErrPacketAuth)
+			}
+		})
+	}
+}
+
+func TestSealedPacketSeq(t *testing.T) {
+	up, _, err := DeriveKeys([]byte("secret"), []byte("nonce"))
+	if err != nil {
+		t.Fatalf("DeriveKeys() error = %v", err)
+	}
+
+	const seq = 0x0102030405060708
+	var raw [8]byte
+	binary.LittleEndian.PutUint64(raw[:], seq)
+
+	g := rand.NewChaCha8([32]byte{7})
+	packet := Packet{
+		Data: []byte("hello"),
+		Type: PacketData,
+		CID:  NewConnID(g),
+		Seq:  seq,
+	}
+	packet.UseStyles(1 << Style0)
+	packet.InitEncode(g, 0x1234)
+	packet.UseKey(up)
+	data := Encode(&packet, nil)
+
+	// sequence number must not be visible on wire
+	if bytes.Contains(data, raw[:]) || bytes.Contains(data, raw[:4]) {
+		t.Errorf("Encode() exposes sequence number: %x", data)
+	}
+
+	var got Packet
+	got.InitDecode(0x1234)
+	got.UseKey(up)
+	err = Decode(&got, data)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if got.Seq != seq {
+		t.Errorf("Decode() seq = %#x, want %#x", got.Seq, uint64(seq))
+	}
+}
@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// SizeRange is a range of packet data sizes picked with given weight.
+type SizeRange struct {
+	Min    int
+	Max    int
+	Weight int
+}
+
+// Profile describes traffic shape which tunnel mimics to avoid looking
+// like a bulk proxy. Data packets are split and padded toward sizes from
+// profile distribution, junk packets are sent while tunnel is idle and
+// writes are delayed by random jitter.
+type Profile struct {
+	Name string
+
+	// Distribution of packet data sizes. Empty distribution means that
+	// data packets are sent as is.
+	Sizes []SizeRange
+
+	// Junk packet is sent after tunnel was idle for random duration
+	// in range [IdleMin, IdleMax]. Zero IdleMax disables junk packets.
+	IdleMin time.Duration
+	IdleMax time.Duration
+
+	// Maximum random delay before writing queued packets.
+	MaxDelay time.Duration
+}
+
+var (
+	// Sends packets as is.
+	ProfileNone = Profile{Name: "none"}
+
+	// Mimics browser chat over websocket: mostly small messages with
+	// occasional larger ones, rare keepalive-like messages when idle.
+	ProfileChat = Profile{
+		Name: "chat",
+		Sizes: []SizeRange{
+			{Min: 40, Max: 200, Weight: 6},
+			{Min: 200, Max: 1200, Weight: 3},
+			{Min: 1200, Max: 4000, Weight: 1},
+		},
+		IdleMin:  5 * time.Second,
+		IdleMax:  25 * time.Second,
+		MaxDelay: 20 * time.Millisecond,
+	}
+
+	// Mimics video stream over websocket: large chunks sent steadily,
+	// small control messages in between.
+	ProfileVideo = Profile{
+		Name: "video",
+		Sizes: []SizeRange{
+			{Min: 100, Max: 300, Weight: 1},
+			{Min: 8000, Max: 16000, Weight: 5},
+		},
+		IdleMin:  200 * time.Millisecond,
+		IdleMax:  time.Second,
+		MaxDelay: 2 * time.Millisecond,
+	}
+)
+
+var profiles = []*Profile{&ProfileNone, &ProfileChat, &ProfileVideo}
+
+// LookupProfile returns shaping profile by its name. Empty name
+// means ProfileNone.
+func LookupProfile(name string) (*Profile, error) {
+	if name == "" {
+		return &ProfileNone, nil
+	}
+	for _, p := range profiles {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown shaping profile \"%s\"", name)
+}
+
+// Shaper applies profile to outgoing packets of a tunnel.
+//
+// Shaper is not safe for concurrent use, only tunnel writer uses it.
+type Shaper struct {
+	profile *Profile
+
+	g *rand.ChaCha8
+
+	// fires when tunnel is idle for too long, nil if junk packets
+	// are disabled in profile
+	timer *time.Timer
+
+	// sum of weights in profile size distribution
+	total int
+}
+
+// NewShaper creates shaper for the given profile. Nil profile means ProfileNone.
+func NewShaper(p *Profile, g *rand.ChaCha8) *Shaper {
+	if p == nil {
+		p = &ProfileNone
+	}
+	s := &Shaper{profile: p, g: g}
+	for _, r := range p.Sizes {
+		s.total += r.Weight
+	}
+	if p.IdleMax != 0 {
+		s.timer = time.NewTimer(s.Idle())
+	}
+	return s
+}
+
+// IdleC returns channel which receives a value when tunnel was idle for too
+// long and junk packet should be sent. Returns nil if junk packets are disabled.
+func (s *Shaper) IdleC() <-chan time.Time {
+	if s.timer == nil {
+		return nil
+	}
+	return s.timer.C
+}
+
+// Active marks that packet was just written, idle timer is restarted.
+func (s *Shaper) Active() {
+	if s.timer == nil {
+		return
+	}
+	s.timer.Reset(s.Idle())
+}
+
+// Stop releases idle timer.
+func (s *Shaper) Stop() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// Returns target size for next data packet. Zero means no target.
+func (s *Shaper) size() int {
+	if s.total == 0 {
+		return 0
+	}
+
+	w := s.g.Uint64() % uint64(s.total)
+	for _, r := range s.profile.Sizes {
+		if w < uint64(r.Weight) {
+			return min(MaxPayloadSize, r.Min+int(s.g.Uint64()%uint64(r.Max-r.Min+1)))
+		}
+		w -= uint64(r.Weight)
+	}
+	panic("unreachable")
+}
+
+// Shape splits data packet into several packets and sets their target sizes, so
+// that sizes follow profile distribution. Padding is added during encoding, after
+// packet data is compressed (see Packet.Size). Calls emit for each resulting packet
+// in order. Packets of other types are passed to emit as is. Datagram packets
+// are only padded.
+//
+// Without profile distribution only data larger than MaxPayloadSize is split,
+// into packets of random sizes.
+//
+// Pooled packet data is returned to pool after all packets are emitted,
+// thus emit must not retain packet data.
+func (s *Shaper) Shape(p *Packet, emit func(p *Packet) error) error {
+	if p.Pooled {
+		// encoding may replace packet data, thus original
+		// buffer is remembered
+		defer PutBuffer(p.Data)
+	}
+
+	if p.Type != PacketData {
+		return emit(p)
+	}
+	if p.Datagram {
+		// datagram boundaries must be preserved, thus it is never split,
+		// without profile distribution size is zero and it is not padded
+		p.Size = s.size()
+		return emit(p)
+	}
+	if s.total == 0 {
+		return s.split(p, emit)
+	}
+
+	data := p.Data
+	for {
+		size := s.size()
+		if len(data) <= size {
+			return emit(&Packet{
+				Data: data,
+				CID:  p.CID,
+				Type: PacketData,
+				Size: size,
+			})
+		}
+
+		// compressed data would be smaller than target, thus
+		// target size is set for split packets as well
+		err := emit(&Packet{
+			Data: data[:size],
+			CID:  p.CID,
+			Type: PacketData,
+			Size: size,
+		})
+		if err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+}
+
+// Splits data which does not fit into a single packet. Sizes of packets
+// are random, so that they do not mirror sizes of writes.
+func (s *Shaper) split(p *Packet, emit func(p *Packet) error) error {
+	data := p.Data
+	for len(data) > MaxPayloadSize {
+		size := MaxPayloadSize/2 + int(s.g.Uint64()%(MaxPayloadSize/2+1))
+		err := emit(&Packet{
+			Data: data[:size],
+			CID:  p.CID,
+			Type: PacketData,
+		})
+		if err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+
+	p.Data = data
+	return emit(p)
+}
+
+// Junk creates junk packet with data size picked from profile distribution.
+func (s *Shaper) Junk() *Packet {
+	var p Packet
+	p.CID = NewConnID(s.g)
+	p.Type = PacketJunk
+	if s.total != 0 {
+		p.Data = make([]byte, s.size())
+		putJunk(s.g, p.Data)
+	}
+	return &p
+}
+
+// Idle returns random duration of tunnel idleness after which junk packet
+// should be sent. Zero means that junk packets are disabled.
+func (s *Shaper) Idle() time.Duration {
+	return s.between(s.profile.IdleMin, s.profile.IdleMax)
+}
+
+// Delay returns random delay before writing next queued packets.
+func (s *Shaper) Delay() time.Duration {
+	return s.between(0, s.profile.MaxDelay)
+}
+
+func (s *Shaper) between(a, b time.Duration) time.Duration {
+	if b <= a {
+		return b
+	}
+	return a + time.Duration(s.g.Uint64()%uint64(b-a+1))
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDecodePaddedPacket(t *testing.T) {
+	tests := []struct {
+		data string
+		pad  int
+	}{
+		{data: "", pad: 1},
+		{data: "hi", pad: 1},
+		{data: "hello", pad: 100},
+		{data: "hello", pad: MaxPadding + 10},
+	}
+
+	up, _, err := DeriveKeys([]byte("secret"), []byte("nonce"))
+	if err != nil {
+		t.Fatalf("DeriveKeys() error = %v", err)
+	}
+
+	g := rand.NewChaCha8([32]byte{0, 1, 2, 3})
+	for _, key := range []*Key{nil, up} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("sealed=%t pad=%d", key != nil, tt.pad), func(t *testing.T) {
+				packet := Packet{
+					Data: []byte(tt.data),
+					Type: PacketData,
+					CID:  NewConnID(g),
+					Size: len(tt.data) + tt.pad + 2,
+				}
+				packet.InitEncode(g, 0x1234)
+				packet.UseKey(key)
+				encoded := Encode(&packet, nil)
+
+				if want := minPacketLength + min(len(tt.data)+tt.pad+2, MaxPayloadSize); len(encoded) < want {
+					t.Errorf("Encode() length = %d, want at least %d", len(encoded), want)
+				}
+
+				var got Packet
+				got.InitDecode(0x1234)
+				got.UseKey(key)
+				err := Decode(&got, encoded)
+				if err != nil {
+					t.Fatalf("Decode() error = %v", err)
+				}
+				if string(got.Data) != tt.data || got.Type != PacketData {
+					t.Errorf("Decode() data = %q, type = %s", got.Data, got.Type)
+				}
+			})
+		}
+	}
+}
+
+func TestShaperShape(t *testing.T) {
+	g := rand.NewChaCha8([32]byte{9})
+	sh := NewShaper(&ProfileChat, g)
+	defer sh.Stop()
+
+	want := bytes.Repeat([]byte("0123456789"), 2000)
+	cid := NewConnID(g)
+
+	var got []byte
+	var packets []*Packet
+	err := sh.Shape(&Packet{Data: want, CID: cid, Type: PacketData}, func(p *Packet) error {
+		packets = append(packets, p)
+		got = append(got, p.Data...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Shape() error = %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Shape() data mismatch")
+	}
+	if len(packets) < 2 {
+		t.Fatalf("Shape() produced %d packets", len(packets))
+	}
+	for i, p := range packets {
+		if p.CID != cid || p.Type != PacketData {
+			t.Errorf("packet %d: cid = %s, type = %s", i, p.CID, p.Type)
+		}
+		size := max(len(p.Data), p.Size)
+		if i+1 < len(packets) && (size < 40 || size > 4000) {
+			t.Errorf("packet %d: size %d is outside of profile distribution", i, size)
+		}
+	}
+
+	var datagram []*Packet
+	sh.Shape(&Packet{Data: want[:MaxDatagramSize], CID: cid, Type: PacketData, Datagram: true}, func(p *Packet) error {
+		datagram = append(datagram, p)
+		return nil
+	})
+	if len(datagram) != 1 || !bytes.Equal(datagram[0].Data, want[:MaxDatagramSize]) {
+		t.Errorf("Shape() split datagram into %d packets", len(datagram))
+	}
+
+	var none []*Packet
+	sh = NewShaper(nil, g)
+	sh.Shape(&Packet{Data: want[:MaxPayloadSize], Type: PacketData}, func(p *Packet) error {
+		none = append(none, p)
+		return nil
+	})
+	if len(none) != 1 || none[0].Size != 0 {
+		t.Errorf("Shape() without profile changed packet")
+	}
+}
+
+func TestShaperSplit(t *testing.T) {
+	g := rand.NewChaCha8([32]byte{10})
+	sh := NewShaper(nil, g)
+	defer sh.Stop()
+
+	want := make([]byte, 5*MaxPayloadSize+100)
+	putJunk(g, want)
+
+	var got []byte
+	sizes := make(map[int]bool)
+	err := sh.Shape(&Packet{Data: want, Type: PacketData}, func(p *Packet) error {
+		if len(p.Data) > MaxPayloadSize {
+			t.Errorf("Shape() packet size %d exceeds %d", len(p.Data), MaxPayloadSize)
+		}
+		sizes[len(p.Data)] = true
+		got = append(got, p.Data...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Shape() error = %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Shape() data mismatch")
+	}
+	if len(sizes) < 3 {
+		t.Errorf("Shape() produced only %d distinct packet sizes", len(sizes))
+	}
+}
+
+func TestShaperDatagramWithoutProfile(t *testing.T) {
+	g := rand.NewChaCha8([32]byte{11})
+	sh := NewShaper(nil, g)
+	defer sh.Stop()
+
+	// datagram is kept whole even if it is too large for a single packet,
+	// stream rejects such datagrams before they reach shaper
+	want := make([]byte, MaxPayloadSize+100)
+	putJunk(g, want)
+
+	var packets []*Packet
+	err := sh.Shape(&Packet{Data: want, Type: PacketData, Datagram: true}, func(p *Packet) error {
+		packets = append(packets, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Shape() error = %v", err)
+	}
+	if len(packets) != 1 || !bytes.Equal(packets[0].Data, want) || packets[0].Size != 0 {
+		t.Errorf("Shape() split or padded datagram into %d packets", len(packets))
+	}
+}
+
+func TestTunnelJunk(t *testing.T) {
+	tun, s := testConnectOptions(t, &Options{
+		Profile: &Profile{
+			Sizes:   []SizeRange{{Min: 10, Max: 20, Weight: 1}},
+			IdleMin: time.Millisecond,
+			IdleMax: 5 * time.Millisecond,
+		},
+	})
+
+	var junk atomic.Int32
+	go func() {
+		for {
+			p, err := s.read()
+			if err != nil {
+				return
+			}
+			if p.Type == PacketJunk {
+				junk.Add(1)
+			}
+		}
+	}()
+	go tun.Serve(context.Background())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for junk.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle tunnel sent %d junk packets", junk.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// SipHash is SipHash-2-4 keyed hash. It is used for control sum of packets
+// encoded without a key, where whole inner part must be covered.
+//
+// Hash key is a public expansion of 32-bit packet salt (see sipKey), thus
+// the key can be recovered by brute force from a single packet. Control sum
+// only detects corruption, it is not authentication. Packets are protected
+// against tampering only when sealed (see Key), which tunnels always require
+// (see RequiredCaps).
+type SipHash struct {
+	v0, v1, v2, v3 uint64
+
+	// pending tail bytes which do not form a full block yet
+	tail  [8]byte
+	ntail int
+
+	// total number of bytes put into hash
+	total uint64
+}
+
+// Derives 128-bit hash key from packet salt. Salt is expanded with
+// splitmix64, so that nearby salts produce unrelated keys. Effective
+// key size is still 32 bits.
+func sipKey(salt uint32) (k0, k1 uint64) {
+	x := uint64(salt)
+	k0 = splitmix64(&x)
+	k1 = splitmix64(&x)
+	return k0, k1
+}
+
+func splitmix64(x *uint64) uint64 {
+	*x += 0x9E3779B97F4A7C15
+	z := *x
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+func (h *SipHash) reset(salt uint32) {
+	h.resetKey(sipKey(salt))
+}
+
+func (h *SipHash) resetKey(k0, k1 uint64) {
+	h.v0 = k0 ^ 0x736F6D6570736575
+	h.v1 = k1 ^ 0x646F72616E646F6D
+	h.v2 = k0 ^ 0x6C7967656E657261
+	h.v3 = k1 ^ 0x7465646279746573
+	h.ntail = 0
+	h.total = 0
+}
+
+func (h *SipHash) put(data []byte) {
+	h.total += uint64(len(data))
+
+	if h.ntail != 0 {
+		n := copy(h.tail[h.ntail:], data)
+		h.ntail += n
+		data = data[n:]
+		if h.ntail < 8 {
+			return
+		}
+		h.block(binary.LittleEndian.Uint64(h.tail[:]))
+		h.ntail = 0
+	}
+
+	for len(data) >= 8 {
+		h.block(binary.LittleEndian.Uint64(data))
+		data = data[8:]
+	}
+	h.ntail = copy(h.tail[:], data)
+}
+
+func (h *SipHash) block(m uint64) {
+	h.v3 ^= m
+	h.round()
+	h.round()
+	h.v0 ^= m
+}
+
+func (h *SipHash) round() {
+	v0, v1, v2, v3 := h.v0, h.v1, h.v2, h.v3
+
+	v0 += v1
+	v1 = bits.RotateLeft64(v1, 13)
+	v1 ^= v0
+	v0 = bits.RotateLeft64(v0, 32)
+	v2 += v3
+	v3 = bits.RotateLeft64(v3, 16)
+	v3 ^= v2
+	v0 += v3
+	v3 = bits.RotateLeft64(v3, 21)
+	v3 ^= v0
+	v2 += v1
+	v1 = bits.RotateLeft64(v1, 17)
+	v1 ^= v2
+	v2 = bits.RotateLeft64(v2, 32)
+
+	h.v0, h.v1, h.v2, h.v3 = v0, v1, v2, v3
+}
+
+// Finalizes hash and returns its 64-bit value. Hash state is modified,
+// thus reset must be called before further use.
+func (h *SipHash) get64() uint64 {
+	var last [8]byte
+	copy(last[:], h.tail[:h.ntail])
+	last[7] = byte(h.total)
+	h.block(binary.LittleEndian.Uint64(last[:]))
+
+	h.v2 ^= 0xFF
+	h.round()
+	h.round()
+	h.round()
+	h.round()
+	return h.v0 ^ h.v1 ^ h.v2 ^ h.v3
+}
+
+// Same as get64, but folds result into 32 bits.
+func (h *SipHash) get32() uint32 {
+	v := h.get64()
+	return uint32(v) ^ uint32(v>>32)
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+func TestSipHash(t *testing.T) {
+	// reference vectors from SipHash paper, key is 00..0f and
+	// message of length n is 00..(n-1)
+	tests := []struct {
+		n    int
+		want uint64
+	}{
+		{n: 0, want: 0x726FDB47DD0E0E31},
+		{n: 1, want: 0x74F839C593DC67FD},
+		{n: 7, want: 0xAB0200F58B01D137},
+		{n: 8, want: 0x93F5F5799A932462},
+		{n: 15, want: 0xA129CA6149BE45E5},
+		{n: 63, want: 0x958A324CEB064572},
+	}
+
+	const k0 = 0x0706050403020100
+	const k1 = 0x0F0E0D0C0B0A0908
+
+	for _, tt := range tests {
+		msg := make([]byte, tt.n)
+		for i := range msg {
+			msg[i] = byte(i)
+		}
+
+		t.Run(fmt.Sprintf("n=%d", tt.n), func(t *testing.T) {
+			var h SipHash
+			h.resetKey(k0, k1)
+			h.put(msg)
+			if got := h.get64(); got != tt.want {
+				t.Errorf("get64() = %016X, want %016X", got, tt.want)
+			}
+
+			// same message split into pieces of various sizes
+			for step := 1; step < 10; step++ {
+				h.resetKey(k0, k1)
+				for i := 0; i < len(msg); i += step {
+					h.put(msg[i:min(i+step, len(msg))])
+				}
+				if got := h.get64(); got != tt.want {
+					t.Errorf("step=%d get64() = %016X, want %016X", step, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodePacketTampered(t *testing.T) {
+	g := rand.NewChaCha8([32]byte{0, 1, 2, 3})
+
+	packet := Packet{
+		Data: []byte(strings.Repeat("hello", 20)),
+		Type: PacketData,
+		CID:  NewConnID(g),
+	}
+	packet.InitEncode(g, 0x1234)
+	packet.UseStyles(1 << Style0)
+	encoded := Encode(&packet, nil)
+
+	// flip each byte of inner part, style wrapper is left intact
+	for i := 2; i < len(encoded)-2; i++ {
+		data := make([]byte, len(encoded))
+		copy(data, encoded)
+		data[i] ^= 0x01
+
+		var got Packet
+		got.InitDecode(0x1234)
+		err := Decode(&got, data)
+		if err == nil {
+			t.Errorf("Decode() with flipped byte at %d succeeded", i)
+		}
+	}
+}
+
+func benchmarkHash(b *testing.B, hash func(data []byte) uint32) {
+	for _, size := range []int{64, 1 << 10, 1 << 14} {
+		data := make([]byte, size)
+		putJunk(rand.NewChaCha8([32]byte{}), data)
+
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for b.Loop() {
+				hash(data)
+			}
+		})
+	}
+}
+
+func BenchmarkHasher(b *testing.B) {
+	benchmarkHash(b, func(data []byte) uint32 {
+		var h Hasher
+		h.reset(0x1234)
+		h.put(data)
+		return h.get32()
+	})
+}
+
+func BenchmarkSipHash(b *testing.B) {
+	benchmarkHash(b, func(data []byte) uint32 {
+		var h SipHash
+		h.reset(0x1234)
+		h.put(data)
+		return h.get32()
+	})
+}
@@ -0,0 +1,418 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stream is a single proxied connection inside a tunnel.
+//
+// Stream of udp network carries datagrams: each Write sends one datagram
+// and each Read returns one datagram, excess bytes of datagram which do not
+// fit into read buffer are discarded. Datagrams which exceed flow control
+// window are dropped instead of blocking the writer.
+type Stream struct {
+	t *Tunnel
+
+	// incoming data chunks from server
+	in Queue
+
+	// credit for sending data to server
+	sendw SendWindow
+
+	// accounts data received from server
+	recvw RecvWindow
+
+	// closed when server confirms or rejects connection
+	ready chan struct{}
+
+	// closed when no more data will come from server
+	rdone chan struct{}
+
+	// error which describes why open failed, nil means success
+	openErr error
+
+	// reason why read side was closed
+	rerr error
+
+	// remaining part of last incoming chunk
+	rest []byte
+
+	// last incoming chunk, returned to pool after it is read
+	chunk []byte
+
+	network string
+	addr    string
+
+	// stream carries datagrams instead of byte stream
+	datagram bool
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	openOnce   sync.Once
+	rdoneOnce  sync.Once
+	wcloseOnce sync.Once
+	closeOnce  sync.Once
+
+	// number of closed directions, stream is released when both
+	// directions are closed by half-close
+	halves atomic.Int32
+
+	// signals that stream was closed locally
+	done chan struct{}
+
+	cid ConnID
+}
+
+var _ net.Conn = (*Stream)(nil)
+
+func newStream(t *Tunnel, network, addr string) *Stream {
+	s := &Stream{
+		t:             t,
+		ready:         make(chan struct{}),
+		rdone:         make(chan struct{}),
+		done:          make(chan struct{}),
+		network:       network,
+		addr:          addr,
+		datagram:      isDatagramNetwork(network),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+	}
+	s.in.Init()
+	s.sendw.Init()
+	return s
+}
+
+// ConnID returns id of the stream inside its tunnel.
+func (s *Stream) ConnID() ConnID {
+	return s.cid
+}
+
+// Marks stream as opened or failed to open.
+func (s *Stream) open(err error) {
+	s.openOnce.Do(func() {
+		s.openErr = err
+		close(s.ready)
+	})
+}
+
+// Queues data chunk from server for reading.
+func (s *Stream) put(data []byte) {
+	err := s.recvw.Receive(len(data))
+	if err != nil {
+		// server does not respect flow control
+		s.t.dropStream(s.cid)
+		s.t.sendReset(s.cid)
+		s.sendw.Close()
+		s.closeRead(err)
+		return
+	}
+	s.in.Push(data)
+}
+
+// Marks that no more data will come from server. Returns false if read
+// side was already closed.
+func (s *Stream) closeRead(err error) bool {
+	closed := false
+	s.rdoneOnce.Do(func() {
+		s.rerr = err
+		close(s.rdone)
+		closed = true
+	})
+	s.open(err)
+	return closed
+}
+
+// Handles close packet from server.
+func (s *Stream) closeByPeer(cc CloseCode) {
+	err := &CloseError{Code: cc}
+	if cc != CloseWrite {
+		s.t.dropStream(s.cid)
+		s.sendw.Close()
+		s.closeRead(err)
+		return
+	}
+
+	if s.closeRead(err) {
+		s.closeHalf()
+	}
+}
+
+// Accounts one closed direction of the stream.
+func (s *Stream) closeHalf() {
+	if s.halves.Add(1) == 2 {
+		s.t.dropStream(s.cid)
+	}
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	for {
+		if len(s.rest) != 0 {
+			n := copy(b, s.rest)
+			s.rest = s.rest[n:]
+			if len(s.rest) == 0 {
+				PutBuffer(s.chunk)
+				s.chunk = nil
+			}
+			s.consume(n)
+			return n, nil
+		}
+
+		data, ok := s.in.Pop()
+		if ok {
+			if s.datagram {
+				return s.readDatagram(b, data), nil
+			}
+			s.rest = data
+			s.chunk = data
+			continue
+		}
+
+		select {
+		case <-s.in.Wait():
+		case <-s.done:
+			return 0, net.ErrClosed
+		case <-s.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-s.rdone:
+			// drain data which came before close
+			data, ok := s.in.Pop()
+			if ok {
+				if s.datagram {
+					return s.readDatagram(b, data), nil
+				}
+				s.rest = data
+				s.chunk = data
+				continue
+			}
+			if s.rerr != nil {
+				if c, ok := s.rerr.(*CloseError); ok && c.Graceful() {
+					return 0, io.EOF
+				}
+				return 0, s.rerr
+			}
+			return 0, io.EOF
+		}
+	}
+}
+
+// Copies datagram into read buffer, excess bytes are discarded.
+func (s *Stream) readDatagram(b []byte, data []byte) int {
+	n := copy(b, data)
+	s.consume(len(data))
+	PutBuffer(data)
+	return n
+}
+
+// Accounts data consumed by reader and grants more credit to server if needed.
+func (s *Stream) consume(n int) {
+	k := s.recvw.Consume(n)
+	if k == 0 {
+		return
+	}
+	s.t.sendPing(s.cid, PingWindow, uint64(k))
+}
+
+func (s *Stream) Write(b []byte) (int, error) {
+	select {
+	case <-s.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	if s.datagram {
+		return s.writeDatagram(b)
+	}
+
+	var written int
+	for len(b) != 0 {
+		n, err := s.sendw.Acquire(min(len(b), BufferSize), s.writeDeadline.wait(), os.ErrDeadlineExceeded)
+		if err != nil {
+			if err == ErrWindowClosed {
+				err = net.ErrClosed
+			}
+			return written, err
+		}
+
+		// caller may reuse buffer after write returns
+		data := GetBuffer(n)
+		copy(data, b[:n])
+
+		err = s.t.send(&Packet{
+			Data:   data,
+			CID:    s.cid,
+			Type:   PacketData,
+			Pooled: true,
+		})
+		if err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Sends b as a single datagram. Datagram is silently dropped if server
+// did not grant enough credit for it.
+func (s *Stream) writeDatagram(b []byte) (int, error) {
+	if len(b) > MaxDatagramSize {
+		return 0, ErrDatagramSize
+	}
+	if !s.sendw.TryAcquire(len(b)) {
+		select {
+		case <-s.sendw.done:
+			return 0, net.ErrClosed
+		default:
+			return len(b), nil
+		}
+	}
+
+	data := GetBuffer(len(b))
+	copy(data, b)
+	err := s.t.send(&Packet{
+		Data:     data,
+		CID:      s.cid,
+		Type:     PacketData,
+		Datagram: true,
+		Pooled:   true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// CloseWrite shuts down sending side of the stream. Server receives end
+// of data, while stream still may be used for reading.
+func (s *Stream) CloseWrite() error {
+	var err error
+	s.wcloseOnce.Do(func() {
+		s.sendw.Close()
+		err = s.t.sendClose(s.cid, CloseWrite)
+		s.closeHalf()
+	})
+	return err
+}
+
+// Close closes the stream and notifies server.
+func (s *Stream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.sendw.Close()
+		if !s.t.dropStream(s.cid) {
+			// stream was already closed in both directions
+			return
+		}
+		err = s.t.sendClose(s.cid, CloseOK)
+	})
+	return err
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return streamAddr{network: s.network, addr: s.t.ws.LocalAddr().String()}
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return streamAddr{network: s.network, addr: s.addr}
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	s.writeDeadline.set(t)
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.set(t)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.set(t)
+	return nil
+}
+
+type streamAddr struct {
+	network string
+	addr    string
+}
+
+func (a streamAddr) Network() string {
+	return a.network
+}
+
+func (a streamAddr) String() string {
+	return a.addr
+}
+
+// deadline signals through channel when deadline time is reached.
+type deadline struct {
+	mu    sync.Mutex
+	timer *time.Timer
+
+	// closed when deadline is exceeded
+	c chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{c: make(chan struct{})}
+}
+
+// Sets deadline time. Zero value of time means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// timer already fired, wait channel is closed
+		d.c = make(chan struct{})
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.c)
+	if t.IsZero() {
+		if closed {
+			d.c = make(chan struct{})
+		}
+		return
+	}
+
+	dur := time.Until(t)
+	if dur <= 0 {
+		if !closed {
+			close(d.c)
+		}
+		return
+	}
+
+	if closed {
+		d.c = make(chan struct{})
+	}
+	c := d.c
+	d.timer = time.AfterFunc(dur, func() {
+		close(c)
+	})
+}
+
+// Returns channel which is closed when deadline is exceeded.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.c
+}
+
+func isClosedChan(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Style determines packet encoding masquerade style.
+//
+// Style wraps inner part of encoded packet, so that the whole packet
+// looks like a json message. Some styles also transform inner part.
+type Style uint8
+
+const (
+	// {"..."}
+	Style0 Style = iota
+
+	// ["..."]
+	Style1
+
+	// {"type":"...","data":"..."}
+	//
+	// Type is picked from a list of common event names, data holds inner
+	// part in url-safe base64.
+	Style2
+
+	// "..."
+	//
+	// Json string with inner part in standard base64.
+	Style3
+
+	// [...]
+	//
+	// Array of numbers, one number for each byte of inner part.
+	Style4
+
+	// Number of known styles, not a valid style.
+	numStyles
+)
+
+var styleNames = [...]string{
+	Style0: "object",
+	Style1: "array",
+	Style2: "envelope",
+	Style3: "string",
+	Style4: "numbers",
+}
+
+func (s Style) String() string {
+	if s >= numStyles {
+		return fmt.Sprintf("style=%d", uint8(s))
+	}
+	return styleNames[s]
+}
+
+// StyleSet is a set of styles which can be used for encoding packets
+// of a tunnel. Each style is represented by bit with its number.
+//
+// Style set is negotiated between client and server during handshake.
+// Style0 is always supported.
+type StyleSet uint16
+
+const (
+	// Style set used when none is specified.
+	DefaultStyles StyleSet = 1<<Style0 | 1<<Style1
+
+	// All known styles.
+	AllStyles StyleSet = 1<<numStyles - 1
+)
+
+func (s StyleSet) Has(style Style) bool {
+	return s&(1<<style) != 0
+}
+
+// Returns style set with zero value replaced by DefaultStyles.
+func (s StyleSet) orDefault() StyleSet {
+	if s == 0 {
+		return DefaultStyles
+	}
+	return s
+}
+
+// Picks style from the set with the given random value.
+func (s StyleSet) pick(v uint8) Style {
+	s = s.orDefault()
+
+	var styles [numStyles]Style
+	n := 0
+	for style := range numStyles {
+		if s.Has(style) {
+			styles[n] = style
+			n += 1
+		}
+	}
+	return styles[int(v)%n]
+}
+
+func (s StyleSet) String() string {
+	var names []string
+	for style := range numStyles {
+		if s.Has(style) {
+			names = append(names, style.String())
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseStyleSet parses comma-separated list of style names.
+// Empty string gives DefaultStyles.
+func ParseStyleSet(s string) (StyleSet, error) {
+	if s == "" {
+		return DefaultStyles, nil
+	}
+
+	var set StyleSet
+	for name := range strings.SplitSeq(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "all" {
+			set |= AllStyles
+			continue
+		}
+
+		found := false
+		for style := range numStyles {
+			if styleNames[style] == name {
+				set |= 1 << style
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown style \"%s\"", name)
+		}
+	}
+	return set, nil
+}
+
+// NegotiateStyles returns styles supported by both sides.
+func NegotiateStyles(a, b StyleSet) StyleSet {
+	return (a.orDefault() & b.orDefault() & AllStyles) | 1<<Style0
+}
+
+// Event names for Style2 envelopes.
+var envelopeTypes = [...]string{
+	"message",
+	"update",
+	"event",
+	"presence",
+	"typing",
+	"ack",
+	"sync",
+	"state",
+}
+
+// Writes style prefix and returns position where inner part starts.
+func (c *encoder) start(s Style) int {
+	switch s {
+	case Style0:
+		c.puts(`{"`)
+	case Style1:
+		c.puts(`["`)
+	case Style2, Style3, Style4:
+		// whole packet is written after inner part is known
+	default:
+		panic(fmt.Sprintf("unexpected style (=%d)", s))
+	}
+	return len(c.buf)
+}
+
+// Writes style suffix and transforms inner part which starts at
+// the given position.
+func (c *encoder) end(s Style, mark int) {
+	switch s {
+	case Style0:
+		c.puts(`"}`)
+		return
+	case Style1:
+		c.puts(`"]`)
+		return
+	}
+
+	inner := GetBuffer(len(c.buf) - mark)
+	defer PutBuffer(inner)
+	copy(inner, c.buf[mark:])
+	c.buf = c.buf[:mark]
+
+	switch s {
+	case Style2:
+		// inner part starts with text junk, thus event name is random
+		c.puts(`{"type":"`)
+		c.puts(envelopeTypes[int(inner[1])%len(envelopeTypes)])
+		c.puts(`","data":"`)
+		c.buf = base64.RawURLEncoding.AppendEncode(c.buf, inner)
+		c.puts(`"}`)
+	case Style3:
+		c.putb('"')
+		c.buf = base64.StdEncoding.AppendEncode(c.buf, inner)
+		c.putb('"')
+	case Style4:
+		c.putb('[')
+		for i, b := range inner {
+			if i != 0 {
+				c.putb(',')
+			}
+			c.buf = strconv.AppendUint(c.buf, uint64(b), 10)
+		}
+		c.putb(']')
+	default:
+		panic(fmt.Sprintf("unexpected style (=%d)", s))
+	}
+}
+
+// Removes style wrapper from encoded packet and returns its inner part.
+//
+// Unwrapping is done in place, thus returned slice always points into
+// supplied data. Styles which transform inner part decode it over its
+// own text, decoded bytes never overtake text which is yet to be read.
+func unwrap(data []byte) ([]byte, Style, error) {
+	if len(data) < 2 {
+		return nil, 0, ErrPacketStyle
+	}
+
+	first := data[0]
+	last := data[len(data)-1]
+	switch {
+	case first == '{' && last == '}':
+		rest, ok := bytes.CutPrefix(data, []byte(`{"type":"`))
+		if !ok {
+			return unwrapRaw(data, Style0)
+		}
+		_, rest, ok = bytes.Cut(rest, []byte(`","data":"`))
+		if !ok {
+			return nil, 0, ErrPacketStyle
+		}
+		rest, ok = bytes.CutSuffix(rest, []byte(`"}`))
+		if !ok {
+			return nil, 0, ErrPacketStyle
+		}
+		inner, err := base64.RawURLEncoding.AppendDecode(rest[:0], rest)
+		if err != nil {
+			return nil, 0, ErrPacketStyle
+		}
+		return inner, Style2, nil
+	case first == '[' && last == ']':
+		if data[1] == '"' {
+			return unwrapRaw(data, Style1)
+		}
+		inner, err := parseNumbers(data[1 : len(data)-1])
+		if err != nil {
+			return nil, 0, err
+		}
+		return inner, Style4, nil
+	case first == '"' && last == '"':
+		inner, err := base64.StdEncoding.AppendDecode(data[1:1], data[1:len(data)-1])
+		if err != nil {
+			return nil, 0, ErrPacketStyle
+		}
+		return inner, Style3, nil
+	default:
+		return nil, 0, ErrPacketStyle
+	}
+}
+
+// Removes style prefix and suffix of two bytes each.
+func unwrapRaw(data []byte, s Style) ([]byte, Style, error) {
+	if len(data) < 4 || data[1] != '"' || data[len(data)-2] != '"' {
+		return nil, 0, ErrPacketStyle
+	}
+	return data[2 : len(data)-2], s, nil
+}
+
+// Parses comma-separated list of byte values. Parsing is done in place,
+// each value is stored behind its text.
+func parseNumbers(data []byte) ([]byte, error) {
+	inner := data[:0]
+
+	var v int
+	digits := 0
+	for i := 0; i <= len(data); i++ {
+		if i == len(data) || data[i] == ',' {
+			if digits == 0 {
+				return nil, ErrPacketStyle
+			}
+			inner = append(inner, byte(v))
+			v = 0
+			digits = 0
+			continue
+		}
+
+		b := data[i]
+		if b < '0' || b > '9' {
+			return nil, ErrPacketStyle
+		}
+		v = 10*v + int(b-'0')
+		digits += 1
+		if digits > 3 || v > 0xFF {
+			return nil, ErrPacketStyle
+		}
+	}
+	return inner, nil
+}
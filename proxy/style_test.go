@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeStyledPacket(t *testing.T) {
+	up, _, err := DeriveKeys([]byte("secret"), []byte("nonce"))
+	if err != nil {
+		t.Fatalf("DeriveKeys() error = %v", err)
+	}
+
+	g := rand.NewChaCha8([32]byte{5, 4, 3})
+	for style := range numStyles {
+		for _, key := range []*Key{nil, up} {
+			name := style.String()
+			if key != nil {
+				name += " sealed"
+			}
+			t.Run(name, func(t *testing.T) {
+				packet := Packet{
+					Data: []byte("hello, styled world"),
+					Type: PacketData,
+					CID:  NewConnID(g),
+				}
+				packet.InitEncode(g, 0xABCD)
+				packet.UseKey(key)
+				packet.UseStyles(1 << style)
+				data := Encode(&packet, nil)
+
+				_, got, err := unwrap(bytes.Clone(data))
+				if err != nil {
+					t.Fatalf("unwrap() error = %v", err)
+				}
+				if got != style {
+					t.Fatalf("unwrap() style = %s, want %s", got, style)
+				}
+
+				var p Packet
+				p.InitDecode(0xABCD)
+				p.UseKey(key)
+				p.UseStyles(AllStyles)
+				err = Decode(&p, bytes.Clone(data))
+				if err != nil {
+					t.Fatalf("Decode() error = %v", err)
+				}
+				err = comparePackets(&p, &packet)
+				if err != nil {
+					t.Errorf("compare packets: %v", err)
+				}
+
+				if style == Style0 {
+					return
+				}
+				p = Packet{}
+				p.InitDecode(0xABCD)
+				p.UseKey(key)
+				p.UseStyles(1 << Style0)
+				err = Decode(&p, data)
+				if !errors.Is(err, ErrPacketStyle) {
+					t.Errorf("Decode() with style outside of set error = %v, want %v", err, ErrPacketStyle)
+				}
+			})
+		}
+	}
+}
+
+func TestUnwrapBadStyle(t *testing.T) {
+	tests := []string{
+		``,
+		`{}`,
+		`"`,
+		`["]`,
+		`[1,,2]`,
+		`[1,256]`,
+		`[0001]`,
+		`[a]`,
+		`{"type":"message"}`,
+		`{"type":"message","data":"!!"}`,
+		`"!!!!"`,
+		`<"abc">`,
+	}
+
+	for _, tt := range tests {
+		t.Run(tt, func(t *testing.T) {
+			_, _, err := unwrap([]byte(tt))
+			if !errors.Is(err, ErrPacketStyle) {
+				t.Errorf("unwrap() error = %v, want %v", err, ErrPacketStyle)
+			}
+		})
+	}
+}
+
+func TestParseStyleSet(t *testing.T) {
+	tests := []struct {
+		s    string
+		want StyleSet
+		err  bool
+	}{
+		{s: "", want: DefaultStyles},
+		{s: "object", want: 1 << Style0},
+		{s: "object, envelope,numbers", want: 1<<Style0 | 1<<Style2 | 1<<Style4},
+		{s: "all", want: AllStyles},
+		{s: "xml", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseStyleSet(tt.s)
+			if (err != nil) != tt.err {
+				t.Fatalf("ParseStyleSet() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseStyleSet() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	got := NegotiateStyles(1<<Style2|1<<Style3, 1<<Style3|1<<Style4)
+	if want := StyleSet(1<<Style0 | 1<<Style3); got != want {
+		t.Errorf("NegotiateStyles() = %s, want %s", got, want)
+	}
+}
+
+func TestTunnelStyles(t *testing.T) {
+	tun, s := testConnectOptions(t, &Options{Styles: AllStyles})
+	if tun.styles != AllStyles || s.styles != AllStyles {
+		t.Fatalf("negotiated styles: client = %s, server = %s", tun.styles, s.styles)
+	}
+	go s.serveEcho()
+	go tun.Serve(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	st, err := tun.Open(ctx, "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	for i := range 20 {
+		want := []byte(strings.Repeat("styled ", i+1))
+		_, err = st.Write(want)
+		if err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		got := make([]byte, len(want))
+		_, err = io.ReadFull(st, got)
+		if err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("data mismatch")
+		}
+	}
+}
@@ -0,0 +1,731 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	crand "crypto/rand"
+
+	"github.com/mebyus/higs/wsok"
+)
+
+// Tunnel is a client side of websocket connection to proxy server.
+//
+// Single tunnel multiplexes many proxied connections (streams), each
+// stream is identified by its ConnID. Streams are created with Open
+// method and implement net.Conn.
+type Tunnel struct {
+	// websocket connection to server
+	ws *wsok.Conn
+
+	// outgoing packets, drained by writer goroutine
+	out chan *Packet
+
+	// outgoing control packets (pings and window credits), writer
+	// sends them ahead of packets from out
+	ctrl chan *Packet
+
+	// signals that tunnel is closed
+	done chan struct{}
+
+	// reason why tunnel was closed
+	err error
+
+	closeOnce sync.Once
+
+	// Protects map with active streams and random generator.
+	mu sync.Mutex
+
+	streams map[ConnID]*Stream
+
+	// shared generator for streams, guarded by mu
+	g *rand.ChaCha8
+
+	// generator owned by writer goroutine
+	wg *rand.ChaCha8
+
+	// key for packets to server
+	up *Key
+
+	// key for packets from server
+	down *Key
+
+	// sequence number of next packet sent to server,
+	// only writer goroutine uses it
+	seq uint64
+
+	// buffer for incoming messages, only reader goroutine uses it
+	rbuf []byte
+
+	// tracks sequence numbers of packets from server,
+	// only reader goroutine uses it
+	window ReplayWindow
+
+	// tracks keepalive pings and measures round trip time
+	ka Keepalive
+
+	// time between keepalive pings, zero means PingInterval
+	pingInterval time.Duration
+
+	// traffic shaping profile for outgoing packets
+	profile *Profile
+
+	// records tunnel frames, nil if capture is disabled
+	capture *Capture
+
+	// styles negotiated with server
+	styles StyleSet
+
+	// protocol version and capabilities negotiated with server
+	version uint8
+	caps    Caps
+}
+
+var ErrTunnelClosed = errors.New("tunnel closed")
+
+// ReadBufferSize is capacity of buffer for incoming messages. Larger messages
+// are rejected, thus it caps memory used by a single message.
+const ReadBufferSize = MaxFrameSize
+
+// Browser-like user agent for websocket upgrade requests.
+const userAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:145.0) Gecko/20100101 Firefox/145.0"
+
+// Options configure tunnel established by Connect.
+type Options struct {
+	// Traffic shaping profile for packets sent to server.
+	// Nil profile means no shaping.
+	Profile *Profile
+
+	// Styles offered to server during handshake.
+	// Zero set means DefaultStyles.
+	Styles StyleSet
+
+	// Capabilities offered to server during handshake. Zero set means
+	// SupportedCaps. Required capabilities are always offered.
+	Caps Caps
+
+	// Optional capture for recording tunnel frames.
+	Capture *Capture
+}
+
+// Connect dials proxy server at specified websocket url (ws or wss scheme)
+// and establishes a new tunnel. Returned tunnel does not process incoming
+// packets until Serve is called. Nil options mean defaults.
+func Connect(ctx context.Context, rawURL string, token string, opts *Options) (*Tunnel, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var useTLS bool
+	switch u.Scheme {
+	case "ws", "http":
+	case "wss", "https":
+		useTLS = true
+	default:
+		return nil, fmt.Errorf("unsupported url scheme \"%s\"", u.Scheme)
+	}
+
+	host := u.Host
+	addr := host
+	if u.Port() == "" {
+		port := "80"
+		if useTLS {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if useTLS {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		err = tc.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	t, err := connect(ctx, conn, u, token, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func connect(ctx context.Context, conn net.Conn, u *url.URL, token string, opts *Options) (*Tunnel, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	deadline, ok := ctx.Deadline()
+	if ok {
+		err := conn.SetDeadline(deadline)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var seed [32]byte
+	crand.Read(seed[:])
+	g := rand.NewChaCha8(seed)
+	crand.Read(seed[:])
+	wg := rand.NewChaCha8(seed)
+
+	hs, err := NewHandshake()
+	if err != nil {
+		return nil, err
+	}
+	hm := hs.Message()
+	hm.Styles = opts.Styles.orDefault()
+	if opts.Caps != 0 {
+		hm.Caps = (opts.Caps & SupportedCaps) | RequiredCaps
+	}
+
+	origin := "http://" + u.Host
+	if u.Scheme == "wss" || u.Scheme == "https" {
+		origin = "https://" + u.Host
+	}
+
+	// websocket key is random for each tunnel, thus it is used as
+	// handshake nonce for signing messages and deriving tunnel keys
+	key := wsok.GenHandshakeKey(g)
+	hm.SignOffer(token, []byte(key))
+
+	rb := bufio.NewReader(conn)
+	wb := bufio.NewWriter(conn)
+	cfg := wsok.ConnectConfig{
+		ExtraHeaders: []wsok.Header{
+			{Name: "Cookie", Value: HandshakeCookie(&hm)},
+		},
+		Path:      u.RequestURI(),
+		Key:       key,
+		Host:      u.Host,
+		UserAgent: userAgent,
+		Origin:    origin,
+	}
+	err = wsok.WriteConnectRequest(wb, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	err = wb.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := wsok.ReadConnectResponse(rb)
+	if err != nil {
+		return nil, err
+	}
+	_, err = wsok.CheckConnectResponse(resp, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ws := wsok.NewConn(conn, bufio.NewReadWriter(rb, wb), true)
+	ws.SetMaxMessageSize(ReadBufferSize)
+	rbuf := make([]byte, 0, ReadBufferSize)
+	var m wsok.Message
+	err = ws.ReadMessage(&m, rbuf)
+	if err != nil {
+		return nil, fmt.Errorf("read handshake reply: %w", err)
+	}
+	var reply HandshakeMessage
+	err = DecodeHandshakeReply(&reply, m.Data)
+	if err != nil {
+		return nil, err
+	}
+	err = reply.VerifyReply(&hm, token, []byte(key))
+	if err != nil {
+		return nil, err
+	}
+	err = reply.Check()
+	if err != nil {
+		return nil, err
+	}
+	up, down, err := hs.Keys(&reply, token, []byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Capture != nil {
+		opts.Capture.Begin(up, down)
+	}
+
+	return &Tunnel{
+		ws:      ws,
+		out:     make(chan *Packet, 64),
+		ctrl:    make(chan *Packet, 16),
+		done:    make(chan struct{}),
+		streams: make(map[ConnID]*Stream),
+		g:       g,
+		wg:      wg,
+		rbuf:    rbuf,
+		up:      up,
+		down:    down,
+		profile: opts.Profile,
+		capture: opts.Capture,
+		styles:  NegotiateStyles(hm.Styles, reply.Styles),
+		version: reply.Version,
+		caps:    reply.Caps & hm.Caps,
+	}, nil
+}
+
+// Serve processes incoming packets and sends outgoing ones until
+// tunnel is closed or context is canceled. Always returns non-nil error
+// which describes why tunnel was closed.
+func (t *Tunnel) Serve(ctx context.Context) error {
+	go t.serveWrites()
+	go t.serveKeepalive()
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.close(ctx.Err())
+		case <-t.done:
+		}
+	}()
+
+	for {
+		err := t.readNextFrame()
+		if err != nil {
+			t.close(err)
+			return t.err
+		}
+	}
+}
+
+// Caps returns capabilities negotiated with server.
+func (t *Tunnel) Caps() Caps {
+	return t.caps
+}
+
+// RTT returns round trip time statistics measured by keepalive pings.
+func (t *Tunnel) RTT() RTTStats {
+	return t.ka.Stats()
+}
+
+// Periodically sends keepalive pings to server. Closes tunnel with
+// ErrTunnelDead when server stops replying.
+func (t *Tunnel) serveKeepalive() {
+	interval := t.pingInterval
+	if interval == 0 {
+		interval = PingInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case now := <-ticker.C:
+			t.mu.Lock()
+			nonce := t.g.Uint64()
+			t.mu.Unlock()
+
+			if !t.ka.Next(nonce, now) {
+				t.close(ErrTunnelDead)
+				return
+			}
+			t.sendPing(TunnelID, PingRequest, nonce)
+		}
+	}
+}
+
+// Handles keepalive ping which refers to the tunnel itself.
+func (t *Tunnel) handlePing(data []byte) error {
+	var p Ping
+	err := DecodePing(&p, data)
+	if err != nil {
+		return err
+	}
+
+	switch p.Kind {
+	case PingRequest:
+		t.mu.Lock()
+		reply := NewPingPacket(t.g, TunnelID, PingReply, p.Value)
+		t.mu.Unlock()
+
+		// reader must not wait for writer, otherwise tunnel may deadlock
+		// when both directions are saturated, thus reply is dropped if
+		// control queue is full (server treats it as a missed ping)
+		select {
+		case t.ctrl <- reply:
+		default:
+		}
+	case PingReply:
+		t.ka.Reply(p.Value, time.Now())
+	}
+	return nil
+}
+
+// Close closes tunnel and all its streams.
+func (t *Tunnel) Close() error {
+	t.close(ErrTunnelClosed)
+	return nil
+}
+
+func (t *Tunnel) close(err error) {
+	t.closeOnce.Do(func() {
+		t.err = err
+		close(t.done)
+		t.ws.Close()
+
+		t.mu.Lock()
+		streams := t.streams
+		t.streams = nil
+		t.mu.Unlock()
+
+		for _, s := range streams {
+			s.sendw.Close()
+			s.closeRead(ErrTunnelClosed)
+		}
+	})
+}
+
+// Open creates a new stream inside the tunnel. Address must be in "host:port"
+// form, where host is either IP address or a name which will be resolved by
+// server. Supported networks are "tcp" and "udp", the latter only if server
+// supports CapUDP (see Stream for datagram semantics).
+//
+// Open waits until server confirms connection to target.
+func (t *Tunnel) Open(ctx context.Context, network string, addr string) (*Stream, error) {
+	var nw uint8
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		nw = NetworkTCP
+	case "udp", "udp4", "udp6":
+		if !t.caps.Has(CapUDP) {
+			return nil, fmt.Errorf("%w: udp network", ErrUnsupported)
+		}
+		nw = NetworkUDP
+	default:
+		return nil, fmt.Errorf("unsupported network \"%s\"", network)
+	}
+
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(sport, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port \"%s\"", sport)
+	}
+	if host == "" || len(host) > maxHostNameLength {
+		return nil, ErrHostName
+	}
+	ip, err := netip.ParseAddr(host)
+	isIP := err == nil
+	if isIP && ip.Is6() && !ip.Is4In6() && !t.caps.Has(CapIPv6) {
+		return nil, fmt.Errorf("%w: ipv6 destination", ErrUnsupported)
+	}
+
+	var h Hello
+	s := newStream(t, network, addr)
+
+	t.mu.Lock()
+	if t.streams == nil {
+		t.mu.Unlock()
+		return nil, ErrTunnelClosed
+	}
+	if isIP {
+		h.InitEncode(t.g, nw, netip.AddrPortFrom(ip, uint16(port)))
+	} else {
+		h.InitEncodeName(t.g, nw, host, uint16(port))
+	}
+	s.cid = NewConnID(t.g)
+	t.streams[s.cid] = s
+	t.mu.Unlock()
+
+	err = t.send(&Packet{
+		Data: EncodeHello(&h, nil),
+		CID:  s.cid,
+		Type: PacketHello,
+	})
+	if err != nil {
+		t.dropStream(s.cid)
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		s.Close()
+		return nil, ctx.Err()
+	case <-s.ready:
+		if s.openErr != nil {
+			t.dropStream(s.cid)
+			return nil, s.openErr
+		}
+		return s, nil
+	}
+}
+
+// Queues packet for sending to server. Packet must have type, cid and data
+// set, all other fields will be initialized by writer goroutine.
+func (t *Tunnel) send(p *Packet) error {
+	select {
+	case <-t.done:
+		return ErrTunnelClosed
+	case t.out <- p:
+		return nil
+	}
+}
+
+// Queues close packet for specified stream.
+func (t *Tunnel) sendClose(cid ConnID, cc CloseCode) error {
+	t.mu.Lock()
+	p := NewClosePacket(t.g, cid, cc)
+	t.mu.Unlock()
+
+	return t.send(p)
+}
+
+// Queues reset packet for specified stream without waiting for writer, since
+// tunnel reader uses it. Reset must not go ahead of data packets already
+// queued for the stream (server treats packets of unknown connection as
+// an error), thus it goes into the same queue. If queue is full, reset is
+// queued by separate goroutine.
+func (t *Tunnel) sendReset(cid ConnID) {
+	t.mu.Lock()
+	p := NewClosePacket(t.g, cid, CloseReset)
+	t.mu.Unlock()
+
+	select {
+	case t.out <- p:
+	default:
+		go t.send(p)
+	}
+}
+
+// Queues ping packet for specified stream. Pings go ahead of queued data packets.
+func (t *Tunnel) sendPing(cid ConnID, kind PingKind, value uint64) error {
+	t.mu.Lock()
+	p := NewPingPacket(t.g, cid, kind, value)
+	t.mu.Unlock()
+
+	select {
+	case <-t.done:
+		return ErrTunnelClosed
+	case t.ctrl <- p:
+		return nil
+	}
+}
+
+// serve packets that come from streams and send them to server
+func (t *Tunnel) serveWrites() {
+	sh := NewShaper(t.profile, t.wg)
+	defer sh.Stop()
+
+	// delays writes, closed tunnel must not wait for it
+	delay := time.NewTimer(0)
+	delay.Stop()
+
+	var buf []byte
+	emit := func(p *Packet) error {
+		var err error
+		buf, err = t.writePacket(buf[:0], p)
+		return err
+	}
+
+	for {
+		var err error
+		select {
+		case <-t.done:
+			return
+		case <-sh.IdleC():
+			err = emit(sh.Junk())
+			if err == nil {
+				err = t.ws.Flush()
+			}
+		case p := <-t.ctrl:
+			err = emit(p)
+			if err == nil {
+				err = t.flushPending()
+			}
+		case p := <-t.out:
+			if d := sh.Delay(); d > 0 {
+				// jitter timings, more packets may be queued meanwhile
+				delay.Reset(d)
+				select {
+				case <-delay.C:
+				case <-t.done:
+					return
+				}
+			}
+			err = t.writeControl(emit)
+			if err == nil {
+				err = sh.Shape(p, emit)
+			}
+			if err == nil {
+				err = t.flushPending()
+			}
+		}
+		if err != nil {
+			t.close(err)
+			return
+		}
+		sh.Active()
+	}
+}
+
+// Flushes written packets only when there are no more pending packets.
+func (t *Tunnel) flushPending() error {
+	if len(t.out) != 0 || len(t.ctrl) != 0 {
+		return nil
+	}
+	return t.ws.Flush()
+}
+
+// Writes all pending control packets. Data packets may wait in queue
+// for a long time, thus writer sends control packets ahead of them.
+func (t *Tunnel) writeControl(emit func(p *Packet) error) error {
+	for {
+		select {
+		case p := <-t.ctrl:
+			err := emit(p)
+			if err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func (t *Tunnel) writePacket(buf []byte, p *Packet) ([]byte, error) {
+	var mask [4]byte
+	binary.LittleEndian.PutUint32(mask[:], uint32(t.wg.Uint64()))
+
+	salt := t.up.Salt(mask)
+	p.Compress = t.caps.Has(CapCompress)
+	p.InitEncode(t.wg, salt)
+	p.UseKey(t.up)
+	p.UseStyles(t.styles)
+	p.Seq = t.seq
+	t.seq += 1
+
+	// packet is encoded right after room for frame header
+	buf = Encode(p, append(buf, make([]byte, wsok.MaxHeaderSize)...))
+	if t.capture != nil {
+		t.capture.Frame(CaptureUp, wsok.OpBin, salt, buf[wsok.MaxHeaderSize:])
+	}
+	return buf, t.ws.WriteInPlace(&wsok.Frame{
+		Op:      wsok.OpBin,
+		Mask:    mask,
+		Fin:     true,
+		UseMask: true,
+	}, buf)
+}
+
+func (t *Tunnel) readNextFrame() error {
+	var m wsok.Message
+	err := t.ws.ReadMessage(&m, t.rbuf)
+	var ce *wsok.CloseError
+	if errors.As(err, &ce) {
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+	salt := t.down.Salt(m.Mask)
+	if t.capture != nil {
+		t.capture.Frame(CaptureDown, m.Op, salt, m.Data)
+	}
+	if m.Op != wsok.OpBin {
+		return nil
+	}
+
+	var packet Packet
+	packet.InitDecode(salt)
+	packet.UseKey(t.down)
+	packet.UseStyles(t.styles)
+	packet.UseWindow(&t.window)
+	err = Decode(&packet, m.Data)
+	if err != nil {
+		if errors.Is(err, ErrPacketReplay) {
+			return nil
+		}
+		return err
+	}
+
+	if packet.Type == PacketPing && packet.CID == TunnelID {
+		return t.handlePing(packet.Data)
+	}
+
+	s := t.getStream(packet.CID)
+	if s == nil {
+		return nil
+	}
+
+	switch packet.Type {
+	case PacketHello:
+		s.open(nil)
+	case PacketData:
+		// packet data points into read buffer, which is reused for next message
+		data := GetBuffer(len(packet.Data))
+		copy(data, packet.Data)
+		s.put(data)
+	case PacketClose:
+		var c Close
+		err = DecodeClose(&c, packet.Data)
+		if err != nil {
+			return err
+		}
+		s.closeByPeer(c.Code)
+	case PacketPing:
+		var p Ping
+		err = DecodePing(&p, packet.Data)
+		if err != nil {
+			return err
+		}
+		if p.Kind == PingWindow && p.Value <= InitialWindow {
+			s.sendw.Grant(int(p.Value))
+		}
+	case PacketJunk:
+		// nothing to do
+	default:
+		return fmt.Errorf("unexpected packet type (=%d)", packet.Type)
+	}
+	return nil
+}
+
+func (t *Tunnel) getStream(cid ConnID) *Stream {
+	t.mu.Lock()
+	s := t.streams[cid]
+	t.mu.Unlock()
+
+	return s
+}
+
+// Removes stream from tunnel. Returns false if stream was already removed.
+func (t *Tunnel) dropStream(cid ConnID) bool {
+	t.mu.Lock()
+	_, ok := t.streams[cid]
+	delete(t.streams, cid)
+	t.mu.Unlock()
+
+	return ok
+}
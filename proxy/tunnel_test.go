@@ -0,0 +1,703 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mebyus/higs/wsok"
+)
+
+const testToken = "token"
+
+// testServer is a minimal proxy server for testing tunnels. Instead of
+// dialing targets it echoes data back to client.
+type testServer struct {
+	ws *wsok.Conn
+
+	g *rand.ChaCha8
+
+	up   *Key
+	down *Key
+
+	styles StyleSet
+
+	// guards writes, generator and seq
+	mu sync.Mutex
+
+	seq uint64
+}
+
+// Accepts websocket upgrade on the given connection.
+func acceptTestServer(conn net.Conn) (*testServer, error) {
+	rb := bufio.NewReader(conn)
+	wb := bufio.NewWriter(conn)
+
+	req, err := http.ReadRequest(rb)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range req.Header {
+		for _, v := range values {
+			if strings.Contains(v, testToken) {
+				return nil, fmt.Errorf("auth token is sent in %s header", name)
+			}
+		}
+	}
+	key := req.Header.Get("Sec-Websocket-Key")
+	cookie, err := req.Cookie(HandshakeCookieName)
+	if err != nil {
+		return nil, err
+	}
+	var hm HandshakeMessage
+	err = DecodeHandshake(&hm, cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	err = hm.VerifyOffer(testToken, []byte(key))
+	if err != nil {
+		wb.WriteString("HTTP/1.1 401 Unauthorized\r\nContent-Length: 0\r\n\r\n")
+		wb.Flush()
+		return nil, err
+	}
+	hs, err := NewHandshake()
+	if err != nil {
+		return nil, err
+	}
+	up, down, err := hs.Keys(&hm, testToken, []byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	wb.WriteString("HTTP/1.1 101 Switching Protocols\n")
+	wb.WriteString("Connection: Upgrade\n")
+	wb.WriteString("Upgrade: websocket\n")
+	wb.WriteString("Sec-Websocket-Accept: " + wsok.HashHandshakeKey(key) + "\n\n")
+	ws := wsok.NewConn(conn, bufio.NewReadWriter(rb, wb), false)
+	reply := hs.Message()
+	reply.Accept(&hm, SupportedCaps, AllStyles)
+	reply.SignReply(&hm, testToken, []byte(key))
+	err = ws.WriteMessage(wsok.OpText, EncodeHandshakeReply(&reply))
+	if err != nil {
+		return nil, err
+	}
+	err = ws.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	return &testServer{
+		ws:     ws,
+		g:      rand.NewChaCha8([32]byte{3, 2, 1}),
+		up:     up,
+		down:   down,
+		styles: reply.Styles,
+	}, nil
+}
+
+func (s *testServer) read() (*Packet, error) {
+	var m wsok.Message
+	err := s.ws.ReadMessage(&m, make([]byte, 0, ReadBufferSize))
+	if err != nil {
+		return nil, err
+	}
+
+	var p Packet
+	p.InitDecode(s.up.Salt(m.Mask))
+	p.UseKey(s.up)
+	p.UseStyles(s.styles)
+	err = Decode(&p, m.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *testServer) write(p *Packet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p.InitEncode(s.g, s.down.Salt([4]byte{}))
+	p.UseKey(s.down)
+	p.UseStyles(s.styles)
+	p.Seq = s.seq
+	s.seq += 1
+
+	err := s.ws.WriteMessage(wsok.OpBin, Encode(p, nil))
+	if err != nil {
+		return err
+	}
+	return s.ws.Flush()
+}
+
+func (s *testServer) writeClose(cid ConnID, cc CloseCode) error {
+	var c Close
+	s.mu.Lock()
+	c.InitEncode(s.g, cc)
+	s.mu.Unlock()
+	return s.write(&Packet{Type: PacketClose, CID: cid, Data: EncodeClose(&c, nil)})
+}
+
+// Echoes data of all streams back to client.
+func (s *testServer) serveEcho() error {
+	for {
+		p, err := s.read()
+		if err != nil {
+			return err
+		}
+
+		switch p.Type {
+		case PacketHello:
+			var h Hello
+			err = DecodeHello(&h, p.Data)
+			if err != nil {
+				return err
+			}
+			if h.Name == "refused.example" {
+				err = s.writeClose(p.CID, CloseDialRefused)
+			} else {
+				err = s.write(&Packet{Type: PacketHello, CID: p.CID})
+			}
+		case PacketData:
+			err = s.write(&Packet{Type: PacketData, CID: p.CID, Data: p.Data})
+		case PacketPing:
+			var ping Ping
+			err = DecodePing(&ping, p.Data)
+			if err != nil {
+				return err
+			}
+			if ping.Kind == PingRequest {
+				s.mu.Lock()
+				ping.InitEncode(s.g, PingReply, ping.Value)
+				s.mu.Unlock()
+				err = s.write(&Packet{Type: PacketPing, CID: TunnelID, Data: EncodePing(&ping, nil)})
+			}
+		case PacketClose:
+			var c Close
+			err = DecodeClose(&c, p.Data)
+			if err != nil {
+				return err
+			}
+			if c.Code == CloseWrite {
+				// all data was already echoed
+				err = s.writeClose(p.CID, CloseWrite)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Connects tunnel to test server over in-memory pipe.
+func testConnect(t *testing.T) (*Tunnel, *testServer) {
+	return testConnectOptions(t, nil)
+}
+
+func testConnectOptions(t *testing.T, opts *Options) (*Tunnel, *testServer) {
+	c1, c2 := net.Pipe()
+
+	type result struct {
+		s   *testServer
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		s, err := acceptTestServer(c2)
+		ch <- result{s: s, err: err}
+	}()
+
+	u, err := url.Parse("ws://example.com/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tun, err := connect(ctx, c1, u, testToken, opts)
+	if err != nil {
+		t.Fatalf("connect() error = %v", err)
+	}
+
+	r := <-ch
+	if r.err != nil {
+		t.Fatalf("accept tunnel: %v", r.err)
+	}
+	t.Cleanup(func() {
+		// pipe is synchronous, thus close frame from client
+		// would wait for server which no longer reads
+		c2.Close()
+		tun.Close()
+	})
+	return tun, r.s
+}
+
+func TestTunnel(t *testing.T) {
+	tun, s := testConnect(t)
+	go s.serveEcho()
+	go tun.Serve(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := tun.Open(ctx, "tcp", "refused.example:443")
+	var cerr *CloseError
+	if !errors.As(err, &cerr) || cerr.Code != CloseDialRefused {
+		t.Errorf("Open() refused stream error = %v", err)
+	}
+
+	streams := make([]*Stream, 3)
+	for i, addr := range []string{"127.0.0.1:80", "[::1]:443", "example.com:8080"} {
+		streams[i], err = tun.Open(ctx, "tcp", addr)
+		if err != nil {
+			t.Fatalf("Open(%s) error = %v", addr, err)
+		}
+	}
+
+	for i, s := range streams {
+		want := bytes.Repeat([]byte{'a' + byte(i)}, 1000*(i+1))
+		_, err = s.Write(want)
+		if err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+
+		got := make([]byte, len(want))
+		_, err = io.ReadFull(s, got)
+		if err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("stream %d data mismatch", i)
+		}
+	}
+
+	for _, s := range streams {
+		err = s.Close()
+		if err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+	}
+}
+
+func TestStreamCloseWrite(t *testing.T) {
+	tun, s := testConnect(t)
+	go s.serveEcho()
+	go tun.Serve(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	st, err := tun.Open(ctx, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	want := []byte("request body")
+	_, err = st.Write(want)
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	err = st.CloseWrite()
+	if err != nil {
+		t.Fatalf("CloseWrite() error = %v", err)
+	}
+	_, err = st.Write(want)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write() after CloseWrite() error = %v, want %v", err, net.ErrClosed)
+	}
+
+	// response is still readable after local side is closed
+	st.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(st)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("ReadAll() = %q, want %q", got, want)
+	}
+
+	// both directions are closed, stream must be released
+	if tun.getStream(st.ConnID()) != nil {
+		t.Errorf("stream was not released after both sides closed write")
+	}
+}
+
+func TestStreamCloseByPeer(t *testing.T) {
+	tun, s := testConnect(t)
+	go tun.Serve(context.Background())
+
+	errs := make(chan error, 1)
+	go func() {
+		p, err := s.read()
+		if err != nil {
+			errs <- err
+			return
+		}
+		err = s.write(&Packet{Type: PacketHello, CID: p.CID})
+		if err != nil {
+			errs <- err
+			return
+		}
+		errs <- s.writeClose(p.CID, CloseReset)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	st, err := tun.Open(ctx, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	err = <-errs
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = st.Read(make([]byte, 16))
+	var cerr *CloseError
+	if !errors.As(err, &cerr) || cerr.Code != CloseReset {
+		t.Errorf("Read() error = %v, want reset", err)
+	}
+	if tun.getStream(st.ConnID()) != nil {
+		t.Errorf("stream was not released after close by peer")
+	}
+}
+
+func TestTunnelCaps(t *testing.T) {
+	tun, s := testConnectOptions(t, &Options{Caps: CapSealed})
+	go s.serveEcho()
+	go tun.Serve(context.Background())
+
+	if tun.Caps() != CapSealed {
+		t.Errorf("Caps() = %s, want %s", tun.Caps(), CapSealed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := tun.Open(ctx, "tcp", "[2001:db8::1]:443")
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Open() ipv6 error = %v, want %v", err, ErrUnsupported)
+	}
+	_, err = tun.Open(ctx, "udp", "192.0.2.1:443")
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Open() udp error = %v, want %v", err, ErrUnsupported)
+	}
+	st, err := tun.Open(ctx, "tcp", "192.0.2.1:443")
+	if err != nil {
+		t.Fatalf("Open() ipv4 error = %v", err)
+	}
+	st.Close()
+}
+
+func TestStreamDatagrams(t *testing.T) {
+	tun, s := testConnectOptions(t, &Options{Profile: &ProfileChat})
+	go s.serveEcho()
+	go tun.Serve(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	st, err := tun.Open(ctx, "udp", "192.0.2.1:443")
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer st.Close()
+
+	// sizes cross shaping profile ranges, datagrams must not be split
+	sizes := []int{1, 100, 1500, 9000}
+	for _, size := range sizes {
+		_, err = st.Write(bytes.Repeat([]byte{byte(size)}, size))
+		if err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	st.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, MaxDatagramSize)
+	for _, size := range sizes {
+		n, err := st.Read(buf)
+		if err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		if n != size || buf[0] != byte(size) {
+			t.Errorf("Read() = %d bytes, want datagram of %d bytes", n, size)
+		}
+	}
+
+	// excess bytes of datagram are discarded
+	_, err = st.Write([]byte("hello"))
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	_, err = st.Write([]byte("world"))
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	small := make([]byte, 2)
+	for _, want := range []string{"he", "wo"} {
+		n, err := st.Read(small)
+		if err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		if string(small[:n]) != want {
+			t.Errorf("Read() = %q, want %q", small[:n], want)
+		}
+	}
+
+	_, err = st.Write(make([]byte, MaxDatagramSize+1))
+	if !errors.Is(err, ErrDatagramSize) {
+		t.Errorf("Write() large datagram error = %v, want %v", err, ErrDatagramSize)
+	}
+}
+
+func TestTunnelPingReplyAheadOfData(t *testing.T) {
+	tun, s := testConnect(t)
+
+	// writer is not running yet, thus data queue stays full
+	for range cap(tun.out) {
+		tun.out <- &Packet{Type: PacketData, CID: TunnelID, Data: []byte("data")}
+	}
+
+	var ping Ping
+	ping.InitEncode(s.g, PingRequest, 42)
+	data := EncodePing(&ping, nil)
+
+	done := make(chan struct{})
+	go func() {
+		// more requests than control queue holds, excess replies are dropped
+		for range 2 * cap(tun.ctrl) {
+			tun.handlePing(data)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handlePing() blocked on full queue")
+	}
+
+	go tun.serveWrites()
+	p, err := s.read()
+	if err != nil {
+		t.Fatalf("read() error = %v", err)
+	}
+	if p.Type != PacketPing {
+		t.Fatalf("first packet type = %s, want %s", p.Type, PacketPing)
+	}
+	err = DecodePing(&ping, p.Data)
+	if err != nil {
+		t.Fatalf("DecodePing() error = %v", err)
+	}
+	if ping.Kind != PingReply || ping.Value != 42 {
+		t.Errorf("ping reply kind = %d, value = %d", ping.Kind, ping.Value)
+	}
+}
+
+// Relays tunnel handshake like a middlebox which terminates TLS and sees
+// the whole upgrade request, but does not know auth token. Public keys in
+// handshake messages are replaced with its own key, as it is required for
+// reading tunnel traffic.
+func relayHandshake(client net.Conn, server net.Conn, swapOffer bool, swapReply bool) {
+	defer client.Close()
+	defer server.Close()
+
+	mitm, err := NewHandshake()
+	if err != nil {
+		return
+	}
+
+	cr := bufio.NewReader(client)
+	req, err := http.ReadRequest(cr)
+	if err != nil {
+		return
+	}
+	if swapOffer {
+		cookie, err := req.Cookie(HandshakeCookieName)
+		if err != nil {
+			return
+		}
+		var m HandshakeMessage
+		err = DecodeHandshake(&m, cookie.Value)
+		if err != nil {
+			return
+		}
+		m.PublicKey = mitm.Message().PublicKey
+		req.Header.Set("Cookie", HandshakeCookie(&m))
+	}
+	err = req.Write(server)
+	if err != nil {
+		return
+	}
+
+	sr := bufio.NewReader(server)
+	resp, err := wsok.ReadConnectResponse(sr)
+	if err != nil {
+		return
+	}
+	_, err = client.Write(resp)
+	if err != nil || !swapReply {
+		return
+	}
+
+	sws := wsok.NewConn(server, bufio.NewReadWriter(sr, bufio.NewWriter(server)), true)
+	var msg wsok.Message
+	err = sws.ReadMessage(&msg, nil)
+	if err != nil {
+		return
+	}
+	var m HandshakeMessage
+	err = DecodeHandshakeReply(&m, msg.Data)
+	if err != nil {
+		return
+	}
+	m.PublicKey = mitm.Message().PublicKey
+
+	cws := wsok.NewConn(client, bufio.NewReadWriter(cr, bufio.NewWriter(client)), false)
+	err = cws.WriteMessage(wsok.OpText, EncodeHandshakeReply(&m))
+	if err == nil {
+		cws.Flush()
+	}
+}
+
+// Sealing keys are derived only after both sides verified the exchange,
+// thus middlebox which replaces public keys cannot complete the tunnel
+// and read or forge sealed packets.
+func TestTunnelHandshakeMITM(t *testing.T) {
+	tests := []struct {
+		name string
+
+		swapOffer bool
+		swapReply bool
+
+		// error expected from server, nil if server completes handshake
+		serverErr error
+	}{
+		{
+			name:      "1 swapped client key",
+			swapOffer: true,
+			serverErr: ErrHandshakeAuth,
+		},
+		{
+			name:      "2 swapped server key",
+			swapReply: true,
+		},
+		{
+			name:      "3 swapped both keys",
+			swapOffer: true,
+			swapReply: true,
+			serverErr: ErrHandshakeAuth,
+		},
+	}
+
+	u, err := url.Parse("ws://example.com/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, r1 := net.Pipe()
+			r2, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+
+			ch := make(chan error, 1)
+			go func() {
+				_, err := acceptTestServer(c2)
+				ch <- err
+			}()
+			go relayHandshake(r1, r2, tt.swapOffer, tt.swapReply)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			tun, err := connect(ctx, c1, u, testToken, nil)
+			if err == nil {
+				tun.Close()
+				t.Fatal("connect() through middlebox succeeded")
+			}
+			if tt.swapReply && !tt.swapOffer && !errors.Is(err, ErrHandshakeAuth) {
+				t.Errorf("connect() error = %v, want %v", err, ErrHandshakeAuth)
+			}
+
+			err = <-ch
+			if !errors.Is(err, tt.serverErr) {
+				t.Errorf("server error = %v, want %v", err, tt.serverErr)
+			}
+		})
+	}
+}
+
+func TestStreamResetWithFullQueue(t *testing.T) {
+	tun, s := testConnect(t)
+
+	st := newStream(tun, "tcp", "192.0.2.1:443")
+	st.cid = NewConnID(s.g)
+	tun.streams[st.cid] = st
+
+	// writer is not running yet, thus data queue stays full
+	for range cap(tun.out) {
+		tun.out <- &Packet{Type: PacketData, CID: st.cid, Data: []byte("data")}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// server does not respect flow control
+		st.put(make([]byte, InitialWindow+1))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("put() blocked on full queue")
+	}
+	if tun.getStream(st.cid) != nil {
+		t.Errorf("stream was not dropped")
+	}
+
+	// reset follows data queued before it
+	go tun.serveWrites()
+	for i := range cap(tun.out) + 1 {
+		p, err := s.read()
+		if err != nil {
+			t.Fatalf("read() error = %v", err)
+		}
+		if i < cap(tun.out) && p.Type != PacketData {
+			t.Fatalf("packet %d type = %s, want %s", i, p.Type, PacketData)
+		}
+		if i == cap(tun.out) && p.Type != PacketClose {
+			t.Fatalf("packet %d type = %s, want %s", i, p.Type, PacketClose)
+		}
+	}
+}
+
+func TestTunnelCloseDuringDelay(t *testing.T) {
+	tun, s := testConnectOptions(t, &Options{Profile: &Profile{Name: "slow", MaxDelay: time.Hour}})
+	go s.serveEcho()
+
+	exited := make(chan struct{})
+	go func() {
+		tun.serveWrites()
+		close(exited)
+	}()
+
+	tun.out <- &Packet{Type: PacketData, CID: TunnelID, Data: []byte("data")}
+	for len(tun.out) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	tun.Close()
+
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer waits for delay after tunnel was closed")
+	}
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Protocol version spoken by this implementation. It must be incremented
+// each time packet format or tunnel behavior changes in incompatible way.
+const ProtocolVersion = 1
+
+// Oldest protocol version this implementation can talk to.
+const MinProtocolVersion = 1
+
+// Caps is a set of optional protocol features. Client offers features it
+// supports during handshake and server replies with the common set.
+type Caps uint16
+
+const (
+	// Destination may be specified as IPv6 address.
+	CapIPv6 Caps = 1 << iota
+
+	// Streams may carry UDP datagrams.
+	CapUDP
+
+	// Packets are sealed with tunnel keys.
+	CapSealed
+
+	// Packet data may be compressed.
+	CapCompress
+
+	// Number of known capabilities, not a valid capability.
+	numCaps = iota
+)
+
+// Capabilities supported by this implementation.
+const SupportedCaps = CapIPv6 | CapUDP | CapSealed | CapCompress
+
+// Capabilities without which tunnel cannot be established.
+// Tunnels are always sealed, thus peers which cannot seal
+// packets are rejected.
+const RequiredCaps = CapSealed
+
+var capNames = [...]string{
+	"ipv6",
+	"udp",
+	"sealed",
+	"compress",
+}
+
+// Has reports whether all capabilities from f are present in the set.
+func (c Caps) Has(f Caps) bool {
+	return c&f == f
+}
+
+func (c Caps) String() string {
+	var names []string
+	for i := range numCaps {
+		if c&(1<<i) != 0 {
+			names = append(names, capNames[i])
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+var (
+	ErrIncompatible = errors.New("incompatible peer")
+	ErrUnsupported  = errors.New("not supported by peer")
+)
+
+// Accept fills server reply with protocol version, capabilities and styles
+// negotiated with client offer. Server supports the given capabilities and
+// styles.
+//
+// If client is incompatible, then reply is marked with CloseIncompatible code.
+// Such reply must still be sent to client, so that it knows the reason.
+func (m *HandshakeMessage) Accept(offer *HandshakeMessage, caps Caps, styles StyleSet) {
+	m.Version = min(offer.Version, ProtocolVersion)
+	m.Caps = offer.Caps & caps
+	m.Styles = NegotiateStyles(offer.Styles, styles)
+	m.Code = CloseOK
+
+	if m.Version < MinProtocolVersion || !m.Caps.Has(RequiredCaps) {
+		m.Code = CloseIncompatible
+	}
+}
+
+// Check validates server reply to client offer. Returned error
+// wraps ErrIncompatible if tunnel cannot be established with this server.
+func (m *HandshakeMessage) Check() error {
+	if m.Code != CloseOK {
+		return fmt.Errorf("%w: %w", ErrIncompatible, &CloseError{Code: m.Code})
+	}
+	if m.Version < MinProtocolVersion || m.Version > ProtocolVersion {
+		return fmt.Errorf("%w: protocol version %d", ErrIncompatible, m.Version)
+	}
+	if !m.Caps.Has(RequiredCaps) {
+		return fmt.Errorf("%w: capabilities \"%s\"", ErrIncompatible, m.Caps)
+	}
+	return nil
+}
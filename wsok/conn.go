@@ -0,0 +1,718 @@
+package wsok
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// CloseCode is status code carried by close frame.
+type CloseCode uint16
+
+const (
+	CloseNormal        CloseCode = 1000
+	CloseGoingAway     CloseCode = 1001
+	CloseProtocolError CloseCode = 1002
+	CloseUnsupported   CloseCode = 1003
+
+	// Close frame has no status code. Never sent in close frame.
+	CloseNoStatus CloseCode = 1005
+
+	// Connection was dropped without close frame. Never sent in close frame.
+	CloseAbnormal CloseCode = 1006
+
+	CloseInvalidData CloseCode = 1007
+	ClosePolicy      CloseCode = 1008
+	CloseTooBig      CloseCode = 1009
+	CloseExtension   CloseCode = 1010
+	CloseInternal    CloseCode = 1011
+)
+
+// Reports whether code may be sent in close frame.
+func (c CloseCode) valid() bool {
+	switch {
+	case c >= 1000 && c <= 1003:
+		return true
+	case c >= 1007 && c <= 1011:
+		return true
+	case c >= 3000 && c <= 4999:
+		// registered and private codes
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseError is returned by Conn after close frame was received from peer.
+type CloseError struct {
+	Reason string
+	Code   CloseCode
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket closed with code %d", e.Code)
+	}
+	return fmt.Sprintf("websocket closed with code %d: %s", e.Code, e.Reason)
+}
+
+// Message is a complete data message assembled from one or more frames.
+type Message struct {
+	Data []byte
+
+	// Opcode of the first frame, either OpText or OpBin.
+	Op OpCode
+
+	// Mask of the first frame, zero if frame was not masked.
+	Mask [4]byte
+}
+
+// Conn is a message layer on top of websocket frames.
+//
+// It reassembles fragmented messages, validates incoming frames, replies
+// to pings and performs close handshake. Extensions are not supported,
+// thus frames with extension bits set are rejected.
+//
+// Conn also implements net.Conn: each Write is sent as a single binary
+// frame and Read streams payloads of incoming data messages, message
+// boundaries are not preserved. Read may be mixed with ReadMessage and
+// NextReader, the latter two discard unread payload of current message.
+//
+// Incoming messages are limited in size (see SetMaxMessageSize), larger
+// messages fail connection with CloseTooBig status.
+//
+// Conn is safe for one concurrent reader and any number of concurrent
+// writers. Data frames written with WriteMessage or WriteInPlace are not
+// flushed, call Flush when needed. Write and control frames are always
+// flushed.
+type Conn struct {
+	// nil if Conn was created over plain reader and writer
+	conn net.Conn
+
+	r io.Reader
+	w io.Writer
+
+	// guards writes and closeSent
+	wmu sync.Mutex
+
+	// close frame was sent, no more frames may be written
+	closeSent bool
+
+	// Reply to the latest ping which is not written yet. Reader never
+	// waits for write lock, thus pong is written by whoever holds
+	// the lock when releasing it (see unlockWrite).
+	pong        [MaxControlSize]byte
+	pongSize    int
+	pongPending atomic.Bool
+
+	// guards pong and pongSize
+	pmu sync.Mutex
+
+	closeOnce sync.Once
+
+	// error returned by all reads after connection failed or was closed
+	// by peer, only reader uses it
+	rerr error
+
+	// State of current incoming frame and message, only reader uses it.
+
+	// payload bytes left unread in current frame
+	left uint64
+
+	// mask of current frame and position of next unread byte in its payload
+	mask [4]byte
+	pos  int
+
+	// total payload size of current message
+	size uint64
+
+	// max payload size of message
+	maxSize uint64
+
+	// incremented for each new message, so that reader returned by
+	// NextReader can tell that its message is gone
+	seq uint64
+
+	// payload of current message is not fully read
+	started bool
+
+	// current message has more frames after current one
+	fragmented bool
+
+	// buffer for control frame payload, only reader uses it
+	ctrl [MaxControlSize]byte
+
+	// negotiated during handshake, may be empty
+	subprotocol string
+
+	// client side masks outgoing frames and expects unmasked incoming ones
+	client bool
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+// NewConn wraps connection on which websocket handshake was completed.
+// Buffers used during handshake (for example returned by http.Hijacker)
+// should be passed along, since reader may already hold incoming frames.
+// Nil buffers mean that new ones are created for conn.
+//
+// Client side must be specified, since frames are masked only in one
+// direction.
+func NewConn(conn net.Conn, rw *bufio.ReadWriter, client bool) *Conn {
+	if rw == nil {
+		rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	}
+	c := newConn(rw.Reader, rw.Writer, client)
+	c.conn = conn
+	return c
+}
+
+// Creates Conn which reads frames from r and writes them to w.
+func newConn(r io.Reader, w io.Writer, client bool) *Conn {
+	return &Conn{
+		r:       r,
+		w:       w,
+		maxSize: DefaultMaxMessageSize,
+		client:  client,
+	}
+}
+
+// Subprotocol returns subprotocol selected by Upgrade, empty if client
+// offered none of supported ones or Conn was created with NewConn.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// DefaultMaxMessageSize is max size of incoming message for new Conn.
+const DefaultMaxMessageSize = 1 << 20
+
+// SetMaxMessageSize sets max payload size of incoming message. Size is
+// checked before frame payload is read, thus it also caps memory used by
+// ReadMessage. Must not be called concurrently with reads.
+func (c *Conn) SetMaxMessageSize(size int) {
+	c.maxSize = uint64(size)
+}
+
+// ReadMessage reads next data message, control frames which arrive
+// before or between its fragments are handled internally.
+//
+// Message payload is appended to buf[:0], which grows if its capacity is
+// not enough. Thus message data is valid only until buffer is reused and
+// may be passed back as buffer for the next call.
+//
+// Returns *CloseError after close frame was received from peer. Protocol
+// errors fail connection, peer is notified with close frame carrying
+// corresponding status code. Once error is returned, all subsequent
+// reads return the same error.
+func (c *Conn) ReadMessage(m *Message, buf []byte) error {
+	if c.rerr != nil {
+		return c.rerr
+	}
+	err := c.readMessage(m, buf)
+	if err != nil {
+		c.rerr = err
+	}
+	return err
+}
+
+func (c *Conn) readMessage(m *Message, buf []byte) error {
+	err := c.beginMessage(m)
+	if err != nil {
+		return err
+	}
+
+	data := buf[:0]
+	for {
+		if len(data) == cap(data) && c.left != 0 {
+			// frame size was checked against message limit,
+			// thus buffer never grows beyond it
+			data = slices.Grow(data, int(c.left))
+		}
+		n, err := c.readPayload(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.Op == OpText && !utf8.Valid(data) {
+		return c.closeWith(CloseInvalidData, errors.New("text message is not valid utf-8"))
+	}
+	m.Data = data
+	return nil
+}
+
+// NextReader starts reading next data message. Its payload is read
+// from returned reader, which returns io.EOF at the end of message.
+// Message data field is not set and text messages are not validated.
+//
+// Unread payload of previous message is discarded. Reader is valid
+// until next message is started.
+func (c *Conn) NextReader(m *Message) (io.Reader, error) {
+	if c.rerr != nil {
+		return nil, c.rerr
+	}
+	err := c.beginMessage(m)
+	if err != nil {
+		c.rerr = err
+		return nil, err
+	}
+	return &messageReader{c: c, seq: c.seq}, nil
+}
+
+type messageReader struct {
+	c *Conn
+
+	// sequence number of message
+	seq uint64
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	c := r.c
+	if c.seq != r.seq {
+		return 0, errors.New("message reader is used after next message")
+	}
+	if c.rerr != nil {
+		return 0, c.rerr
+	}
+	n, err := c.readPayload(p)
+	if err != nil && err != io.EOF {
+		c.rerr = err
+	}
+	return n, err
+}
+
+// Read reads payload of incoming data messages as a stream of bytes.
+// Returns io.EOF after peer closed connection normally, *CloseError
+// is returned for other close codes.
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.rerr != nil {
+		return 0, c.rerr
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for {
+		if !c.started {
+			var m Message
+			err := c.beginMessage(&m)
+			var ce *CloseError
+			if errors.As(err, &ce) && (ce.Code == CloseNormal || ce.Code == CloseNoStatus) {
+				err = io.EOF
+			}
+			if err != nil {
+				c.rerr = err
+				return 0, err
+			}
+		}
+
+		n, err := c.readPayload(p)
+		if err == io.EOF {
+			// empty message or end of message
+			continue
+		}
+		if err != nil {
+			c.rerr = err
+		}
+		return n, err
+	}
+}
+
+// Reads header of the first frame of next message, unread payload of
+// current message is discarded.
+func (c *Conn) beginMessage(m *Message) error {
+	var buf [512]byte
+	for c.started {
+		_, err := c.readPayload(buf[:])
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+
+	var f Frame
+	err := c.nextFrame(&f)
+	if err != nil {
+		return err
+	}
+	c.seq += 1
+	c.started = true
+	m.Data = nil
+	m.Op = f.Op
+	m.Mask = f.Mask
+	return nil
+}
+
+// Reads payload of current message, frames of fragmented message are
+// read as needed. Returns io.EOF at the end of message.
+func (c *Conn) readPayload(p []byte) (int, error) {
+	for c.left == 0 {
+		if !c.fragmented {
+			c.started = false
+			return 0, io.EOF
+		}
+		var f Frame
+		err := c.nextFrame(&f)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	for i := range n {
+		p[i] ^= c.mask[(c.pos+i)&0b11]
+	}
+	c.pos += n
+	c.left -= uint64(n)
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Reads header of next data frame and makes it current. Control frames
+// which arrive before it are handled.
+func (c *Conn) nextFrame(f *Frame) error {
+	for {
+		size, err := readHeader(c.r, f)
+		if err != nil {
+			return c.fail(err)
+		}
+		if f.Ext != 0 {
+			return c.fail(fmt.Errorf("%w: extension bits %03b are set", ErrProtocol, f.Ext))
+		}
+		if f.UseMask == c.client {
+			// client must mask all frames and server must not
+			return c.fail(fmt.Errorf("%w: bad frame masking", ErrProtocol))
+		}
+
+		if f.Op.IsControl() {
+			payload := c.ctrl[:size]
+			_, err = io.ReadFull(c.r, payload)
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return err
+			}
+			unmask(payload, f.Mask)
+			err = c.handleControl(f.Op, payload)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if f.Op == OpFrag && !c.fragmented {
+			return c.fail(fmt.Errorf("%w: continuation frame without message", ErrProtocol))
+		}
+		if f.Op != OpFrag && c.fragmented {
+			return c.fail(fmt.Errorf("%w: new message inside fragmented message", ErrProtocol))
+		}
+		if f.Op != OpFrag {
+			c.size = 0
+		}
+		if size > c.maxSize-c.size {
+			return c.fail(fmt.Errorf("%w: message exceeds %d bytes", ErrFrameSize, c.maxSize))
+		}
+
+		c.size += size
+		c.left = size
+		c.mask = f.Mask
+		c.pos = 0
+		c.fragmented = !f.Fin
+		return nil
+	}
+}
+
+// Write sends p as a single binary frame.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.unlockWrite()
+
+	if c.closeSent {
+		return 0, net.ErrClosed
+	}
+	f := Frame{Data: p, Op: OpBin, Fin: true}
+	c.maskFrame(&f)
+	err := Encode(c.w, &f)
+	if err != nil {
+		return 0, err
+	}
+	err = c.flush()
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Time given to close frame to be sent when connection is closed.
+const closeTimeout = time.Second
+
+// Close sends close frame with normal status (unless close frame was
+// already sent) and closes underlying connection.
+func (c *Conn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		if c.conn == nil {
+			err = c.WriteClose(CloseNormal, "")
+			return
+		}
+		// unblock writer which may hold write lock, so that close frame
+		// does not wait for it indefinitely
+		_ = c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		_ = c.WriteClose(CloseNormal, "")
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// LocalAddr returns nil if Conn was created without net.Conn.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns nil if Conn was created without net.Conn.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets read and write deadlines of underlying connection.
+// Expired read deadline breaks Conn same as other read errors, since
+// frame may be left partially read.
+//
+// Conn created without net.Conn does not support deadlines, all deadline
+// methods return os.ErrNoDeadline for it.
+func (c *Conn) SetDeadline(t time.Time) error {
+	if c.conn == nil {
+		return os.ErrNoDeadline
+	}
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	if c.conn == nil {
+		return os.ErrNoDeadline
+	}
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	if c.conn == nil {
+		return os.ErrNoDeadline
+	}
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) handleControl(op OpCode, payload []byte) error {
+	switch op {
+	case OpPing:
+		c.queuePong(payload)
+		return nil
+	case OpPong:
+		// unsolicited pongs are allowed and pings are never sent by Conn
+		return nil
+	case OpClose:
+		ce := &CloseError{Code: CloseNoStatus}
+		switch {
+		case len(payload) == 1:
+			return c.fail(fmt.Errorf("%w: truncated close code", ErrProtocol))
+		case len(payload) >= 2:
+			ce.Code = CloseCode(binary.BigEndian.Uint16(payload))
+			ce.Reason = string(payload[2:])
+			if !ce.Code.valid() {
+				return c.fail(fmt.Errorf("%w: bad close code %d", ErrProtocol, ce.Code))
+			}
+			if !utf8.ValidString(ce.Reason) {
+				return c.closeWith(CloseInvalidData, errors.New("close reason is not valid utf-8"))
+			}
+		}
+
+		// echo status code back to complete close handshake
+		code := ce.Code
+		if code == CloseNoStatus {
+			code = 0
+		}
+		// peer may drop connection right after its close frame,
+		// thus failed echo is not reported
+		_ = c.WriteClose(code, "")
+		return ce
+	default:
+		panic(fmt.Sprintf("unexpected control opcode 0x%x", uint8(op)))
+	}
+}
+
+// Fails connection after reading frame failed. Peer is notified only about
+// protocol violations, other errors come from underlying reader.
+func (c *Conn) fail(err error) error {
+	switch {
+	case errors.Is(err, ErrFrameSize):
+		return c.closeWith(CloseTooBig, err)
+	case errors.Is(err, ErrProtocol):
+		return c.closeWith(CloseProtocolError, err)
+	default:
+		return err
+	}
+}
+
+// Sends close frame with the given code and returns err.
+func (c *Conn) closeWith(code CloseCode, err error) error {
+	// peer is already in bad state, thus write error is not reported
+	_ = c.WriteClose(code, "")
+	return err
+}
+
+// WriteMessage writes data message as a single frame.
+func (c *Conn) WriteMessage(op OpCode, data []byte) error {
+	c.wmu.Lock()
+	defer c.unlockWrite()
+
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	f := Frame{Data: data, Op: op, Fin: true}
+	c.maskFrame(&f)
+	return Encode(c.w, &f)
+}
+
+// WriteInPlace writes frame same way as EncodeInPlace. Frame masking
+// must be set by caller according to Conn side.
+func (c *Conn) WriteInPlace(f *Frame, buf []byte) error {
+	c.wmu.Lock()
+	defer c.unlockWrite()
+
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	return EncodeInPlace(c.w, f, buf)
+}
+
+// WriteClose sends close frame with the given status code and reason,
+// zero code means that close frame carries no status. After close frame
+// was sent, all writes fail with net.ErrClosed. Sending close frame
+// again does nothing.
+func (c *Conn) WriteClose(code CloseCode, reason string) error {
+	c.wmu.Lock()
+	defer c.unlockWrite()
+
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+
+	var payload []byte
+	if code != 0 {
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+		if len(payload) > MaxControlSize {
+			payload = payload[:MaxControlSize]
+		}
+	}
+	return c.writeFrame(OpClose, payload)
+}
+
+// Flush flushes underlying writer if it is buffered.
+func (c *Conn) Flush() error {
+	c.wmu.Lock()
+	defer c.unlockWrite()
+
+	return c.flush()
+}
+
+// Queues reply to ping, only the latest ping is answered. Pong is written
+// right away if write lock is free, otherwise writer which holds the lock
+// sends it. Reader must not wait for writer, since the latter may be
+// blocked on full socket until peer reads, and peer may wait for pong.
+func (c *Conn) queuePong(payload []byte) {
+	c.pmu.Lock()
+	c.pongSize = copy(c.pong[:], payload)
+	c.pongPending.Store(true)
+	c.pmu.Unlock()
+
+	if c.wmu.TryLock() {
+		c.unlockWrite()
+	}
+}
+
+// Releases write lock. Queued pong is written before that. Pong may be
+// queued right before lock is released, thus it is checked once more.
+func (c *Conn) unlockWrite() {
+	for {
+		c.writePong()
+		c.wmu.Unlock()
+		if !c.pongPending.Load() || !c.wmu.TryLock() {
+			return
+		}
+	}
+}
+
+// Writes queued pong, must be called with write lock held.
+func (c *Conn) writePong() {
+	if !c.pongPending.Load() {
+		return
+	}
+
+	var payload [MaxControlSize]byte
+	c.pmu.Lock()
+	n := copy(payload[:], c.pong[:c.pongSize])
+	c.pongPending.Store(false)
+	c.pmu.Unlock()
+
+	if c.closeSent {
+		// peer does not expect pongs after close frame
+		return
+	}
+	// pong is best effort, failed write breaks buffered
+	// writer, thus error surfaces on the next write
+	_ = c.writeFrame(OpPong, payload[:n])
+}
+
+// Writes and flushes single frame, must be called with write lock held.
+func (c *Conn) writeFrame(op OpCode, payload []byte) error {
+	f := Frame{Data: payload, Op: op, Fin: true}
+	c.maskFrame(&f)
+	err := Encode(c.w, &f)
+	if err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+func (c *Conn) maskFrame(f *Frame) {
+	if !c.client {
+		return
+	}
+	f.UseMask = true
+	binary.LittleEndian.PutUint32(f.Mask[:], rand.Uint32())
+}
+
+func (c *Conn) flush() error {
+	fw, ok := c.w.(interface{ Flush() error })
+	if !ok {
+		return nil
+	}
+	return fw.Flush()
+}
@@ -0,0 +1,438 @@
+package wsok
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+var testMask = [4]byte{0xAC, 0x13, 0xE9, 0x06}
+
+// Encodes frames as they are sent by client.
+func encodeClientFrames(t *testing.T, frames ...Frame) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for _, f := range frames {
+		f.Mask = testMask
+		f.UseMask = true
+		err := Encode(&buf, &f)
+		if err != nil {
+			t.Fatalf("Encode() error = %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Decodes close code from the first close frame in output.
+func readCloseCode(t *testing.T, out *bytes.Buffer) CloseCode {
+	t.Helper()
+
+	for {
+		var f Frame
+		err := Decode(out, &f)
+		if err != nil {
+			t.Fatalf("no close frame in output: %v", err)
+		}
+		if f.Op != OpClose {
+			continue
+		}
+		if len(f.Data) < 2 {
+			return CloseNoStatus
+		}
+		return CloseCode(binary.BigEndian.Uint16(f.Data))
+	}
+}
+
+func TestConnFragmented(t *testing.T) {
+	in := encodeClientFrames(t,
+		Frame{Data: []byte("hello"), Op: OpText},
+		Frame{Data: []byte("ping"), Op: OpPing, Fin: true},
+		Frame{Data: []byte(", "), Op: OpFrag},
+		Frame{Data: []byte("world"), Op: OpFrag, Fin: true},
+	)
+	var out bytes.Buffer
+	c := newConn(bytes.NewReader(in), &out, false)
+
+	var m Message
+	err := c.ReadMessage(&m, make([]byte, 0, 100))
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if string(m.Data) != "hello, world" || m.Op != OpText || m.Mask != testMask {
+		t.Errorf("ReadMessage() got = %q (op=0x%x, mask=%v)", m.Data, uint8(m.Op), m.Mask)
+	}
+
+	var pong Frame
+	err = Decode(&out, &pong)
+	if err != nil {
+		t.Fatalf("Decode() pong error = %v", err)
+	}
+	if pong.Op != OpPong || string(pong.Data) != "ping" || pong.UseMask {
+		t.Errorf("reply to ping = %#v", &pong)
+	}
+}
+
+func TestConnProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		err  error
+		code CloseCode
+	}{
+		{
+			name: "1 extension bits",
+			in:   encodeClientFrames(t, Frame{Data: []byte("hello"), Op: OpBin, Fin: true, Ext: 0b100}),
+			err:  ErrProtocol,
+			code: CloseProtocolError,
+		},
+		{
+			name: "2 unmasked frame",
+			in:   []byte("\x82\x05hello"),
+			err:  ErrProtocol,
+			code: CloseProtocolError,
+		},
+		{
+			name: "3 continuation without message",
+			in:   encodeClientFrames(t, Frame{Data: []byte("hello"), Op: OpFrag, Fin: true}),
+			err:  ErrProtocol,
+			code: CloseProtocolError,
+		},
+		{
+			name: "4 new message inside fragmented one",
+			in: encodeClientFrames(t,
+				Frame{Data: []byte("hello"), Op: OpBin},
+				Frame{Data: []byte("world"), Op: OpBin, Fin: true},
+			),
+			err:  ErrProtocol,
+			code: CloseProtocolError,
+		},
+		{
+			name: "5 fragmented control frame",
+			in:   encodeClientFrames(t, Frame{Data: []byte("ping"), Op: OpPing}),
+			err:  ErrProtocol,
+			code: CloseProtocolError,
+		},
+		{
+			name: "6 large control frame",
+			in:   encodeClientFrames(t, Frame{Data: make([]byte, MaxControlSize+1), Op: OpPing, Fin: true}),
+			err:  ErrProtocol,
+			code: CloseProtocolError,
+		},
+		{
+			name: "7 unknown opcode",
+			in:   encodeClientFrames(t, Frame{Data: []byte("hello"), Op: 0x3, Fin: true}),
+			err:  ErrProtocol,
+			code: CloseProtocolError,
+		},
+		{
+			name: "8 reserved close code",
+			in:   encodeClientFrames(t, Frame{Data: []byte{0x03, 0xED}, Op: OpClose, Fin: true}),
+			err:  ErrProtocol,
+			code: CloseProtocolError,
+		},
+		{
+			name: "9 message too large",
+			in: encodeClientFrames(t,
+				Frame{Data: make([]byte, 60), Op: OpBin},
+				Frame{Data: make([]byte, 60), Op: OpFrag, Fin: true},
+			),
+			err:  ErrFrameSize,
+			code: CloseTooBig,
+		},
+		{
+			name: "10 huge frame",
+			in:   []byte("\x82\xff\x40\x00\x00\x00\x00\x00\x00\x00\xac\x13\xe9\x06hello"),
+			err:  ErrFrameSize,
+			code: CloseTooBig,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			c := newConn(bytes.NewReader(tt.in), &out, false)
+			c.SetMaxMessageSize(100)
+
+			var m Message
+			err := c.ReadMessage(&m, nil)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ReadMessage() error = %v, want %v", err, tt.err)
+			}
+			code := readCloseCode(t, &out)
+			if code != tt.code {
+				t.Errorf("close code = %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestConnInvalidText(t *testing.T) {
+	in := encodeClientFrames(t, Frame{Data: []byte("\xff\xfe"), Op: OpText, Fin: true})
+	var out bytes.Buffer
+	c := newConn(bytes.NewReader(in), &out, false)
+
+	var m Message
+	err := c.ReadMessage(&m, make([]byte, 0, 100))
+	if err == nil {
+		t.Fatalf("ReadMessage() accepted invalid utf-8 text")
+	}
+	code := readCloseCode(t, &out)
+	if code != CloseInvalidData {
+		t.Errorf("close code = %d, want %d", code, CloseInvalidData)
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(CloseNormal))
+	payload = append(payload, "bye"...)
+	var in bytes.Buffer
+	err := Encode(&in, &Frame{Data: payload, Op: OpClose, Fin: true})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	// client side reads unmasked frames from server
+	var out bytes.Buffer
+	c := newConn(&in, &out, true)
+
+	var m Message
+	err = c.ReadMessage(&m, nil)
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Code != CloseNormal || ce.Reason != "bye" {
+		t.Fatalf("ReadMessage() error = %v, want close with code %d", err, CloseNormal)
+	}
+	err = c.ReadMessage(&m, nil)
+	if !errors.As(err, &ce) {
+		t.Errorf("ReadMessage() after close error = %v", err)
+	}
+
+	var reply Frame
+	err = Decode(&out, &reply)
+	if err != nil {
+		t.Fatalf("Decode() close reply error = %v", err)
+	}
+	if reply.Op != OpClose || !reply.UseMask || !bytes.Equal(reply.Data, payload[:2]) {
+		t.Errorf("reply to close = %#v", &reply)
+	}
+
+	err = c.WriteMessage(OpBin, []byte("hello"))
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("WriteMessage() after close error = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestConnStream(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewConn(c1, nil, true)
+	server := NewConn(c2, nil, false)
+	defer server.Close()
+
+	go func() {
+		for _, s := range []string{"hello", "", ", ", "world"} {
+			_, err := client.Write([]byte(s))
+			if err != nil {
+				t.Errorf("Write() error = %v", err)
+			}
+		}
+		client.Close()
+	}()
+
+	// small buffer, so that frame payload is read in several parts
+	got, err := readAllBy(server, 3)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if string(got) != "hello, world" {
+		t.Errorf("Read() got = %q, want %q", got, "hello, world")
+	}
+}
+
+// Reads from r with buffer of the given size until io.EOF.
+func readAllBy(r io.Reader, size int) ([]byte, error) {
+	var data []byte
+	buf := make([]byte, size)
+	for {
+		n, err := r.Read(buf)
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return data, err
+		}
+	}
+}
+
+func TestConnDeadline(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewConn(c1, nil, true)
+	defer client.Close()
+	defer c2.Close()
+
+	err := client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if err != nil {
+		t.Fatalf("SetReadDeadline() error = %v", err)
+	}
+	_, err = client.Read(make([]byte, 16))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestConnNextReader(t *testing.T) {
+	in := encodeClientFrames(t,
+		Frame{Data: []byte("hello"), Op: OpBin},
+		Frame{Data: []byte("ping"), Op: OpPing, Fin: true},
+		Frame{Data: []byte(", world"), Op: OpFrag, Fin: true},
+		Frame{Data: []byte("skipped "), Op: OpBin},
+		Frame{Data: []byte("part"), Op: OpFrag, Fin: true},
+		Frame{Data: []byte("last"), Op: OpText, Fin: true},
+	)
+	var out bytes.Buffer
+	c := newConn(bytes.NewReader(in), &out, false)
+
+	var m Message
+	r, err := c.NextReader(&m)
+	if err != nil {
+		t.Fatalf("NextReader() error = %v", err)
+	}
+	got, err := readAllBy(r, 3)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if string(got) != "hello, world" || m.Op != OpBin {
+		t.Errorf("NextReader() got = %q (op=0x%x)", got, uint8(m.Op))
+	}
+
+	// second message is partially read, its rest must be discarded
+	r, err = c.NextReader(&m)
+	if err != nil {
+		t.Fatalf("NextReader() error = %v", err)
+	}
+	_, err = io.ReadFull(r, make([]byte, 4))
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+
+	err = c.ReadMessage(&m, nil)
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if string(m.Data) != "last" || m.Op != OpText {
+		t.Errorf("ReadMessage() got = %q (op=0x%x)", m.Data, uint8(m.Op))
+	}
+	_, err = r.Read(make([]byte, 4))
+	if err == nil {
+		t.Errorf("Read() of previous message succeeded")
+	}
+}
+
+func TestConnReadMessageBuffer(t *testing.T) {
+	in := encodeClientFrames(t,
+		Frame{Data: []byte("hello"), Op: OpBin, Fin: true},
+		Frame{Data: bytes.Repeat([]byte("a"), 100), Op: OpBin},
+		Frame{Data: bytes.Repeat([]byte("b"), 100), Op: OpFrag, Fin: true},
+	)
+	var out bytes.Buffer
+	c := newConn(bytes.NewReader(in), &out, false)
+
+	buf := make([]byte, 0, 16)
+	var m Message
+	err := c.ReadMessage(&m, buf)
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if string(m.Data) != "hello" || &m.Data[0] != &buf[:1][0] {
+		t.Errorf("ReadMessage() got = %q, buffer was not reused", m.Data)
+	}
+
+	// buffer grows for larger message
+	err = c.ReadMessage(&m, m.Data)
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	want := append(bytes.Repeat([]byte("a"), 100), bytes.Repeat([]byte("b"), 100)...)
+	if !bytes.Equal(m.Data, want) {
+		t.Errorf("ReadMessage() got = %q, want %q", m.Data, want)
+	}
+}
+
+func TestConnWithoutNetConn(t *testing.T) {
+	var out bytes.Buffer
+	c := newConn(bytes.NewReader(nil), &out, false)
+
+	if c.LocalAddr() != nil || c.RemoteAddr() != nil {
+		t.Errorf("addresses of Conn without net.Conn are not nil")
+	}
+	err := c.SetDeadline(time.Now())
+	if !errors.Is(err, os.ErrNoDeadline) {
+		t.Errorf("SetDeadline() error = %v, want %v", err, os.ErrNoDeadline)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	code := readCloseCode(t, &out)
+	if code != CloseNormal {
+		t.Errorf("close code = %d, want %d", code, CloseNormal)
+	}
+	err = c.Close()
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("second Close() error = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestConnPingWhileWriterBlocked(t *testing.T) {
+	in := encodeClientFrames(t,
+		Frame{Data: []byte("ping 1"), Op: OpPing, Fin: true},
+		Frame{Data: []byte("ping 2"), Op: OpPing, Fin: true},
+		Frame{Data: []byte("hello"), Op: OpText, Fin: true},
+	)
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	c := newConn(bytes.NewReader(in), pw, false)
+
+	// writer holds write lock while peer does not read
+	go c.WriteMessage(OpBin, []byte("data"))
+	for c.wmu.TryLock() {
+		c.wmu.Unlock()
+		runtime.Gosched()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		var m Message
+		err := c.ReadMessage(&m, nil)
+		if err == nil && string(m.Data) != "hello" {
+			err = fmt.Errorf("got %q", m.Data)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ReadMessage() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadMessage() waits for blocked writer")
+	}
+
+	// writer sends reply to the latest ping after its own frame
+	for _, want := range []Frame{{Op: OpBin, Data: []byte("data")}, {Op: OpPong, Data: []byte("ping 2")}} {
+		var f Frame
+		err := Decode(pr, &f)
+		if err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		if f.Op != want.Op || string(f.Data) != string(want.Data) {
+			t.Errorf("Decode() got = %q (op=0x%x), want %q (op=0x%x)", f.Data, uint8(f.Op), want.Data, uint8(want.Op))
+		}
+	}
+}
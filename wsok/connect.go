@@ -1,10 +1,13 @@
 package wsok
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"strings"
 )
 
@@ -22,6 +25,11 @@ type ConnectConfig struct {
 	// Optional.
 	AcceptEncodings []string
 
+	// Optional.
+	//
+	// Subprotocols offered to server in order of preference.
+	Subprotocols []string
+
 	// Required.
 	Path string
 
@@ -85,6 +93,7 @@ func WriteConnectRequest(w io.Writer, c *ConnectConfig) error {
 		{"Sec-WebSocket-Version", "13"},
 		{"Origin", c.Origin},
 		{"Sec-WebSocket-Extensions", joinHeaderValues(c.Extensions)},
+		{"Sec-WebSocket-Protocol", joinHeaderValues(c.Subprotocols)},
 		{"Sec-Websocket-Key", c.Key},
 		{"Connection", "keep-alive, Upgrade"},
 		{"Sec-Fetch-Dest", "empty"},
@@ -110,7 +119,7 @@ func WriteConnectRequest(w io.Writer, c *ConnectConfig) error {
 		}
 	}
 
-	_, err = io.WriteString(w, "\n")
+	_, err = io.WriteString(w, "\r\n")
 	return err
 }
 
@@ -138,7 +147,7 @@ func writeGetPath(w io.Writer, path string) error {
 	if err != nil {
 		return err
 	}
-	_, err = io.WriteString(w, " HTTP/1.1\n")
+	_, err = io.WriteString(w, " HTTP/1.1\r\n")
 	return err
 }
 
@@ -159,60 +168,95 @@ func writeHeader(w io.Writer, name, value string) error {
 	if err != nil {
 		return err
 	}
-	_, err = io.WriteString(w, "\n")
+	_, err = io.WriteString(w, "\r\n")
 	return err
 }
 
+// Max size of websocket connect response.
+const maxConnectResponseSize = 1 << 12
+
+// ReadConnectResponse reads websocket connect response until (and including)
+// empty line. Frames which follow the response are left in reader.
+func ReadConnectResponse(r *bufio.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	for {
+		line, err := r.ReadSlice('\n')
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		if buf.Len() > maxConnectResponseSize {
+			return nil, errors.New("connect response is too large")
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			return buf.Bytes(), nil
+		}
+	}
+}
+
+// CheckConnectResponse checks websocket connect response to request written
+// with the given config. Returns subprotocol selected by server, empty if
+// server did not select any.
+//
 // Correct websocket connect response should be like:
 //
 //	HTTP/1.1 101 Switching Protocols
-//	Connection: Upgrade
 //	Upgrade: websocket
-//	Sec-Websocket-Accept: <hash>
+//	Connection: Upgrade
+//	Sec-WebSocket-Accept: <hash>
 //
-// Note that response must end with double new line ("\n\n").
-func CheckConnectResponse(b []byte, key string) error {
-	split := bytes.Split(b, []byte{'\n'})
-	if len(split) != 6 {
-		return fmt.Errorf("unexpected number of headers (=%d)", len(split))
+// Response is parsed as regular HTTP response, thus lines may end with
+// either CRLF or LF, header names are case-insensitive and extra headers
+// are allowed.
+func CheckConnectResponse(b []byte, c *ConnectConfig) (string, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil {
+		return "", fmt.Errorf("parse connect response: %w", err)
 	}
 
-	if !bytes.Equal(split[0], []byte("HTTP/1.1 101 Switching Protocols")) {
-		return fmt.Errorf("bad status: %s", split[0])
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return "", fmt.Errorf("bad status: %s", resp.Status)
 	}
-
-	if !bytes.Equal(split[1], []byte("Connection: Upgrade")) {
-		return fmt.Errorf("bad connection header: %s", split[1])
+	if !hasHeaderToken(resp.Header, "Upgrade", "websocket") {
+		return "", fmt.Errorf("bad upgrade header: %s", resp.Header.Get("Upgrade"))
 	}
-
-	if !bytes.Equal(split[2], []byte("Upgrade: websocket")) {
-		return fmt.Errorf("bad upgrade header: %s", split[2])
+	if !hasHeaderToken(resp.Header, "Connection", "upgrade") {
+		return "", fmt.Errorf("bad connection header: %s", resp.Header.Get("Connection"))
 	}
 
-	acceptSplit := bytes.SplitN(split[3], []byte{':'}, 2)
-	if len(acceptSplit) != 2 {
-		return fmt.Errorf("bad accept header: %s", split[3])
+	gotHash := resp.Header.Get("Sec-WebSocket-Accept")
+	if gotHash != HashHandshakeKey(c.Key) {
+		return "", fmt.Errorf("handshake key hash mismatch: %s", gotHash)
 	}
 
-	// TODO: check accept header name
-
-	gotHash := bytes.TrimSpace(acceptSplit[1])
-	wantHash := HashHandshakeKey(key)
-	if !bytes.Equal(gotHash, []byte(wantHash)) {
-		return fmt.Errorf("handshake key hash mismatch: %s", gotHash)
+	// Conn does not implement any extensions
+	ext := resp.Header.Get("Sec-WebSocket-Extensions")
+	if ext != "" {
+		return "", fmt.Errorf("unsupported extensions: %s", ext)
 	}
 
-	if len(split[4]) != 0 {
-		return fmt.Errorf("bad end: %s", split[4])
+	protocol := resp.Header.Get("Sec-WebSocket-Protocol")
+	if protocol != "" && !slices.Contains(c.Subprotocols, protocol) {
+		return "", fmt.Errorf("subprotocol was not offered: %s", protocol)
 	}
-
-	return nil
+	return protocol, nil
 }
 
+// HasUpgradeHeaders reports whether request headers ask for websocket upgrade.
 func HasUpgradeHeaders(headers http.Header) bool {
-	if headers.Get("Upgrade") != "websocket" {
-		return false
-	}
+	return hasHeaderToken(headers, "Upgrade", "websocket") &&
+		hasHeaderToken(headers, "Connection", "upgrade")
+}
 
-	return strings.Contains(headers.Get("Connection"), "Upgrade")
+// Reports whether comma-separated values of header contain the given
+// token. Tokens are compared case-insensitively.
+func hasHeaderToken(headers http.Header, name, token string) bool {
+	for _, v := range headers.Values(name) {
+		for t := range strings.SplitSeq(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -0,0 +1,119 @@
+package wsok
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckConnectResponse(t *testing.T) {
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	const hash = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+
+	tests := []struct {
+		name     string
+		resp     string
+		protocol string
+		wantErr  bool
+	}{
+		{
+			name:    "1 lf line endings",
+			resp:    "HTTP/1.1 101 Switching Protocols\nConnection: Upgrade\nUpgrade: websocket\nSec-Websocket-Accept: " + hash + "\n\n",
+			wantErr: false,
+		},
+		{
+			name:    "2 crlf line endings",
+			resp:    "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + hash + "\r\n\r\n",
+			wantErr: false,
+		},
+		{
+			name:    "3 header case and extra headers",
+			resp:    "HTTP/1.1 101 Switching Protocols\r\nserver: nginx\r\nupgrade: WebSocket\r\nCONNECTION: keep-alive, upgrade\r\nsec-websocket-accept: " + hash + "\r\nDate: Sat, 17 Oct 2026 10:00:00 GMT\r\n\r\n",
+			wantErr: false,
+		},
+		{
+			name:     "4 offered subprotocol",
+			resp:     "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + hash + "\r\nSec-WebSocket-Protocol: higs\r\n\r\n",
+			protocol: "higs",
+			wantErr:  false,
+		},
+		{
+			name:    "5 subprotocol not offered",
+			resp:    "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + hash + "\r\nSec-WebSocket-Protocol: mqtt\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "6 bad status",
+			resp:    "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "7 bad accept hash",
+			resp:    "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: AAAA\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "8 no upgrade header",
+			resp:    "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + hash + "\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "9 extension not supported",
+			resp:    "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + hash + "\r\nSec-WebSocket-Extensions: permessage-deflate\r\n\r\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// response is followed by frame which must stay unread
+			r := bufio.NewReader(strings.NewReader(tt.resp + "\x82\x00"))
+			resp, err := ReadConnectResponse(r)
+			if err != nil {
+				t.Fatalf("ReadConnectResponse() error = %v", err)
+			}
+			if r.Buffered() != 2 {
+				t.Errorf("ReadConnectResponse() left %d bytes, want 2", r.Buffered())
+			}
+
+			protocol, err := CheckConnectResponse(resp, &ConnectConfig{
+				Key:          key,
+				Subprotocols: []string{"chat", "higs"},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckConnectResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if protocol != tt.protocol {
+				t.Errorf("CheckConnectResponse() protocol = %q, want %q", protocol, tt.protocol)
+			}
+		})
+	}
+}
+
+func TestWriteConnectRequest(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteConnectRequest(&buf, &ConnectConfig{
+		Subprotocols: []string{"chat", "higs"},
+		Path:         "/stream",
+		Key:          "dGhlIHNhbXBsZSBub25jZQ==",
+		Host:         "example.com",
+	})
+	if err != nil {
+		t.Fatalf("WriteConnectRequest() error = %v", err)
+	}
+	if strings.Count(buf.String(), "\n") != strings.Count(buf.String(), "\r\n") {
+		t.Errorf("WriteConnectRequest() lines do not end with crlf")
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("http.ReadRequest() error = %v", err)
+	}
+	if !HasUpgradeHeaders(req.Header) {
+		t.Errorf("WriteConnectRequest() has no upgrade headers: %v", req.Header)
+	}
+	if req.Header.Get("Sec-WebSocket-Protocol") != "chat, higs" {
+		t.Errorf("WriteConnectRequest() protocol header = %q", req.Header.Get("Sec-WebSocket-Protocol"))
+	}
+}
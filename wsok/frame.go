@@ -1,9 +1,11 @@
 package wsok
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand/v2"
@@ -19,8 +21,26 @@ const (
 	OpBin   OpCode = 0x2
 	OpClose OpCode = 0x8
 	OpPing  OpCode = 0x9
+	OpPong  OpCode = 0xA
 )
 
+// IsControl reports whether opcode belongs to control frame.
+func (op OpCode) IsControl() bool {
+	return op&0x8 != 0
+}
+
+func (op OpCode) valid() bool {
+	switch op {
+	case OpFrag, OpText, OpBin, OpClose, OpPing, OpPong:
+		return true
+	default:
+		return false
+	}
+}
+
+// MaxControlSize is maximum payload size of control frame.
+const MaxControlSize = 125
+
 const handshakeMagic = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 
 func GenHandshakeKey(g *rand.ChaCha8) string {
@@ -57,23 +77,106 @@ type Frame struct {
 	UseMask bool
 }
 
+// Decode reads frame from reader. Frame payload is placed
+// into a newly allocated slice.
+//
+// Payload size is not limited, use DecodeInto or Conn for reading
+// frames from untrusted peers.
 func Decode(r io.Reader, f *Frame) error {
-	// fixed buffer for reading frame header
-	var buf [12]byte
+	return decode(r, f, nil, false)
+}
+
+// DecodeInto same as Decode, but reads frame payload into the given
+// buffer. Thus frame data is valid only until buffer is reused.
+//
+// Frame with payload larger than buffer capacity is rejected with
+// ErrFrameSize before payload is read, so buffer capacity also caps
+// memory used by a single frame.
+func DecodeInto(r io.Reader, f *Frame, buf []byte) error {
+	return decode(r, f, buf, true)
+}
+
+var ErrFrameSize = errors.New("frame too large")
+
+// Payload larger than this is read in chunks, so that memory is not
+// allocated upfront for length which peer declared but never sent.
+const maxPreallocSize = 1 << 20
+
+func readPayload(r io.Reader, size uint64) ([]byte, error) {
+	if size <= maxPreallocSize {
+		data := make([]byte, size)
+		_, err := io.ReadFull(r, data)
+		return data, err
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(maxPreallocSize)
+	_, err := io.CopyN(&buf, r, int64(size))
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
-	n, err := r.Read(buf[:2])
+func decode(r io.Reader, f *Frame, buf []byte, fixed bool) error {
+	size, err := readHeader(r, f)
 	if err != nil {
 		return err
 	}
-	if n != 2 {
-		return fmt.Errorf("unable to read 2 frame header bytes (got %d)", n)
+
+	if fixed && size > uint64(cap(buf)) {
+		return fmt.Errorf("%w: %d bytes", ErrFrameSize, size)
 	}
 
-	fin := (buf[0] >> 7) == 1
-	ext := (buf[0] >> 4) & 0x7
-	op := OpCode(buf[0] & 0xf)
-	useMask := (buf[1] >> 7) == 1
-	sizeBits := buf[1] & 0x7f
+	var data []byte
+	if size != 0 {
+		var err error
+		if uint64(cap(buf)) >= size {
+			data = buf[:size]
+			_, err = io.ReadFull(r, data)
+		} else {
+			data, err = readPayload(r, size)
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.UseMask {
+		unmask(data, f.Mask)
+	}
+	f.Data = data
+	return nil
+}
+
+// ErrProtocol is returned for frames which violate websocket protocol.
+var ErrProtocol = errors.New("websocket protocol error")
+
+// Reads frame header and fills all frame fields except data.
+// Returns payload size declared in header.
+func readHeader(r io.Reader, f *Frame) (uint64, error) {
+	// fixed buffer for reading frame header
+	var hbuf [12]byte
+
+	// reader may return header in several parts, for example when
+	// it arrives in small network segments
+	_, err := io.ReadFull(r, hbuf[:2])
+	if err != nil {
+		// io.EOF is returned as is only if there is no frame at all
+		return 0, err
+	}
+
+	fin := (hbuf[0] >> 7) == 1
+	ext := (hbuf[0] >> 4) & 0x7
+	op := OpCode(hbuf[0] & 0xf)
+	useMask := (hbuf[1] >> 7) == 1
+	sizeBits := hbuf[1] & 0x7f
 
 	if debug {
 		fmt.Printf("fin: %v\n", fin)
@@ -83,27 +186,42 @@ func Decode(r io.Reader, f *Frame) error {
 		fmt.Printf("size bits: %b\n", sizeBits)
 	}
 
-	// TODO: check extension bits
-	// TODO: check opcode value
+	// extension bits are not checked here, since their meaning
+	// depends on extensions negotiated by caller
+	if !op.valid() {
+		return 0, fmt.Errorf("%w: unknown opcode 0x%x", ErrProtocol, uint8(op))
+	}
+	if op.IsControl() {
+		if !fin {
+			return 0, fmt.Errorf("%w: fragmented control frame", ErrProtocol)
+		}
+		if sizeBits > MaxControlSize {
+			return 0, fmt.Errorf("%w: control frame too large", ErrProtocol)
+		}
+	}
 
 	size := uint64(sizeBits)
 	pos := 0
 	headerExtraSize := getHeaderExtraSize(useMask, sizeBits)
 	if headerExtraSize > 0 {
-		n, err := r.Read(buf[:headerExtraSize])
-		if err != nil {
-			return err
+		_, err := io.ReadFull(r, hbuf[:headerExtraSize])
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
 		}
-		if n != headerExtraSize {
-			return fmt.Errorf("unable to read extra header bytes: got %d, want %d", n, headerExtraSize)
+		if err != nil {
+			return 0, err
 		}
 
 		if sizeBits == 126 {
-			size = uint64(binary.BigEndian.Uint16(buf[:2]))
+			size = uint64(binary.BigEndian.Uint16(hbuf[:2]))
 			pos = 2
 		} else if sizeBits == 127 {
-			size = binary.BigEndian.Uint64(buf[:8])
+			size = binary.BigEndian.Uint64(hbuf[:8])
 			pos = 8
+			if size>>63 != 0 {
+				// most significant bit must be 0
+				return 0, fmt.Errorf("%w: bad length 0x%016x", ErrFrameSize, size)
+			}
 		}
 	}
 
@@ -113,35 +231,25 @@ func Decode(r io.Reader, f *Frame) error {
 
 	var mask [4]byte
 	if useMask {
-		copy(mask[:], buf[pos:headerExtraSize])
+		copy(mask[:], hbuf[pos:headerExtraSize])
 		if debug {
 			fmt.Printf("mask: 0x%04x\n", mask)
 		}
 	}
 
-	var data []byte
-	if size != 0 {
-		data = make([]byte, size)
-		_, err := io.ReadFull(r, data)
-		if err != nil {
-			return err
-		}
-	}
-
-	if useMask {
-		// unmask payload
-		for i := 0; i < len(data); i++ {
-			data[i] ^= mask[i&0b11]
-		}
-	}
-
-	f.Data = data
+	f.Data = nil
 	f.Op = op
 	f.Ext = ext
 	f.Fin = fin
 	f.Mask = mask
 	f.UseMask = useMask
-	return nil
+	return size, nil
+}
+
+func unmask(data []byte, mask [4]byte) {
+	for i := 0; i < len(data); i++ {
+		data[i] ^= mask[i&0b11]
+	}
 }
 
 func getHeaderExtraSize(useMask bool, sizeBits uint8) int {
@@ -159,11 +267,13 @@ func getHeaderExtraSize(useMask bool, sizeBits uint8) int {
 	return size
 }
 
-func Encode(w io.Writer, f *Frame) error {
-	// fixed buffer for encoding frame header
-	var hbuf [14]byte
+// MaxHeaderSize is maximum size of encoded frame header.
+const MaxHeaderSize = 14
 
-	sizeBits, extraSize := getSizeBits(uint64(len(f.Data)))
+// Encodes frame header for payload of the given size into buffer.
+// Returns header length.
+func putHeader(hbuf *[MaxHeaderSize]byte, f *Frame, size int) int {
+	sizeBits, extraSize := getSizeBits(uint64(size))
 
 	hbuf[0] = (boolBit(f.Fin) << 7) | ((f.Ext & 0x7) << 4) | (uint8(f.Op) & 0xF)
 	hbuf[1] = (boolBit(f.UseMask) << 7) | sizeBits
@@ -174,9 +284,9 @@ func Encode(w io.Writer, f *Frame) error {
 	case 0:
 		// do nothing
 	case 2:
-		binary.BigEndian.PutUint16(hbuf[2:], uint16(len(f.Data)))
+		binary.BigEndian.PutUint16(hbuf[2:], uint16(size))
 	case 8:
-		binary.BigEndian.PutUint64(hbuf[2:], uint64(len(f.Data)))
+		binary.BigEndian.PutUint64(hbuf[2:], uint64(size))
 	default:
 		panic(fmt.Sprintf("unexpected extra size %d", extraSize))
 	}
@@ -186,6 +296,40 @@ func Encode(w io.Writer, f *Frame) error {
 		copy(hbuf[n:n+4], f.Mask[:])
 		n += 4
 	}
+	return n
+}
+
+// EncodeInPlace encodes frame which payload is stored in buf right after
+// MaxHeaderSize bytes of reserved room. Frame data field is ignored.
+//
+// Header is placed into the room just before payload and payload is masked
+// in place, thus the whole frame is written with a single call without
+// copying. Buffer contents are modified.
+func EncodeInPlace(w io.Writer, f *Frame, buf []byte) error {
+	if len(buf) < MaxHeaderSize {
+		panic("no header room")
+	}
+
+	payload := buf[MaxHeaderSize:]
+	var hbuf [MaxHeaderSize]byte
+	n := putHeader(&hbuf, f, len(payload))
+	start := MaxHeaderSize - n
+	copy(buf[start:], hbuf[:n])
+
+	if f.UseMask {
+		for i := range payload {
+			payload[i] ^= f.Mask[i&0b11]
+		}
+	}
+
+	_, err := w.Write(buf[start:])
+	return err
+}
+
+func Encode(w io.Writer, f *Frame) error {
+	// fixed buffer for encoding frame header
+	var hbuf [MaxHeaderSize]byte
+	n := putHeader(&hbuf, f, len(f.Data))
 
 	_, err := w.Write(hbuf[:n])
 	if err != nil {
@@ -2,64 +2,68 @@ package wsok
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"reflect"
 	"testing"
+	"testing/iotest"
 )
 
-func TestDecode(t *testing.T) {
-	tests := []struct {
-		name  string // description of this test case
-		frame Frame
-	}{
-		{
-			name: "1 empty no mask",
-			frame: Frame{
-				Data: nil,
-				Op:   OpBin,
-				Fin:  true,
-			},
+var decodeTests = []struct {
+	name  string // description of this test case
+	frame Frame
+}{
+	{
+		name: "1 empty no mask",
+		frame: Frame{
+			Data: nil,
+			Op:   OpBin,
+			Fin:  true,
 		},
-		{
-			name: "2 small data no mask",
-			frame: Frame{
-				Data: []byte("hello"),
-				Op:   OpBin,
-				Fin:  true,
-			},
+	},
+	{
+		name: "2 small data no mask",
+		frame: Frame{
+			Data: []byte("hello"),
+			Op:   OpBin,
+			Fin:  true,
 		},
-		{
-			name: "3 small data with mask",
-			frame: Frame{
-				Data:    []byte("hello"),
-				Op:      OpBin,
-				Fin:     true,
-				Mask:    [4]byte{0xAC, 0x13, 0xE9, 0x06},
-				UseMask: true,
-			},
+	},
+	{
+		name: "3 small data with mask",
+		frame: Frame{
+			Data:    []byte("hello"),
+			Op:      OpBin,
+			Fin:     true,
+			Mask:    [4]byte{0xAC, 0x13, 0xE9, 0x06},
+			UseMask: true,
 		},
-		{
-			name: "4 medium payload",
-			frame: Frame{
-				Data:    bytes.Repeat([]byte("hello world"), 1000),
-				Op:      OpBin,
-				Fin:     true,
-				Mask:    [4]byte{0xAC, 0x13, 0xE9, 0x06},
-				UseMask: true,
-			},
+	},
+	{
+		name: "4 medium payload",
+		frame: Frame{
+			Data:    bytes.Repeat([]byte("hello world"), 1000),
+			Op:      OpBin,
+			Fin:     true,
+			Mask:    [4]byte{0xAC, 0x13, 0xE9, 0x06},
+			UseMask: true,
 		},
-		{
-			name: "5 big payload",
-			frame: Frame{
-				Data:    bytes.Repeat([]byte("hello world"), 10000),
-				Op:      OpBin,
-				Fin:     true,
-				Mask:    [4]byte{0xAC, 0x13, 0xE9, 0x06},
-				UseMask: true,
-			},
+	},
+	{
+		name: "5 big payload",
+		frame: Frame{
+			Data:    bytes.Repeat([]byte("hello world"), 10000),
+			Op:      OpBin,
+			Fin:     true,
+			Mask:    [4]byte{0xAC, 0x13, 0xE9, 0x06},
+			UseMask: true,
 		},
-	}
+	},
+}
 
-	for _, tt := range tests {
+func TestDecode(t *testing.T) {
+	for _, tt := range decodeTests {
 		t.Run(tt.name, func(t *testing.T) {
 			var buf bytes.Buffer
 			err := Encode(&buf, &tt.frame)
@@ -80,3 +84,217 @@ func TestDecode(t *testing.T) {
 		})
 	}
 }
+
+func FuzzDecode(f *testing.F) {
+	for _, tt := range decodeTests {
+		var buf bytes.Buffer
+		err := Encode(&buf, &tt.frame)
+		if err != nil {
+			f.Fatalf("Encode() error = %v", err)
+		}
+		f.Add(buf.Bytes())
+	}
+	// length with most significant bit set
+	f.Add([]byte("\x82\x7f\xff\xff\xff\xff\xff\xff\xff\xff"))
+	// length of 1 TiB, but payload is not sent
+	f.Add([]byte("\x82\x7f\x00\x00\x01\x00\x00\x00\x00\x00hello"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var frame Frame
+		err := Decode(bytes.NewReader(data), &frame)
+		if err == nil && len(frame.Data) > len(data) {
+			t.Errorf("Decode() data length = %d, input length = %d", len(frame.Data), len(data))
+		}
+
+		buf := make([]byte, 0, 100)
+		err = DecodeInto(bytes.NewReader(data), &frame, buf)
+		if err == nil && len(frame.Data) > cap(buf) {
+			t.Errorf("DecodeInto() data length = %d, buffer capacity = %d", len(frame.Data), cap(buf))
+		}
+	})
+}
+
+func TestEncodeInPlace(t *testing.T) {
+	frames := []Frame{
+		{Data: nil, Op: OpBin, Fin: true},
+		{Data: []byte("hello"), Op: OpText, Fin: true},
+		{Data: bytes.Repeat([]byte("hello world"), 1000), Op: OpBin, Fin: true, Mask: [4]byte{0xAC, 0x13, 0xE9, 0x06}, UseMask: true},
+		{Data: bytes.Repeat([]byte("hello world"), 10000), Op: OpBin, Fin: true},
+	}
+
+	for _, f := range frames {
+		var want bytes.Buffer
+		err := Encode(&want, &f)
+		if err != nil {
+			t.Fatalf("Encode() error = %v", err)
+		}
+
+		buf := make([]byte, MaxHeaderSize, MaxHeaderSize+len(f.Data))
+		buf = append(buf, f.Data...)
+		var got bytes.Buffer
+		err = EncodeInPlace(&got, &f, buf)
+		if err != nil {
+			t.Fatalf("EncodeInPlace() error = %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("EncodeInPlace() output differs from Encode() for %d bytes payload", len(f.Data))
+		}
+
+		var frame Frame
+		err = DecodeInto(&got, &frame, make([]byte, 0, len(f.Data)))
+		if err != nil {
+			t.Fatalf("DecodeInto() error = %v", err)
+		}
+		if !bytes.Equal(frame.Data, f.Data) {
+			t.Errorf("DecodeInto() data mismatch for %d bytes payload", len(f.Data))
+		}
+	}
+}
+
+func TestDecodeIntoFrameSize(t *testing.T) {
+	var buf bytes.Buffer
+	err := Encode(&buf, &Frame{Data: make([]byte, 1000), Op: OpBin, Fin: true})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+
+	var frame Frame
+	err = DecodeInto(bytes.NewReader(buf.Bytes()), &frame, make([]byte, 0, 999))
+	if !errors.Is(err, ErrFrameSize) {
+		t.Errorf("DecodeInto() error = %v, want %v", err, ErrFrameSize)
+	}
+	err = DecodeInto(bytes.NewReader(buf.Bytes()), &frame, make([]byte, 0, 1000))
+	if err != nil {
+		t.Errorf("DecodeInto() error = %v", err)
+	}
+}
+
+func BenchmarkEncodeInPlace(b *testing.B) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1<<10)
+	buf := make([]byte, MaxHeaderSize+len(payload))
+	f := Frame{Op: OpBin, Fin: true, Mask: [4]byte{0xAC, 0x13, 0xE9, 0x06}, UseMask: true}
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	for b.Loop() {
+		copy(buf[MaxHeaderSize:], payload)
+		err := EncodeInPlace(io.Discard, &f, buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeInto(b *testing.B) {
+	var encoded bytes.Buffer
+	err := Encode(&encoded, &Frame{
+		Data:    bytes.Repeat([]byte("0123456789abcdef"), 1<<10),
+		Op:      OpBin,
+		Fin:     true,
+		Mask:    [4]byte{0xAC, 0x13, 0xE9, 0x06},
+		UseMask: true,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var r bytes.Reader
+	var f Frame
+	buf := make([]byte, 0, 1<<14)
+
+	b.SetBytes(1 << 14)
+	b.ReportAllocs()
+	for b.Loop() {
+		r.Reset(encoded.Bytes())
+		err := DecodeInto(&r, &f, buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecodeShortReads(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "7-bit length", size: 125},
+		{name: "16-bit length", size: 0xFFFF},
+		{name: "64-bit length", size: 0x10000},
+	}
+	for _, tt := range tests {
+		for _, useMask := range []bool{false, true} {
+			frame := Frame{
+				Data:    bytes.Repeat([]byte{0x5A}, tt.size),
+				Op:      OpBin,
+				Fin:     true,
+				UseMask: useMask,
+			}
+			if useMask {
+				frame.Mask = [4]byte{0xAC, 0x13, 0xE9, 0x06}
+			}
+			var encoded bytes.Buffer
+			err := Encode(&encoded, &frame)
+			if err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+
+			t.Run(fmt.Sprintf("%s mask=%t", tt.name, useMask), func(t *testing.T) {
+				var got Frame
+				err := Decode(iotest.OneByteReader(bytes.NewReader(encoded.Bytes())), &got)
+				if err != nil {
+					t.Fatalf("Decode() error = %v", err)
+				}
+				if !reflect.DeepEqual(&got, &frame) {
+					t.Errorf("Decode() got different frame")
+				}
+
+				err = DecodeInto(iotest.OneByteReader(bytes.NewReader(encoded.Bytes())), &got, make([]byte, 0, tt.size))
+				if err != nil {
+					t.Fatalf("DecodeInto() error = %v", err)
+				}
+				if !bytes.Equal(got.Data, frame.Data) {
+					t.Errorf("DecodeInto() got different data")
+				}
+
+				// client side expects unmasked frames
+				c := newConn(iotest.OneByteReader(bytes.NewReader(encoded.Bytes())), io.Discard, !useMask)
+				var m Message
+				err = c.ReadMessage(&m, nil)
+				if err != nil {
+					t.Fatalf("ReadMessage() error = %v", err)
+				}
+				if !bytes.Equal(m.Data, frame.Data) {
+					t.Errorf("ReadMessage() got different data")
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	var encoded bytes.Buffer
+	err := Encode(&encoded, &Frame{
+		Data:    []byte("hello"),
+		Op:      OpBin,
+		Fin:     true,
+		Mask:    [4]byte{0xAC, 0x13, 0xE9, 0x06},
+		UseMask: true,
+	})
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	data := encoded.Bytes()
+
+	var frame Frame
+	err = Decode(bytes.NewReader(nil), &frame)
+	if err != io.EOF {
+		t.Errorf("Decode() of empty input error = %v, want %v", err, io.EOF)
+	}
+	for n := 1; n < len(data); n++ {
+		err = Decode(iotest.OneByteReader(bytes.NewReader(data[:n])), &frame)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("Decode() of %d bytes error = %v, want %v", n, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
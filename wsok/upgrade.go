@@ -0,0 +1,133 @@
+package wsok
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type UpgradeOptions struct {
+	// Optional.
+	//
+	// Subprotocols supported by server in order of preference.
+	Subprotocols []string
+
+	// Optional.
+	//
+	// Extra headers for response.
+	ExtraHeaders []Header
+}
+
+var ErrUpgrade = errors.New("bad websocket upgrade request")
+
+// Upgrade completes server side of websocket handshake and takes over
+// request connection. Nil options mean defaults.
+//
+// Bad upgrade request is answered with corresponding HTTP error status
+// and ErrUpgrade is returned.
+func Upgrade(w http.ResponseWriter, r *http.Request, opts *UpgradeOptions) (*Conn, error) {
+	if opts == nil {
+		opts = &UpgradeOptions{}
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("%w: method %s", ErrUpgrade, r.Method)
+	}
+	if !HasUpgradeHeaders(r.Header) {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, fmt.Errorf("%w: no upgrade headers", ErrUpgrade)
+	}
+	version := r.Header.Get("Sec-WebSocket-Version")
+	if version != "13" {
+		// tell client which version is supported
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		w.WriteHeader(http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("%w: version %q", ErrUpgrade, version)
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !checkHandshakeKey(key) {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, fmt.Errorf("%w: bad key %q", ErrUpgrade, key)
+	}
+	protocol := selectSubprotocol(r.Header, opts.Subprotocols)
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, errors.New("response writer does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, err
+	}
+	// server may have set deadlines for reading request
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	err = writeUpgradeResponse(rw, key, protocol, opts.ExtraHeaders)
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := NewConn(conn, rw, false)
+	c.subprotocol = protocol
+	return c, nil
+}
+
+func writeUpgradeResponse(w io.Writer, key string, protocol string, extra []Header) error {
+	_, err := io.WriteString(w, "HTTP/1.1 101 Switching Protocols\r\n")
+	if err != nil {
+		return err
+	}
+
+	headers := []Header{
+		{"Upgrade", "websocket"},
+		{"Connection", "Upgrade"},
+		{"Sec-WebSocket-Accept", HashHandshakeKey(key)},
+		{"Sec-WebSocket-Protocol", protocol},
+	}
+	for _, h := range append(headers, extra...) {
+		err = writeHeader(w, h.Name, h.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = io.WriteString(w, "\r\n")
+	return err
+}
+
+// Handshake key must be base64 encoding of 16 bytes.
+func checkHandshakeKey(key string) bool {
+	b, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(b) == 16
+}
+
+// Picks first subprotocol supported by server which client has offered.
+// Returns empty string if there is no such protocol. Unlike header tokens
+// subprotocol names are case-sensitive.
+func selectSubprotocol(headers http.Header, supported []string) string {
+	for _, p := range supported {
+		for _, v := range headers.Values("Sec-WebSocket-Protocol") {
+			for o := range strings.SplitSeq(v, ",") {
+				if strings.TrimSpace(o) == p {
+					return p
+				}
+			}
+		}
+	}
+	return ""
+}
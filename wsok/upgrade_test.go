@@ -0,0 +1,163 @@
+package wsok
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpgrade(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r, &UpgradeOptions{
+			Subprotocols: []string{"higs", "chat"},
+			ExtraHeaders: []Header{{Name: "Server", Value: "nginx"}},
+		})
+		if err != nil {
+			t.Errorf("Upgrade() error = %v", err)
+			return
+		}
+		defer c.Close()
+
+		// echo messages prefixed with negotiated subprotocol
+		var m Message
+		for {
+			err = c.ReadMessage(&m, nil)
+			if err != nil {
+				return
+			}
+			err = c.WriteMessage(m.Op, append([]byte(c.Subprotocol()+": "), m.Data...))
+			if err == nil {
+				err = c.Flush()
+			}
+			if err != nil {
+				t.Errorf("WriteMessage() error = %v", err)
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	cfg := ConnectConfig{
+		Subprotocols: []string{"mqtt", "chat", "higs"},
+		Path:         "/",
+		Key:          "dGhlIHNhbXBsZSBub25jZQ==",
+		Host:         srv.Listener.Addr().String(),
+	}
+	err = WriteConnectRequest(rw, &cfg)
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		t.Fatalf("WriteConnectRequest() error = %v", err)
+	}
+	resp, err := ReadConnectResponse(rw.Reader)
+	if err != nil {
+		t.Fatalf("ReadConnectResponse() error = %v", err)
+	}
+	if !strings.HasSuffix(string(resp), "\r\n\r\n") || !strings.Contains(string(resp), "Server: nginx\r\n") {
+		t.Errorf("Upgrade() response = %q", resp)
+	}
+	protocol, err := CheckConnectResponse(resp, &cfg)
+	if err != nil {
+		t.Fatalf("CheckConnectResponse() error = %v", err)
+	}
+	if protocol != "higs" {
+		t.Errorf("CheckConnectResponse() protocol = %q, want %q", protocol, "higs")
+	}
+
+	c := NewConn(conn, rw, true)
+	defer c.Close()
+	_, err = c.Write([]byte("hello"))
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	var m Message
+	err = c.ReadMessage(&m, nil)
+	if err != nil {
+		t.Fatalf("ReadMessage() error = %v", err)
+	}
+	if string(m.Data) != "higs: hello" {
+		t.Errorf("ReadMessage() got = %q, want %q", m.Data, "higs: hello")
+	}
+}
+
+func TestUpgradeBadRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		status  int
+	}{
+		{
+			name:   "1 bad method",
+			method: http.MethodPost,
+			headers: map[string]string{
+				"Upgrade":               "websocket",
+				"Connection":            "Upgrade",
+				"Sec-WebSocket-Version": "13",
+				"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+			},
+			status: http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "2 no upgrade headers",
+			method: http.MethodGet,
+			headers: map[string]string{
+				"Sec-WebSocket-Version": "13",
+				"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+			},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "3 old version",
+			method: http.MethodGet,
+			headers: map[string]string{
+				"Upgrade":               "websocket",
+				"Connection":            "Upgrade",
+				"Sec-WebSocket-Version": "8",
+				"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+			},
+			status: http.StatusUpgradeRequired,
+		},
+		{
+			name:   "4 bad key",
+			method: http.MethodGet,
+			headers: map[string]string{
+				"Upgrade":               "websocket",
+				"Connection":            "Upgrade",
+				"Sec-WebSocket-Version": "13",
+				"Sec-WebSocket-Key":     "short",
+			},
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", nil)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+
+			_, err := Upgrade(w, r, nil)
+			if !errors.Is(err, ErrUpgrade) {
+				t.Errorf("Upgrade() error = %v, want %v", err, ErrUpgrade)
+			}
+			if w.Code != tt.status {
+				t.Errorf("Upgrade() status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}